@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Callers authenticate with a static API key or a JWT bearer token. Once any
+// of these is configured (auth section of the config), every route but the
+// publicPaths requires one:
+//
+//	PDF_API_KEYS       comma-separated name=key pairs; the name identifies the caller
+//	PDF_JWT_SECRET     HMAC secret for HS256/HS384/HS512 tokens
+//	PDF_JWT_JWKS_FILE  JSON Web Key Set for RS*, PS*, ES* and EdDSA tokens
+//	PDF_JWT_ISSUER     required "iss", if set
+//	PDF_JWT_AUDIENCE   required "aud", if set
+//
+// API keys come in X-API-Key or as a bearer token. Tokens come in the
+// Authorization header or, for browsers loading previews and download links,
+// in the cookie named by PDF_AUTH_COOKIE (default "access_token"). A token's
+// "sub" claim identifies the caller. Callers are "key:<name>" or "jwt:<sub>",
+// so a token cannot pass for an API key whose name matches its subject.
+type authConfig struct {
+	apiKeys    []apiKey
+	jwtSecret  []byte
+	jwks       map[string]any // kid -> public key
+	issuer     string
+	audience   string
+	cookieName string
+}
+
+type apiKey struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+// principal is an authenticated caller. Jobs and uploads belong to the
+// principal that created them.
+type principal struct {
+	ID     string
+	Method string // "api-key" or "jwt"
+}
+
+var auth authConfig
+
+var errUnauthenticated = errors.New("authentication required")
+
+func loadAuth() error {
+	a := authConfig{
+		issuer:     cfg.Auth.Issuer,
+		audience:   cfg.Auth.Audience,
+		cookieName: cfg.Auth.Cookie,
+	}
+	for name, key := range cfg.Auth.APIKeys {
+		if name == "" || key == "" {
+			return fmt.Errorf("PDF_API_KEYS: empty name or key")
+		}
+		a.apiKeys = append(a.apiKeys, apiKey{name: name, hash: sha256.Sum256([]byte(key))})
+	}
+	if cfg.Auth.JWTSecret != "" {
+		a.jwtSecret = []byte(cfg.Auth.JWTSecret)
+	}
+	if p := cfg.Auth.JWKSFile; p != "" {
+		keys, err := loadJWKS(p)
+		if err != nil {
+			return fmt.Errorf("PDF_JWT_JWKS_FILE: %w", err)
+		}
+		a.jwks = keys
+	}
+	auth = a
+	if !auth.enabled() {
+		slog.Warn("no API keys or JWT verification configured; authentication is disabled")
+	}
+	return nil
+}
+
+func (a *authConfig) enabled() bool {
+	return len(a.apiKeys) > 0 || a.jwtSecret != nil || len(a.jwks) > 0
+}
+
+// authenticate identifies the caller of r.
+func (a *authConfig) authenticate(r *http.Request) (principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if name, ok := a.lookupKey(key); ok {
+			return keyPrincipal(name), nil
+		}
+		return principal{}, errors.New("invalid API key")
+	}
+
+	token := ""
+	if v := r.Header.Get("Authorization"); v != "" {
+		scheme, rest, _ := strings.Cut(v, " ")
+		if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(rest) == "" {
+			return principal{}, errors.New("unsupported Authorization scheme")
+		}
+		token = strings.TrimSpace(rest)
+		if name, ok := a.lookupKey(token); ok {
+			return keyPrincipal(name), nil
+		}
+	} else if c, err := r.Cookie(a.cookieName); err == nil && c.Value != "" {
+		token = c.Value
+	}
+	if token == "" {
+		return principal{}, errUnauthenticated
+	}
+	sub, err := a.verifyJWT(token)
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{ID: "jwt:" + sub, Method: "jwt"}, nil
+}
+
+func keyPrincipal(name string) principal {
+	return principal{ID: "key:" + name, Method: "api-key"}
+}
+
+func (a *authConfig) lookupKey(key string) (string, bool) {
+	h := sha256.Sum256([]byte(key))
+	name, found := "", false
+	// Compare against every key so timing does not reveal which one matched.
+	for _, k := range a.apiKeys {
+		if subtle.ConstantTimeCompare(h[:], k.hash[:]) == 1 {
+			name, found = k.name, true
+		}
+	}
+	return name, found
+}
+
+// verifyJWT checks a token's signature and claims and returns its subject.
+func (a *authConfig) verifyJWT(token string) (string, error) {
+	if a.jwtSecret == nil && len(a.jwks) == 0 {
+		return "", errors.New("bearer tokens are not accepted")
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+	t, err := jwt.Parse(token, a.jwtKey, opts...)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %w", err)
+	}
+	sub, err := t.Claims.GetSubject()
+	if err != nil || sub == "" {
+		return "", errors.New("invalid token: no subject")
+	}
+	return sub, nil
+}
+
+// jwtKey picks the verification key for a token. HMAC tokens only ever
+// verify against the shared secret, and signed tokens only against the JWKS,
+// so one kind of key cannot be passed off as the other.
+func (a *authConfig) jwtKey(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if a.jwtSecret == nil {
+			return nil, errors.New("HMAC tokens are not accepted")
+		}
+		return a.jwtSecret, nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	if k, ok := a.jwks[kid]; ok {
+		return k, nil
+	}
+	if kid == "" && len(a.jwks) == 1 {
+		for _, k := range a.jwks {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS reads the public keys of a JSON Web Key Set. Keys meant for
+// encryption are skipped.
+func loadJWKS(p string) (map[string]any, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		k, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = k
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	b64 := base64.RawURLEncoding
+	switch jwk.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(jwk.N)
+		e, err2 := b64.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err1 := b64.DecodeString(jwk.X)
+		y, err2 := b64.DecodeString(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		k := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(k.X, k.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return k, nil
+	case "OKP":
+		x, err := b64.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+type principalKey struct{}
+
+// publicPaths are served without credentials: probes for orchestrators and
+// load balancers, and the metrics scrape.
+var publicPaths = map[string]bool{
+	"/health":    true,
+	"/ready":     true,
+	"/metrics":   true,
+	"/api/queue": true,
+}
+
+// requireAuth rejects unauthenticated requests and attaches the caller to the
+// request context of the rest.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.enabled() || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := auth.authenticate(r)
+		if err != nil {
+			slog.InfoContext(r.Context(), "authentication failed", "err", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pdf-backend"`)
+			errorJSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		setLogCaller(r.Context(), p.ID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// callerID is the identity of the request's caller, or "" when
+// authentication is disabled.
+func callerID(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p.ID
+}
+
+// canAccess reports whether the caller may see something owned by owner.
+func canAccess(r *http.Request, owner string) bool {
+	return !auth.enabled() || owner == callerID(r)
+}
+
+// jobOwner returns who submitted a job, whether it is still in memory or
+// only in the store.
+func jobOwner(id string) (string, bool) {
+	if j := jobs.get(id); j != nil {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return j.Owner, true
+	}
+	if rec, ok := store.get(id); ok {
+		return rec.Owner, true
+	}
+	return "", false
+}
+
+// canAccessFile reports whether the caller may fetch a job file; key starts
+// with the job ID.
+func canAccessFile(r *http.Request, key string) bool {
+	if !auth.enabled() {
+		return true
+	}
+	jobID, _, _ := strings.Cut(key, "/")
+	owner, ok := jobOwner(jobID)
+	return ok && canAccess(r, owner)
+}
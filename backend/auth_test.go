@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := authConfig{
+		apiKeys:    []apiKey{{name: "ci", hash: sha256.Sum256([]byte("ci-key"))}},
+		jwtSecret:  []byte("jwt-secret"),
+		issuer:     "https://issuer.example",
+		cookieName: "access_token",
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := testToken(t, "jwt-secret", jwt.MapClaims{"sub": "alice", "iss": "https://issuer.example", "exp": exp})
+	// A token whose subject is an API key's name is still not that key.
+	namesake := testToken(t, "jwt-secret", jwt.MapClaims{"sub": "ci", "iss": "https://issuer.example", "exp": exp})
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "alice", "iss": "https://issuer.example", "exp": exp}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		cookie  string
+		want    string // caller ID, or "" when refused
+		wantErr bool
+	}{
+		{"api key header", map[string]string{"X-API-Key": "ci-key"}, "", "key:ci", false},
+		{"api key as bearer", map[string]string{"Authorization": "Bearer ci-key"}, "", "key:ci", false},
+		{"wrong api key", map[string]string{"X-API-Key": "nope"}, "", "", true},
+		{"jwt", map[string]string{"Authorization": "Bearer " + valid}, "", "jwt:alice", false},
+		{"jwt in cookie", nil, valid, "jwt:alice", false},
+		{"jwt named like a key", map[string]string{"Authorization": "Bearer " + namesake}, "", "jwt:ci", false},
+		{"wrong secret", map[string]string{"Authorization": "Bearer " + testToken(t, "other", jwt.MapClaims{"sub": "alice", "iss": "https://issuer.example", "exp": exp})}, "", "", true},
+		{"expired", map[string]string{"Authorization": "Bearer " + testToken(t, "jwt-secret", jwt.MapClaims{"sub": "alice", "iss": "https://issuer.example", "exp": time.Now().Add(-time.Minute).Unix()})}, "", "", true},
+		{"no expiry", map[string]string{"Authorization": "Bearer " + testToken(t, "jwt-secret", jwt.MapClaims{"sub": "alice", "iss": "https://issuer.example"})}, "", "", true},
+		{"wrong issuer", map[string]string{"Authorization": "Bearer " + testToken(t, "jwt-secret", jwt.MapClaims{"sub": "alice", "iss": "https://evil.example", "exp": exp})}, "", "", true},
+		{"no subject", map[string]string{"Authorization": "Bearer " + testToken(t, "jwt-secret", jwt.MapClaims{"iss": "https://issuer.example", "exp": exp})}, "", "", true},
+		{"alg none", map[string]string{"Authorization": "Bearer " + unsigned}, "", "", true},
+		{"basic auth", map[string]string{"Authorization": "Basic Y2k6Y2kta2V5"}, "", "", true},
+		{"nothing", nil, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/jobs", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "access_token", Value: tt.cookie})
+			}
+			p, err := a.authenticate(r)
+			if (err != nil) != tt.wantErr || p.ID != tt.want {
+				t.Errorf("authenticate = %q, %v; want %q, error %v", p.ID, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequireAuthPublicPaths(t *testing.T) {
+	withAuth(t, "ci")
+	h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for path, want := range map[string]int{
+		"/health":    http.StatusOK,
+		"/ready":     http.StatusOK,
+		"/metrics":   http.StatusOK,
+		"/api/queue": http.StatusOK,
+		"/api/jobs":  http.StatusUnauthorized,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s without credentials: %d, want %d", path, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is every setting an operator can tune. It is read once at startup:
+// defaults first, then the YAML file named by PDF_CONFIG_FILE, if any, then
+// environment variables, which win. Keys in the file use the yaml tags below;
+// each setting's environment variable is listed in loadConfigEnv.
+type config struct {
+	Listen             string        `yaml:"listen"`
+	WorkDir            string        `yaml:"workDir"`
+	UploadDir          string        `yaml:"uploadDir"`
+	JobDB              string        `yaml:"jobDB"`
+	Retention          time.Duration `yaml:"retention"`
+	CleanupInterval    time.Duration `yaml:"cleanupInterval"`
+	JobRecordRetention time.Duration `yaml:"jobRecordRetention"`
+	ShutdownTimeout    time.Duration `yaml:"shutdownTimeout"`
+
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies
+	// in front of the server. Only their X-Forwarded-For is believed; without
+	// any, clients are told apart by the address they connect from.
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	// DisabledTools are tool routes not served at all, e.g. the office
+	// conversions on an instance without LibreOffice. ProbeInterval is how
+	// often the toolchain is checked for /ready.
+	DisabledTools []string      `yaml:"disabledTools"`
+	ProbeInterval time.Duration `yaml:"probeInterval"`
+
+	Log struct {
+		Level  string `yaml:"level"`  // debug, info, warn or error
+		Format string `yaml:"format"` // json or text
+	} `yaml:"log"`
+
+	Tracing struct {
+		Exporter    string  `yaml:"exporter"` // none, otlp or stdout
+		Endpoint    string  `yaml:"endpoint"` // OTLP/HTTP URL
+		SampleRatio float64 `yaml:"sampleRatio"`
+	} `yaml:"tracing"`
+
+	Uploads struct {
+		// MaxRequestSize caps the files of one tool request, unless
+		// ToolRequestSize has a cap for that tool; MaxFieldsSize caps its
+		// other fields. MaxBundleSize caps an HTML bundle once unpacked.
+		MaxRequestSize     byteSize            `yaml:"maxRequestSize"`
+		ToolRequestSize    map[string]byteSize `yaml:"toolRequestSize"` // tool -> cap
+		MaxFieldsSize      byteSize            `yaml:"maxFieldsSize"`
+		MaxBundleSize      byteSize            `yaml:"maxBundleSize"`
+		MaxResumableSize   byteSize            `yaml:"maxResumableSize"`
+		ResumableRetention time.Duration       `yaml:"resumableRetention"`
+	} `yaml:"uploads"`
+
+	Render struct {
+		PreviewDPI int `yaml:"previewDPI"`
+		RedactDPI  int `yaml:"redactDPI"`
+		JPGDPI     int `yaml:"jpgDPI"`
+		JPGMinDPI  int `yaml:"jpgMinDPI"`
+		JPGMaxDPI  int `yaml:"jpgMaxDPI"`
+	} `yaml:"render"`
+
+	// Documents bounds what an upload may ask of the tools; see doclimits.go.
+	Documents struct {
+		MaxPages        int      `yaml:"maxPages"`
+		MaxPageSide     int      `yaml:"maxPageSide"` // points
+		MaxStreamSize   byteSize `yaml:"maxStreamSize"`
+		MaxImagePixels  int      `yaml:"maxImagePixels"`
+		MaxRasterPixels int      `yaml:"maxRasterPixels"`
+	} `yaml:"documents"`
+
+	Links struct {
+		Secret string        `yaml:"secret"`
+		TTL    time.Duration `yaml:"ttl"`
+	} `yaml:"links"`
+
+	WebhookSecret string `yaml:"webhookSecret"`
+
+	// Fetch limits the hosts html-to-pdf may load pages from; see
+	// fetchpolicy.go.
+	Fetch struct {
+		AllowHosts []string `yaml:"allowHosts"`
+		DenyHosts  []string `yaml:"denyHosts"`
+	} `yaml:"fetch"`
+
+	Storage struct {
+		Backend string `yaml:"backend"`
+		S3      struct {
+			Endpoint   string        `yaml:"endpoint"`
+			Bucket     string        `yaml:"bucket"`
+			Region     string        `yaml:"region"`
+			AccessKey  string        `yaml:"accessKey"`
+			SecretKey  string        `yaml:"secretKey"`
+			Prefix     string        `yaml:"prefix"`
+			Insecure   bool          `yaml:"insecure"`
+			PresignTTL time.Duration `yaml:"presignTTL"`
+		} `yaml:"s3"`
+	} `yaml:"storage"`
+
+	Auth struct {
+		APIKeys   map[string]string `yaml:"apiKeys"` // name -> key
+		JWTSecret string            `yaml:"jwtSecret"`
+		JWKSFile  string            `yaml:"jwksFile"`
+		Issuer    string            `yaml:"issuer"`
+		Audience  string            `yaml:"audience"`
+		Cookie    string            `yaml:"cookie"`
+	} `yaml:"auth"`
+
+	// These take the same "k=v,k=v" strings as their environment variables.
+	RateLimit string            `yaml:"rateLimit"`
+	Quota     string            `yaml:"quota"`
+	Pools     map[string]string `yaml:"pools"`  // class -> settings
+	Limits    map[string]string `yaml:"limits"` // binary -> settings
+}
+
+// toolEnabled reports whether the tool's routes are served.
+func (c *config) toolEnabled(name string) bool {
+	return !slices.Contains(c.DisabledTools, name)
+}
+
+// cfg is the running configuration.
+var cfg = defaultConfig()
+
+func defaultConfig() config {
+	var c config
+	c.Listen = ":8080"
+	c.WorkDir = "/app/work"
+	c.UploadDir = "/app/uploads"
+	c.JobDB = "/app/data/jobs.db"
+	c.Retention = 2 * time.Hour
+	c.CleanupInterval = 30 * time.Minute
+	c.JobRecordRetention = 30 * 24 * time.Hour
+	c.ShutdownTimeout = 30 * time.Second
+	c.ProbeInterval = 5 * time.Minute
+	c.Log.Level = "info"
+	c.Log.Format = "json"
+	c.Tracing.Exporter = "none"
+	c.Tracing.SampleRatio = 1
+	c.Uploads.MaxRequestSize = 2 << 30
+	c.Uploads.MaxFieldsSize = 10 << 20
+	c.Uploads.MaxBundleSize = 1 << 30
+	c.Uploads.MaxResumableSize = 4 << 30
+	c.Uploads.ResumableRetention = 24 * time.Hour
+	// 110 DPI is a good speed/quality compromise for card thumbnails; redaction
+	// rasterizes at print quality so the result stays legible.
+	c.Render.PreviewDPI = 110
+	c.Render.RedactDPI = 300
+	c.Render.JPGDPI = 150
+	c.Render.JPGMinDPI = 72
+	c.Render.JPGMaxDPI = 600
+	// 14400 pt (200 in) is the largest page PDF viewers are required to
+	// support. 5 gigapixels is some 600 letter pages at the redaction DPI.
+	c.Documents.MaxPages = 2000
+	c.Documents.MaxPageSide = 14400
+	c.Documents.MaxStreamSize = 2 << 30
+	c.Documents.MaxImagePixels = 100_000_000
+	c.Documents.MaxRasterPixels = 5_000_000_000
+	c.Links.TTL = 2 * time.Hour
+	c.Storage.Backend = "local"
+	c.Storage.S3.PresignTTL = 15 * time.Minute
+	c.Auth.Cookie = "access_token"
+	c.Pools = map[string]string{}
+	c.Limits = map[string]string{}
+	return c
+}
+
+// loadConfig reads and validates the configuration into cfg.
+func loadConfig() error {
+	c := defaultConfig()
+	if p := os.Getenv("PDF_CONFIG_FILE"); p != "" {
+		if err := loadConfigFile(&c, p); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	if err := loadConfigEnv(&c); err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	cfg = c
+	return nil
+}
+
+func loadConfigFile(c *config, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	// A misspelt key would otherwise be ignored without a word.
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if c.Pools == nil {
+		c.Pools = map[string]string{}
+	}
+	if c.Limits == nil {
+		c.Limits = map[string]string{}
+	}
+	return nil
+}
+
+func loadConfigEnv(c *config) error {
+	var errs []error
+	str := func(dst *string, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	dur := func(dst *time.Duration, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", key, v))
+			}
+			*dst = d
+		}
+	}
+	num := func(dst *int, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", key, v))
+			}
+			*dst = n
+		}
+	}
+	size := func(dst *byteSize, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := parseByteSize(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+			*dst = byteSize(n)
+		}
+	}
+	ratio := func(dst *float64, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", key, v))
+			}
+			*dst = f
+		}
+	}
+	list := func(dst *[]string, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = nil
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		}
+	}
+	flag := func(dst *bool, key string) {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid boolean %q", key, v))
+			}
+			*dst = b
+		}
+	}
+
+	str(&c.Listen, "PDF_LISTEN_ADDR")
+	str(&c.WorkDir, "PDF_WORK_DIR")
+	str(&c.UploadDir, "PDF_UPLOAD_DIR")
+	str(&c.JobDB, "PDF_JOB_DB")
+	dur(&c.Retention, "PDF_RETENTION")
+	dur(&c.CleanupInterval, "PDF_CLEANUP_INTERVAL")
+	dur(&c.JobRecordRetention, "PDF_JOB_RECORD_RETENTION")
+	dur(&c.ShutdownTimeout, "PDF_SHUTDOWN_TIMEOUT")
+	list(&c.TrustedProxies, "PDF_TRUSTED_PROXIES")
+	list(&c.DisabledTools, "PDF_DISABLED_TOOLS")
+	dur(&c.ProbeInterval, "PDF_PROBE_INTERVAL")
+	str(&c.Log.Level, "PDF_LOG_LEVEL")
+	str(&c.Log.Format, "PDF_LOG_FORMAT")
+	str(&c.Tracing.Exporter, "PDF_TRACING_EXPORTER")
+	str(&c.Tracing.Endpoint, "PDF_TRACING_ENDPOINT")
+	ratio(&c.Tracing.SampleRatio, "PDF_TRACING_SAMPLE_RATIO")
+
+	size(&c.Uploads.MaxRequestSize, "PDF_MAX_REQUEST_SIZE")
+	if v, ok := os.LookupEnv("PDF_TOOL_REQUEST_SIZES"); ok {
+		c.Uploads.ToolRequestSize = map[string]byteSize{}
+		err := parseSettings(v, func(tool, raw string) error {
+			n, err := parseByteSize(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", tool, err)
+			}
+			c.Uploads.ToolRequestSize[tool] = byteSize(n)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PDF_TOOL_REQUEST_SIZES: %w", err))
+		}
+	}
+	size(&c.Uploads.MaxFieldsSize, "PDF_MAX_FIELDS_SIZE")
+	size(&c.Uploads.MaxBundleSize, "PDF_MAX_BUNDLE_SIZE")
+	size(&c.Uploads.MaxResumableSize, "PDF_MAX_RESUMABLE_SIZE")
+	dur(&c.Uploads.ResumableRetention, "PDF_RESUMABLE_RETENTION")
+
+	num(&c.Render.PreviewDPI, "PDF_PREVIEW_DPI")
+	num(&c.Render.RedactDPI, "PDF_REDACT_DPI")
+	num(&c.Render.JPGDPI, "PDF_JPG_DPI")
+	num(&c.Render.JPGMinDPI, "PDF_JPG_MIN_DPI")
+	num(&c.Render.JPGMaxDPI, "PDF_JPG_MAX_DPI")
+
+	num(&c.Documents.MaxPages, "PDF_MAX_PAGES")
+	num(&c.Documents.MaxPageSide, "PDF_MAX_PAGE_SIDE")
+	size(&c.Documents.MaxStreamSize, "PDF_MAX_STREAM_SIZE")
+	num(&c.Documents.MaxImagePixels, "PDF_MAX_IMAGE_PIXELS")
+	num(&c.Documents.MaxRasterPixels, "PDF_MAX_RASTER_PIXELS")
+
+	str(&c.Links.Secret, "PDF_LINK_SECRET")
+	dur(&c.Links.TTL, "PDF_LINK_TTL")
+	str(&c.WebhookSecret, "PDF_WEBHOOK_SECRET")
+	list(&c.Fetch.AllowHosts, "PDF_FETCH_ALLOW_HOSTS")
+	list(&c.Fetch.DenyHosts, "PDF_FETCH_DENY_HOSTS")
+
+	str(&c.Storage.Backend, "PDF_STORAGE")
+	str(&c.Storage.S3.Endpoint, "PDF_S3_ENDPOINT")
+	str(&c.Storage.S3.Bucket, "PDF_S3_BUCKET")
+	str(&c.Storage.S3.Region, "PDF_S3_REGION")
+	str(&c.Storage.S3.AccessKey, "PDF_S3_ACCESS_KEY")
+	str(&c.Storage.S3.SecretKey, "PDF_S3_SECRET_KEY")
+	str(&c.Storage.S3.Prefix, "PDF_S3_PREFIX")
+	flag(&c.Storage.S3.Insecure, "PDF_S3_INSECURE")
+	dur(&c.Storage.S3.PresignTTL, "PDF_S3_PRESIGN_TTL")
+
+	if v, ok := os.LookupEnv("PDF_API_KEYS"); ok {
+		c.Auth.APIKeys = map[string]string{}
+		err := parseSettings(v, func(name, key string) error {
+			if name == "" || key == "" {
+				return fmt.Errorf("want name=key pairs")
+			}
+			c.Auth.APIKeys[name] = key
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PDF_API_KEYS: %w", err))
+		}
+	}
+	str(&c.Auth.JWTSecret, "PDF_JWT_SECRET")
+	str(&c.Auth.JWKSFile, "PDF_JWT_JWKS_FILE")
+	str(&c.Auth.Issuer, "PDF_JWT_ISSUER")
+	str(&c.Auth.Audience, "PDF_JWT_AUDIENCE")
+	str(&c.Auth.Cookie, "PDF_AUTH_COOKIE")
+
+	str(&c.RateLimit, "PDF_RATE_LIMIT")
+	str(&c.Quota, "PDF_QUOTA")
+
+	for _, kv := range os.Environ() {
+		key, v, _ := strings.Cut(kv, "=")
+		if rest, ok := strings.CutPrefix(key, "PDF_POOL_"); ok {
+			c.Pools[strings.ToLower(rest)] = v
+		}
+		if rest, ok := strings.CutPrefix(key, "PDF_LIMITS_"); ok {
+			c.Limits[strings.ToLower(rest)] = v
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Listen != "", "listen address is empty")
+	for name, dir := range map[string]string{"workDir": c.WorkDir, "uploadDir": c.UploadDir, "jobDB": c.JobDB} {
+		check(filepath.IsAbs(dir), "%s must be an absolute path, got %q", name, dir)
+	}
+	// Resumable uploads must not be reachable through /downloads/.
+	check(!within(c.UploadDir, c.WorkDir), "uploadDir must not be inside workDir")
+	check(c.Retention > 0, "retention must be positive")
+	check(c.CleanupInterval > 0, "cleanupInterval must be positive")
+	check(c.JobRecordRetention >= c.Retention, "jobRecordRetention must be at least retention")
+	check(c.ShutdownTimeout > 0, "shutdownTimeout must be positive")
+	for _, p := range c.TrustedProxies {
+		_, err := parsePrefix(p)
+		check(err == nil, "trustedProxies: invalid address or CIDR range %q", p)
+	}
+	for _, name := range c.DisabledTools {
+		check(slices.ContainsFunc(pdfTools, func(t pdfTool) bool { return t.name == name }), "disabledTools: unknown tool %q", name)
+	}
+	check(c.ProbeInterval > 0, "probeInterval must be positive")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level: unknown level %q", c.Log.Level)
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be json or text, got %q", c.Log.Format)
+	check(slices.Contains([]string{"none", "otlp", "stdout"}, c.Tracing.Exporter), "tracing.exporter must be none, otlp or stdout, got %q", c.Tracing.Exporter)
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sampleRatio must be between 0 and 1")
+	check(c.Uploads.MaxRequestSize > 0, "uploads.maxRequestSize must be positive")
+	for name, n := range c.Uploads.ToolRequestSize {
+		check(name == pipelineTool.name || slices.ContainsFunc(pdfTools, func(t pdfTool) bool { return t.name == name }), "uploads.toolRequestSize: unknown tool %q", name)
+		check(n > 0, "uploads.toolRequestSize.%s must be positive", name)
+	}
+	check(c.Uploads.MaxFieldsSize > 0, "uploads.maxFieldsSize must be positive")
+	check(c.Uploads.MaxBundleSize > 0, "uploads.maxBundleSize must be positive")
+	check(c.Uploads.MaxResumableSize > 0, "uploads.maxResumableSize must be positive")
+	check(c.Uploads.ResumableRetention > 0, "uploads.resumableRetention must be positive")
+	for name, dpi := range map[string]int{"previewDPI": c.Render.PreviewDPI, "redactDPI": c.Render.RedactDPI, "jpgDPI": c.Render.JPGDPI, "jpgMinDPI": c.Render.JPGMinDPI, "jpgMaxDPI": c.Render.JPGMaxDPI} {
+		check(dpi >= 36 && dpi <= 1200, "render.%s must be between 36 and 1200, got %d", name, dpi)
+	}
+	check(c.Render.JPGMinDPI <= c.Render.JPGDPI && c.Render.JPGDPI <= c.Render.JPGMaxDPI, "render.jpgDPI must be between jpgMinDPI and jpgMaxDPI")
+	check(c.Documents.MaxPages > 0, "documents.maxPages must be positive")
+	check(c.Documents.MaxPageSide > 0, "documents.maxPageSide must be positive")
+	check(c.Documents.MaxStreamSize > 0, "documents.maxStreamSize must be positive")
+	check(c.Documents.MaxImagePixels > 0, "documents.maxImagePixels must be positive")
+	check(c.Documents.MaxRasterPixels > 0, "documents.maxRasterPixels must be positive")
+	check(c.Links.TTL > 0, "links.ttl must be positive")
+	for _, h := range slices.Concat(c.Fetch.AllowHosts, c.Fetch.DenyHosts) {
+		check(h != "" && !strings.ContainsAny(strings.TrimPrefix(h, "*."), "*/:@ "), "fetch: invalid host %q; want a name like example.com or *.example.com", h)
+	}
+	switch c.Storage.Backend {
+	case "local":
+	case "s3":
+		check(c.Storage.S3.Endpoint != "" && c.Storage.S3.Bucket != "", "storage.s3.endpoint and storage.s3.bucket are required for s3 storage")
+		check(c.Storage.S3.PresignTTL > 0, "storage.s3.presignTTL must be positive")
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend: unknown backend %q", c.Storage.Backend))
+	}
+	return errors.Join(errs...)
+}
+
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// byteSize is a size in bytes written like the PDF_LIMITS_* sizes: "512M", "2G".
+type byteSize int64
+
+func (b *byteSize) UnmarshalYAML(n *yaml.Node) error {
+	v, err := parseByteSize(n.Value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(v)
+	return nil
+}
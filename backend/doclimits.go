@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/tiff"
+)
+
+// A small upload can describe a great deal of work: a PDF declaring a
+// hundred thousand pages or pages the size of a field, a few kilobytes of
+// Flate data inflating to gigabytes, an image header promising a billion
+// pixels. Uploads are measured before any tool opens them:
+//
+//	documents.maxPages        PDF_MAX_PAGES          pages of a PDF (413)
+//	documents.maxPageSide     PDF_MAX_PAGE_SIDE      width or height of a page, in points (422)
+//	documents.maxStreamSize   PDF_MAX_STREAM_SIZE    inflated size of a PDF's streams (413)
+//	documents.maxImagePixels  PDF_MAX_IMAGE_PIXELS   pixels of an uploaded image (413)
+//
+// documents.maxRasterPixels (PDF_MAX_RASTER_PIXELS) bounds the pixels of all
+// pages a tool renders a PDF to at its resolution; preview, redact,
+// pdf-to-jpg and pdf-to-powerpoint check it before rendering anything (413).
+
+// pdfPages is what pdfinfo reports of a PDF: its page count and the size in
+// points of its pages, up to documents.maxPages of them.
+type pdfPages struct {
+	count int
+	sizes [][2]float64
+}
+
+// errPDFInfoOutput is pdfinfo output without a page count.
+var errPDFInfoOutput = errors.New("could not parse page count")
+
+// inspectPDF runs pdfinfo on the PDF at p, opening it with password if it is
+// encrypted.
+func inspectPDF(ctx context.Context, dir, p, password string) (pdfPages, error) {
+	args := []string{"-f", "1", "-l", strconv.Itoa(cfg.Documents.MaxPages)}
+	if password != "" {
+		// Either password may be the one the client has.
+		args = append(args, "-opw", password, "-upw", password)
+	}
+	out, err := runCommandOutput(ctx, dir, "pdfinfo", append(args, p)...)
+	if err != nil {
+		return pdfPages{}, fmt.Errorf("pdfinfo failed: %w", err)
+	}
+	return parsePDFInfo(out)
+}
+
+// parsePDFInfo reads the output of pdfinfo -f -l.
+func parsePDFInfo(out string) (pdfPages, error) {
+	var info pdfPages
+	// Typical lines: "Pages:          12" and "Page    1 size: 612 x 792 pts (letter)"
+	for _, line := range strings.Split(out, "\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(val)
+		switch {
+		case key == "Pages" && len(fields) == 1:
+			info.count, _ = strconv.Atoi(fields[0])
+		case strings.HasPrefix(key, "Page ") && strings.HasSuffix(key, " size") && len(fields) >= 3 && fields[1] == "x":
+			w, errW := strconv.ParseFloat(fields[0], 64)
+			h, errH := strconv.ParseFloat(fields[2], 64)
+			if errW == nil && errH == nil {
+				info.sizes = append(info.sizes, [2]float64{w, h})
+			}
+		}
+	}
+	if info.count <= 0 {
+		return pdfPages{}, errPDFInfoOutput
+	}
+	return info, nil
+}
+
+// inspectError is the answer for a PDF inspectPDF failed on, or nil for
+// output it could not make sense of, which is left for the tool to report.
+// A file pdfinfo gives up on within its limits is refused rather than let
+// through unmeasured; so is one it cannot open, unless damaged says the
+// tool is there to repair it.
+func inspectError(name string, err error, damaged bool) *formError {
+	var le *limitError
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, errPDFInfoOutput):
+		return nil
+	case errors.As(err, &le):
+		return &formError{http.StatusUnprocessableEntity, fmt.Sprintf("%s could not be measured within the %s limit of pdfinfo (%s)", name, le.Limit, le.Value)}
+	case errors.As(err, &exitErr) && exitErr.ExitCode() != 127:
+		// 127 is prlimit failing to start pdfinfo.
+		if damaged {
+			return nil
+		}
+		return &formError{http.StatusUnprocessableEntity, fmt.Sprintf("%s could not be read; it may be damaged, or encrypted with a different password", name)}
+	default:
+		slog.Error("failed to inspect PDF", "err", err)
+		return &formError{http.StatusInternalServerError, "failed to inspect " + name}
+	}
+}
+
+// checkDocumentLimits measures every PDF and image of a submission, sent as
+// a part or as an upload ID, against the documents limits. It returns the
+// pages of the PDFs, which the quota charges. Encrypted PDFs are opened with
+// the submission's password field.
+func checkDocumentLimits(ctx context.Context, r *http.Request) (int64, *formError) {
+	var pages int64
+	password := strings.TrimSpace(r.FormValue("password"))
+	for _, field := range uploadFields {
+		for _, f := range formFiles(r, field) {
+			p := f.dataPath()
+			if _, ok := detectFileType(p, damagedPDFInput, ""); ok {
+				// Only repair takes a PDF that does not end like one.
+				_, whole := detectFileType(p, pdfInput, "")
+				n, err := checkPDFLimits(ctx, filepath.Dir(p), f.Filename, p, password, !whole)
+				if err != nil {
+					return 0, err
+				}
+				pages += int64(n)
+			} else if _, ok := detectFileType(p, imageInput, ""); ok {
+				if err := checkImageLimits(f.Filename, p); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return pages, nil
+}
+
+// checkPDFLimits returns the page count of the PDF at p, or 0 when it is let
+// through unmeasured (see inspectError).
+func checkPDFLimits(ctx context.Context, dir, name, p, password string, damaged bool) (int, *formError) {
+	limit := int64(cfg.Documents.MaxStreamSize)
+	if n, err := inflatedStreamSize(p, limit); err == nil && n > limit {
+		return 0, &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s: its compressed streams inflate to more than %s, the limit for a document", name, formatByteSize(limit))}
+	}
+	info, err := inspectPDF(ctx, dir, p, password)
+	if err != nil {
+		return 0, inspectError(name, err, damaged)
+	}
+	if err := checkPages(name, info); err != nil {
+		return 0, err
+	}
+	side := float64(cfg.Documents.MaxPageSide)
+	for i, s := range info.sizes {
+		if s[0] > side || s[1] > side {
+			return 0, &formError{http.StatusUnprocessableEntity, fmt.Sprintf("%s: page %d is %.0f x %.0f pt; pages may be at most %d pt on a side", name, i+1, s[0], s[1], cfg.Documents.MaxPageSide)}
+		}
+	}
+	return info.count, nil
+}
+
+func checkPages(name string, info pdfPages) *formError {
+	if info.count > cfg.Documents.MaxPages {
+		return &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s has %d pages; documents may have at most %d", name, info.count, cfg.Documents.MaxPages)}
+	}
+	return nil
+}
+
+// checkImageLimits reads the dimensions an image declares, without decoding
+// its pixels.
+func checkImageLimits(name, p string) *formError {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	c, _, err := image.DecodeConfig(bufio.NewReader(f))
+	if err != nil {
+		// The tool reports images it cannot read.
+		return nil
+	}
+	if int64(c.Width)*int64(c.Height) > int64(cfg.Documents.MaxImagePixels) {
+		return &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s is %d x %d pixels; images may have at most %s", name, c.Width, c.Height, formatPixels(float64(cfg.Documents.MaxImagePixels)))}
+	}
+	return nil
+}
+
+// checkRasterSize refuses to render the PDF at p at dpi when its pages would
+// come to more than documents.maxRasterPixels, or when they cannot be
+// measured (see inspectError). Call it before the first page is rendered.
+func checkRasterSize(ctx context.Context, dir, p string, dpi int) *formError {
+	name := filepath.Base(p)
+	info, err := inspectPDF(ctx, dir, p, "")
+	if err != nil {
+		return inspectError(name, err, false)
+	}
+	if err := checkPages(name, info); err != nil {
+		return err
+	}
+	var total float64
+	for _, s := range info.sizes {
+		// Multiplying first keeps whole pixel counts whole: 612 pt at 300 DPI
+		// is 2550 pixels, not 2551.
+		total += math.Ceil(s[0]*float64(dpi)/72) * math.Ceil(s[1]*float64(dpi)/72)
+	}
+	if total > float64(cfg.Documents.MaxRasterPixels) {
+		return &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("rendering %d pages at %d DPI takes %s; at most %s may be rendered per request", info.count, dpi, formatPixels(total), formatPixels(float64(cfg.Documents.MaxRasterPixels)))}
+	}
+	return nil
+}
+
+func formatPixels(n float64) string {
+	if n >= 1e6 {
+		return strconv.FormatFloat(math.Round(n/1e5)/10, 'f', -1, 64) + " megapixels"
+	}
+	return fmt.Sprintf("%.0f pixels", n)
+}
+
+var streamKeyword = []byte("stream")
+
+// inflatedStreamSize adds up what the zlib streams of the PDF at p inflate
+// to, stopping once the total passes limit. Streams are found by their
+// keyword rather than through the cross-reference table, which a hostile
+// file can make say anything; data after the keyword that is not zlib is
+// skipped.
+func inflatedStreamSize(p string, limit int64) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	buf := make([]byte, 1<<20)
+	keep := 0      // bytes carried over from the previous chunk
+	var base int64 // file offset of buf[0]
+	for {
+		n, err := io.ReadFull(f, buf[keep:])
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return total, err
+		}
+		n += keep
+		chunk := buf[:n]
+		// A keyword and its end of line cut off by the end of the chunk are
+		// found in the next one.
+		scan := n
+		if !eof {
+			scan = n - len(streamKeyword) - 2
+		}
+		for i := 0; ; {
+			j := bytes.Index(chunk[i:], streamKeyword)
+			if j < 0 || i+j >= scan {
+				break
+			}
+			j += i
+			i = j + len(streamKeyword)
+			if j >= 3 && string(chunk[j-3:j]) == "end" {
+				continue
+			}
+			var start int
+			switch {
+			case bytes.HasPrefix(chunk[i:], []byte("\r\n")):
+				start = i + 2
+			case bytes.HasPrefix(chunk[i:], []byte("\n")):
+				start = i + 1
+			default:
+				continue
+			}
+			total += inflatedSize(f, base+int64(start), fi.Size(), limit-total+1)
+			if total > limit {
+				return total, nil
+			}
+		}
+		if eof {
+			return total, nil
+		}
+		keep = copy(buf, chunk[scan:])
+		base += int64(scan)
+	}
+}
+
+// inflatedSize is how much of the zlib stream at off inflates, up to limit.
+func inflatedSize(f *os.File, off, size, limit int64) int64 {
+	zr, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(f, off, size-off)))
+	if err != nil {
+		return 0
+	}
+	defer zr.Close()
+	n, _ := io.Copy(io.Discard, io.LimitReader(zr, limit))
+	return n
+}
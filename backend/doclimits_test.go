@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePDFInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		out   string
+		count int
+		sizes [][2]float64
+		ok    bool
+	}{
+		{
+			name: "letter and A4",
+			out: "Title:          Pages: a novel\nProducer:       pdfTeX\nPages:          2\n" +
+				"Page    1 size: 612 x 792 pts (letter)\nPage    1 rot:  0\n" +
+				"Page    2 size: 595.276 x 841.89 pts (A4)\nPage    2 rot:  90\n",
+			count: 2,
+			sizes: [][2]float64{{612, 792}, {595.276, 841.89}},
+			ok:    true,
+		},
+		{name: "count only", out: "Pages:          7\n", count: 7, ok: true},
+		{name: "odd size line", out: "Pages: 1\nPage    1 size: 612 by 792 pts\n", count: 1, ok: true},
+		{name: "no pages", out: "Pages:          0\n"},
+		{name: "no count", out: "Producer:       pdfTeX\n"},
+		{name: "empty", out: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parsePDFInfo(tt.out)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v", err)
+			}
+			if info.count != tt.count || len(info.sizes) != len(tt.sizes) {
+				t.Fatalf("got %+v, want %d pages of %v", info, tt.count, tt.sizes)
+			}
+			for i := range tt.sizes {
+				if info.sizes[i] != tt.sizes[i] {
+					t.Errorf("page %d is %v, want %v", i+1, info.sizes[i], tt.sizes[i])
+				}
+			}
+		})
+	}
+}
+
+// fakePDFInfo puts a pdfinfo running the shell script body first on PATH.
+func fakePDFInfo(t *testing.T, body string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pdfinfo"), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// printing is a fakePDFInfo script that prints out.
+func printing(out string) string {
+	return "cat <<'EOF'\n" + out + "EOF"
+}
+
+// withDocumentLimits restores the documents limits after the test.
+func withDocumentLimits(t *testing.T) {
+	t.Helper()
+	prev := cfg.Documents
+	t.Cleanup(func() { cfg.Documents = prev })
+}
+
+func writeFile(t *testing.T, data []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "in.pdf")
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheckPDFLimits(t *testing.T) {
+	withDocumentLimits(t)
+	cfg.Documents.MaxPages = 3
+	cfg.Documents.MaxPageSide = 1000
+	cfg.Documents.MaxStreamSize = 1 << 20
+	p := writeFile(t, []byte("%PDF-1.4\n%%EOF\n"))
+
+	tests := []struct {
+		name     string
+		script   string // empty for no pdfinfo at all
+		password string
+		damaged  bool
+		limits   *commandLimits
+		pages    int
+		status   int // 0 when accepted
+		msg      string
+	}{
+		{name: "fits", script: printing("Pages: 2\nPage 1 size: 612 x 792 pts\nPage 2 size: 792 x 612 pts\n"), pages: 2},
+		{name: "too many pages", script: printing("Pages: 4\n"), status: http.StatusRequestEntityTooLarge, msg: "in.pdf has 4 pages; documents may have at most 3"},
+		{name: "page too wide", script: printing("Pages: 2\nPage 1 size: 612 x 792 pts\nPage 2 size: 14400 x 612 pts\n"), status: http.StatusUnprocessableEntity, msg: "in.pdf: page 2 is 14400 x 612 pt"},
+		{name: "unparsed output", script: printing("Producer: something new\n")},
+		{name: "unreadable", script: "echo 'Syntax Error: damaged' >&2; exit 1", status: http.StatusUnprocessableEntity, msg: "in.pdf could not be read"},
+		{name: "unreadable, to repair", script: "exit 1", damaged: true},
+		{name: "encrypted, with password", script: `case "$*" in *"-upw s3cret"*) echo "Pages: 1";; *) exit 1;; esac`, password: "s3cret", pages: 1},
+		{name: "encrypted, wrong password", script: `case "$*" in *"-upw s3cret"*) echo "Pages: 1";; *) exit 1;; esac`, password: "guess", status: http.StatusUnprocessableEntity, msg: "in.pdf could not be read"},
+		{name: "timeout", script: "exec sleep 10", limits: &commandLimits{Timeout: 100 * time.Millisecond}, status: http.StatusUnprocessableEntity, msg: "in.pdf could not be measured within the timeout limit"},
+		{name: "killed", script: "kill -XCPU $$", limits: &commandLimits{MaxCPU: time.Second}, status: http.StatusUnprocessableEntity, msg: "in.pdf could not be measured within the max_cpu limit"},
+		{name: "missing", status: http.StatusInternalServerError, msg: "failed to inspect in.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.script != "" {
+				fakePDFInfo(t, tt.script)
+			} else {
+				t.Setenv("PATH", t.TempDir())
+			}
+			if tt.limits != nil {
+				commandLimitOverrides["pdfinfo"] = *tt.limits
+				t.Cleanup(func() { delete(commandLimitOverrides, "pdfinfo") })
+			}
+			pages, err := checkPDFLimits(context.Background(), t.TempDir(), "in.pdf", p, tt.password, tt.damaged)
+			if tt.status == 0 {
+				if err != nil || pages != tt.pages {
+					t.Errorf("got %d pages, %v; want %d", pages, err, tt.pages)
+				}
+				return
+			}
+			if err == nil || err.status != tt.status || !strings.HasPrefix(err.msg, tt.msg) {
+				t.Errorf("err = %v, want %d %q", err, tt.status, tt.msg)
+			}
+		})
+	}
+}
+
+func TestCheckRasterSize(t *testing.T) {
+	withDocumentLimits(t)
+	cfg.Documents.MaxPages = 10
+	// Two letter pages at 300 DPI are 2 x 2550 x 3300 pixels.
+	fakePDFInfo(t, printing("Pages: 2\nPage 1 size: 612 x 792 pts\nPage 2 size: 612 x 792 pts\n"))
+	p := writeFile(t, []byte("%PDF-1.4\n%%EOF\n"))
+
+	tests := []struct {
+		limit int
+		dpi   int
+		ok    bool
+	}{
+		{20_000_000, 300, true},
+		{16_830_000, 300, true},
+		{16_829_999, 300, false},
+		{2_000_000, 72, true},
+		{100, 72, false},
+	}
+	for _, tt := range tests {
+		cfg.Documents.MaxRasterPixels = tt.limit
+		err := checkRasterSize(context.Background(), t.TempDir(), p, tt.dpi)
+		if (err == nil) != tt.ok || err != nil && err.status != http.StatusRequestEntityTooLarge {
+			t.Errorf("limit %d at %d DPI: err = %v", tt.limit, tt.dpi, err)
+		}
+	}
+}
+
+func TestCheckRasterSizeUnreadable(t *testing.T) {
+	// Nothing is rendered from a PDF whose pages could not be counted.
+	fakePDFInfo(t, "exit 1")
+	err := checkRasterSize(context.Background(), t.TempDir(), writeFile(t, []byte("%PDF-1.4\n%%EOF\n")), 300)
+	if err == nil || err.status != http.StatusUnprocessableEntity {
+		t.Errorf("err = %v, want 422", err)
+	}
+}
+
+func zlibBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(make([]byte, n))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestInflatedStreamSize(t *testing.T) {
+	obj := func(eol string, data []byte) []byte {
+		return slices.Concat([]byte("1 0 obj\n<< /Filter /FlateDecode >>\nstream"+eol), data, []byte("\nendstream\nendobj\n"))
+	}
+	// Pads a stream so its keyword straddles the 1 MiB read chunk.
+	straddle := slices.Concat(bytes.Repeat([]byte(" "), 1<<20-40), obj("\n", zlibBytes(t, 3000)))
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit int64
+		want  int64
+	}{
+		{"one stream", obj("\n", zlibBytes(t, 5000)), 1 << 20, 5000},
+		{"crlf", obj("\r\n", zlibBytes(t, 5000)), 1 << 20, 5000},
+		{"two streams", slices.Concat(obj("\n", zlibBytes(t, 5000)), obj("\n", zlibBytes(t, 7000))), 1 << 20, 12000},
+		{"not zlib", obj("\n", []byte("plain bytes")), 1 << 20, 0},
+		{"no end of line", []byte("stream" + string(zlibBytes(t, 5000))), 1 << 20, 0},
+		{"across chunks", straddle, 1 << 20, 3000},
+		{"bomb", obj("\n", zlibBytes(t, 10<<20)), 1 << 20, 1<<20 + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inflatedStreamSize(writeFile(t, tt.data), tt.limit)
+			if err != nil || got != tt.want {
+				t.Errorf("got %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckImageLimits(t *testing.T) {
+	withDocumentLimits(t)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 100, 50))); err != nil {
+		t.Fatal(err)
+	}
+	p := writeFile(t, buf.Bytes())
+	notImage := writeFile(t, []byte("\x89PNG\r\n\x1a\ntruncated"))
+
+	tests := []struct {
+		path  string
+		limit int
+		ok    bool
+	}{
+		{p, 5000, true},
+		{p, 4999, false},
+		{notImage, 1, true},
+	}
+	for _, tt := range tests {
+		cfg.Documents.MaxImagePixels = tt.limit
+		err := checkImageLimits("in.png", tt.path)
+		if (err == nil) != tt.ok || err != nil && err.status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s, limit %d: err = %v", filepath.Base(tt.path), tt.limit, err)
+		}
+	}
+}
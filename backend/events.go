@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types sent on GET /api/jobs/{id}/events.
+const (
+	eventPhase    = "phase"
+	eventProgress = "progress"
+	eventStatus   = "status"
+)
+
+// maxJobEvents bounds the replay history kept per job. Consecutive progress
+// events are coalesced, so this is only reached by very chatty tools.
+const maxJobEvents = 256
+
+type jobEvent struct {
+	Seq         int       `json:"seq"`
+	Type        string    `json:"type"`
+	Message     string    `json:"message,omitempty"`
+	Current     int       `json:"current,omitempty"`
+	Total       int       `json:"total,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	DownloadURL string    `json:"downloadUrl,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// jobEvents is the per-job event log plus its live subscribers.
+type jobEvents struct {
+	mu      sync.Mutex
+	seq     int
+	history []jobEvent
+	subs    map[chan jobEvent]struct{}
+	closed  bool
+}
+
+func (e *jobEvents) publish(ev jobEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.seq++
+	ev.Seq = e.seq
+	ev.Time = time.Now()
+
+	if n := len(e.history); n > 0 && ev.Type == eventProgress && e.history[n-1].Type == eventProgress {
+		e.history[n-1] = ev
+	} else {
+		if len(e.history) >= maxJobEvents {
+			e.history = e.history[1:]
+		}
+		e.history = append(e.history, ev)
+	}
+
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Slow reader: it will catch up from the next event or the final status.
+		}
+	}
+}
+
+// close ends every subscription; no more events are accepted afterwards.
+func (e *jobEvents) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	for ch := range e.subs {
+		close(ch)
+	}
+	e.subs = nil
+}
+
+// subscribe returns the events after seq and, while the job is still going, a
+// channel with the ones that follow. The returned func must be called when done.
+func (e *jobEvents) subscribe(after int) ([]jobEvent, <-chan jobEvent, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var replay []jobEvent
+	for _, ev := range e.history {
+		if ev.Seq > after {
+			replay = append(replay, ev)
+		}
+	}
+	if e.closed {
+		return replay, nil, func() {}
+	}
+
+	ch := make(chan jobEvent, 64)
+	if e.subs == nil {
+		e.subs = make(map[chan jobEvent]struct{})
+	}
+	e.subs[ch] = struct{}{}
+	return replay, ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subs[ch]; ok {
+			delete(e.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// reportPhase records a coarse step of the job running under ctx, if any.
+func reportPhase(ctx context.Context, msg string) {
+	if j := jobFromContext(ctx); j != nil {
+		j.events.publish(jobEvent{Type: eventPhase, Message: msg})
+	}
+}
+
+// reportProgress records per-item progress, e.g. "stamping page 37/120".
+func reportProgress(ctx context.Context, current, total int, msg string) {
+	if j := jobFromContext(ctx); j != nil {
+		j.events.publish(jobEvent{Type: eventProgress, Message: msg, Current: current, Total: total})
+	}
+}
+
+// popplerProgress turns the "page last file" lines that poppler tools print to
+// stderr with -progress into progress events for the job running under ctx.
+type popplerProgress struct {
+	ctx  context.Context
+	verb string
+	buf  []byte
+}
+
+func (p *popplerProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		var page, last int
+		if _, err := fmt.Sscanf(string(p.buf[:i]), "%d %d", &page, &last); err == nil {
+			reportProgress(p.ctx, page, last, fmt.Sprintf("%s page %d/%d", p.verb, page, last))
+		}
+		p.buf = p.buf[i+1:]
+	}
+	// Anything else on stderr is kept with the job by execCommand.
+	if len(p.buf) > 4<<10 {
+		p.buf = p.buf[:0]
+	}
+	return len(b), nil
+}
+
+// handleJobEvents serves GET /api/jobs/{id}/events as a Server-Sent Events
+// stream. Past events are replayed first (honouring Last-Event-ID), and the
+// stream ends after the final "status" event.
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	j := jobs.get(r.PathValue("id"))
+	if j == nil || !canAccess(r, j.owner()) {
+		errorJSON(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	after, _ := strconv.Atoi(strings.TrimSpace(r.Header.Get("Last-Event-ID")))
+	replay, ch, unsubscribe := j.events.subscribe(after)
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	last := after
+	send := func(ev jobEvent) bool {
+		last = ev.Seq
+		data, _ := json.Marshal(ev)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	for _, ev := range replay {
+		if !send(ev) {
+			return
+		}
+	}
+	if ch == nil {
+		return
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				// The job is over; flush whatever a full buffer made us miss.
+				rest, _, _ := j.events.subscribe(last)
+				for _, ev := range rest {
+					if !send(ev) {
+						return
+					}
+				}
+				return
+			}
+			if !send(ev) {
+				return
+			}
+			if ev.Type == eventStatus {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
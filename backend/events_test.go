@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPopplerProgress(t *testing.T) {
+	j := &job{}
+	_, events, done := j.events.subscribe(0)
+	defer done()
+	p := &popplerProgress{ctx: withJob(context.Background(), j), verb: "rasterizing"}
+
+	// Writes need not line up with lines, and other stderr output is skipped.
+	for _, chunk := range []string{"1 3 /tmp/job/page-1.png\n2 3 /tmp", "/job/page-2.png\nSyntax Warning: bad xref\n", "3 3 /tmp/job/page-3.png\n"} {
+		if n, err := p.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+
+	want := []jobEvent{
+		{Type: eventProgress, Current: 1, Total: 3, Message: "rasterizing page 1/3"},
+		{Type: eventProgress, Current: 2, Total: 3, Message: "rasterizing page 2/3"},
+		{Type: eventProgress, Current: 3, Total: 3, Message: "rasterizing page 3/3"},
+	}
+	for i, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.Type || ev.Current != w.Current || ev.Total != w.Total || ev.Message != w.Message {
+				t.Errorf("event %d = %+v, want %+v", i, ev, w)
+			}
+		default:
+			t.Fatalf("got %d events, want %d", i, len(want))
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %+v", ev)
+	default:
+	}
+}
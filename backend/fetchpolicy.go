@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// html-to-pdf renders pages that wkhtmltopdf fetches itself, from a URL the
+// client names or from links in an uploaded page. Every such fetch goes
+// through a proxy started for the run, which only connects to http and https
+// servers at public addresses, checked on the address actually dialled, so a
+// name cannot resolve to a public address for the check and to an internal
+// one for the fetch. Redirects and subresources pass through it too.
+//
+// fetch.allowHosts (PDF_FETCH_ALLOW_HOSTS) limits fetches to the hosts
+// listed, fetch.denyHosts (PDF_FETCH_DENY_HOSTS) refuses some; both take
+// names like "example.com" or "*.example.com" for its subdomains. Listing a
+// host does not let it reach a private address.
+//
+// Webhook callbacks (webhooks.go) are held to the same policy: the
+// callbackUrl is checked when the job is submitted, and deliveries dial
+// through fetchDialer.
+//
+// Local files are readable only for an uploaded ZIP bundle, and then only
+// those in the bundle.
+//
+// fetchBlockedError is a refusal of this policy.
+type fetchBlockedError struct {
+	target string
+	reason string
+}
+
+func (e *fetchBlockedError) Error() string {
+	return fmt.Sprintf("fetching %s is not allowed: %s", e.target, e.reason)
+}
+
+// checkFetchURL validates a URL the client asked to render: it must be http
+// or https, its host must pass the host lists and every address it resolves
+// to must be public. The proxy checks again when the page is fetched.
+func checkFetchURL(ctx context.Context, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("invalid url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("url must be http or https")
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid url")
+	}
+	host := u.Hostname()
+	if err := checkFetchHost(host); err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return u, checkFetchAddr(host, ip)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, ip := range ips {
+		if err := checkFetchAddr(host, ip); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// checkFetchHost applies fetch.denyHosts and fetch.allowHosts to a host name.
+func checkFetchHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if slices.ContainsFunc(cfg.Fetch.DenyHosts, func(p string) bool { return hostMatches(p, host) }) {
+		return &fetchBlockedError{host, "host is denied"}
+	}
+	if len(cfg.Fetch.AllowHosts) > 0 && !slices.ContainsFunc(cfg.Fetch.AllowHosts, func(p string) bool { return hostMatches(p, host) }) {
+		return &fetchBlockedError{host, "host is not in the allow list"}
+	}
+	return nil
+}
+
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// netip does not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkFetchAddr refuses loopback, private, link-local (which includes the
+// cloud metadata endpoints at 169.254.169.254), multicast and unspecified
+// addresses.
+func checkFetchAddr(target string, ip netip.Addr) error {
+	ip = ip.Unmap()
+	var reason string
+	switch {
+	case ip.IsLoopback():
+		reason = "loopback address"
+	case ip.IsPrivate(), sharedAddressSpace.Contains(ip):
+		reason = "private address"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		reason = "link-local address"
+	case ip.IsMulticast(), ip.IsInterfaceLocalMulticast():
+		reason = "multicast address"
+	case ip.IsUnspecified(), ip.Is4() && ip.As4()[0] == 0:
+		reason = "unspecified address"
+	default:
+		return nil
+	}
+	if target != ip.String() {
+		reason = ip.String() + " is a " + reason
+	}
+	return &fetchBlockedError{target, reason}
+}
+
+// fetchDialer connects only to addresses checkFetchAddr accepts.
+var fetchDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return err
+		}
+		return checkFetchAddr(host, ip)
+	},
+}
+
+// fetchProxy is the HTTP proxy of one wkhtmltopdf run. It remembers what it
+// refused so a failed render can say why.
+type fetchProxy struct {
+	srv     *http.Server
+	addr    string
+	forward *httputil.ReverseProxy
+
+	mu      sync.Mutex
+	blocked []error
+}
+
+func startFetchProxy() (*fetchProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &fetchProxy{addr: ln.Addr().String()}
+	p.forward = &httputil.ReverseProxy{
+		// The request already names the server; only hop-by-hop headers go.
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext:           fetchDialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.fail(w, r.URL.Host, err)
+		},
+	}
+	p.srv = &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = p.srv.Serve(ln) }()
+	return p, nil
+}
+
+// url is the value for wkhtmltopdf's --proxy.
+func (p *fetchProxy) url() string {
+	return "http://" + p.addr
+}
+
+func (p *fetchProxy) close() {
+	_ = p.srv.Close()
+	if t, ok := p.forward.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// blockedFetches returns the fetches the policy refused so far.
+func (p *fetchProxy) blockedFetches() []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.blocked)
+}
+
+func (p *fetchProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		p.fail(w, r.URL.String(), &fetchBlockedError{r.URL.String(), "only http and https can be fetched"})
+		return
+	}
+	if err := checkFetchHost(r.URL.Hostname()); err != nil {
+		p.fail(w, r.URL.Host, err)
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+// tunnel serves CONNECT, which is how https pages are fetched.
+func (p *fetchProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "invalid CONNECT target", http.StatusBadRequest)
+		return
+	}
+	if err := checkFetchHost(host); err != nil {
+		p.fail(w, r.Host, err)
+		return
+	}
+	upstream, err := fetchDialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.fail(w, r.Host, err)
+		return
+	}
+	defer upstream.Close()
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *fetchProxy) fail(w http.ResponseWriter, target string, err error) {
+	var blocked *fetchBlockedError
+	if errors.As(err, &blocked) {
+		p.mu.Lock()
+		p.blocked = append(p.blocked, blocked)
+		p.mu.Unlock()
+		http.Error(w, blocked.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, "fetching "+target+" failed", http.StatusBadGateway)
+}
+
+// maxBundleFiles bounds the entries of an uploaded HTML bundle.
+const maxBundleFiles = 2000
+
+// extractHTMLBundle unpacks an uploaded ZIP of a page and its assets into dir
+// and returns the page to render: index.html nearest the top, or else the
+// only HTML file in the bundle.
+func extractHTMLBundle(zipPath, dir string) (string, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", errors.New("the file is not a valid ZIP bundle")
+	}
+	defer zr.Close()
+	if len(zr.File) > maxBundleFiles {
+		return "", fmt.Errorf("the bundle has more than %d files", maxBundleFiles)
+	}
+
+	budget := int64(cfg.Uploads.MaxBundleSize)
+	var index string
+	var pages []string
+	for _, zf := range zr.File {
+		name := path.Clean(zf.Name)
+		if zf.FileInfo().IsDir() || !zf.Mode().IsRegular() {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return "", fmt.Errorf("the bundle contains an invalid path: %s", zf.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		n, err := extractBundleFile(zf, dst, budget)
+		if err != nil {
+			return "", err
+		}
+		budget -= n
+
+		switch strings.ToLower(path.Ext(name)) {
+		case ".html", ".htm":
+			pages = append(pages, dst)
+			if path.Base(name) == "index.html" && (index == "" || strings.Count(name, "/") < strings.Count(index, "/")) {
+				index = name
+			}
+		}
+	}
+	if index != "" {
+		return filepath.Join(dir, filepath.FromSlash(index)), nil
+	}
+	if len(pages) == 1 {
+		return pages[0], nil
+	}
+	return "", errors.New("the bundle needs an index.html")
+}
+
+// extractBundleFile writes one entry to dst, failing once it exceeds budget
+// whatever size the archive claims.
+func extractBundleFile(zf *zip.File, dst string, budget int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	in, err := zf.Open()
+	if err != nil {
+		return 0, fmt.Errorf("the bundle is damaged: %w", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return 0, fmt.Errorf("the bundle contains %s twice", zf.Name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, io.LimitReader(in, budget+1))
+	if err != nil {
+		return n, fmt.Errorf("the bundle is damaged: %w", err)
+	}
+	if n > budget {
+		return n, errors.New("the bundle is too large once unpacked")
+	}
+	return n, nil
+}
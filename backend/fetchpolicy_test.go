@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckFetchAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		reason string // empty when allowed
+	}{
+		{"203.0.113.10", ""},
+		{"8.8.8.8", ""},
+		{"2001:4860:4860::8888", ""},
+		{"127.0.0.1", "loopback address"},
+		{"127.8.9.10", "loopback address"},
+		{"::1", "loopback address"},
+		{"10.0.0.5", "private address"},
+		{"172.16.0.1", "private address"},
+		{"192.168.1.1", "private address"},
+		{"fd00::1", "private address"},
+		{"100.64.0.1", "private address"},
+		{"169.254.169.254", "link-local address"},
+		{"fe80::1", "link-local address"},
+		{"224.0.0.1", "link-local address"},
+		{"239.1.2.3", "multicast address"},
+		{"ff05::1", "multicast address"},
+		{"0.0.0.0", "unspecified address"},
+		{"0.1.2.3", "unspecified address"},
+		{"::", "unspecified address"},
+		{"::ffff:127.0.0.1", "loopback address"},
+		{"::ffff:10.1.2.3", "private address"},
+	}
+	for _, tt := range tests {
+		err := checkFetchAddr(tt.addr, netip.MustParseAddr(tt.addr))
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: %v, want it allowed", tt.addr, err)
+			}
+			continue
+		}
+		var blocked *fetchBlockedError
+		if !errors.As(err, &blocked) || !strings.HasSuffix(blocked.reason, tt.reason) {
+			t.Errorf("%s: err = %v, want %q", tt.addr, err, tt.reason)
+		}
+	}
+}
+
+func TestCheckFetchHost(t *testing.T) {
+	prev := cfg.Fetch
+	t.Cleanup(func() { cfg.Fetch = prev })
+
+	tests := []struct {
+		allow, deny []string
+		host        string
+		ok          bool
+	}{
+		{nil, nil, "example.com", true},
+		{nil, []string{"example.com"}, "example.com", false},
+		{nil, []string{"example.com"}, "EXAMPLE.com.", false},
+		{nil, []string{"example.com"}, "www.example.com", true},
+		{nil, []string{"*.example.com"}, "www.example.com", false},
+		{nil, []string{"*.example.com"}, "example.com", true},
+		{nil, []string{"*.example.com"}, "badexample.com", true},
+		{[]string{"*.example.com"}, nil, "cdn.example.com", true},
+		{[]string{"*.example.com"}, nil, "example.org", false},
+		{[]string{"*.example.com"}, []string{"admin.example.com"}, "admin.example.com", false},
+	}
+	for _, tt := range tests {
+		cfg.Fetch.AllowHosts, cfg.Fetch.DenyHosts = tt.allow, tt.deny
+		if err := checkFetchHost(tt.host); (err == nil) != tt.ok {
+			t.Errorf("allow %v, deny %v, host %s: err = %v", tt.allow, tt.deny, tt.host, err)
+		}
+	}
+}
+
+func TestFetchProxyRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the proxy reached a loopback server")
+	}))
+	defer srv.Close()
+	p, err := startFetchProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	proxyURL, _ := url.Parse(p.url())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", resp.StatusCode)
+	}
+	if blocked := p.blockedFetches(); len(blocked) != 1 {
+		t.Errorf("blocked fetches = %v, want one", blocked)
+	}
+}
+
+// writeZip builds a ZIP of name -> content in dir.
+func writeZip(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	p := filepath.Join(dir, "bundle.zip")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return p
+}
+
+func TestExtractHTMLBundle(t *testing.T) {
+	prev := cfg.Uploads.MaxBundleSize
+	t.Cleanup(func() { cfg.Uploads.MaxBundleSize = prev })
+	cfg.Uploads.MaxBundleSize = 1 << 10
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		page  string // page to render, or a substring of the error
+		ok    bool
+	}{
+		{"index at the top", map[string]string{"index.html": "<p>", "docs/index.html": "<p>", "style.css": "p{}"}, "index.html", true},
+		{"nested index", map[string]string{"site/index.html": "<p>", "site/a/index.html": "<p>"}, "site/index.html", true},
+		{"single page", map[string]string{"report.htm": "<p>", "logo.png": "png"}, "report.htm", true},
+		{"no page", map[string]string{"a.html": "<p>", "b.html": "<p>"}, "needs an index.html", false},
+		{"escape", map[string]string{"../index.html": "<p>"}, "invalid path", false},
+		{"too large", map[string]string{"index.html": strings.Repeat("x", 2<<10)}, "too large once unpacked", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			site := filepath.Join(dir, "site-root")
+			got, err := extractHTMLBundle(writeZip(t, dir, tt.files), site)
+			if !tt.ok {
+				if err == nil || !strings.Contains(err.Error(), tt.page) {
+					t.Errorf("err = %v, want %q", err, tt.page)
+				}
+				return
+			}
+			if want := filepath.Join(site, filepath.FromSlash(tt.page)); err != nil || got != want {
+				t.Errorf("got %q, %v; want %q", got, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// fileType is a kind of input a tool accepts, recognised by its content: the
+// filename and Content-Type the client sent are not trusted. exts are the
+// extensions files of the type are saved under, the usual one first, since
+// ImageMagick and LibreOffice pick their reader by extension.
+type fileType struct {
+	name  string
+	exts  []string
+	match func(f *os.File, head []byte) bool
+}
+
+// sniffLen is how much of a file is read to recognise it.
+const sniffLen = 1024
+
+var (
+	typePDF = fileType{"PDF", []string{".pdf"}, func(f *os.File, head []byte) bool {
+		return hasPDFHeader(head) && hasPDFTrailer(f)
+	}}
+	// typeDamagedPDF is what repair takes: a PDF header is enough.
+	typeDamagedPDF = fileType{"PDF", []string{".pdf"}, func(_ *os.File, head []byte) bool {
+		return hasPDFHeader(head)
+	}}
+	typePNG = fileType{"PNG", []string{".png"}, func(_ *os.File, head []byte) bool {
+		return bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n"))
+	}}
+	typeJPEG = fileType{"JPEG", []string{".jpg", ".jpeg"}, func(_ *os.File, head []byte) bool {
+		return bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff})
+	}}
+	typeTIFF = fileType{"TIFF", []string{".tif", ".tiff"}, func(_ *os.File, head []byte) bool {
+		return bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*"))
+	}}
+	typeDOCX = ooxmlType("DOCX", ".docx", "word/document.xml")
+	typeXLSX = ooxmlType("XLSX", ".xlsx", "xl/workbook.xml")
+	typePPTX = ooxmlType("PPTX", ".pptx", "ppt/presentation.xml")
+	// Office 97-2003 files share one container format; LibreOffice tells
+	// them apart by content.
+	typeDOC  = oleType("DOC", ".doc")
+	typeXLS  = oleType("XLS", ".xls")
+	typePPT  = oleType("PPT", ".ppt")
+	typeHTML = fileType{"HTML", []string{".html", ".htm"}, func(_ *os.File, head []byte) bool {
+		ct := http.DetectContentType(head)
+		// XHTML starting with an XML declaration is sniffed as text/xml.
+		return strings.HasPrefix(ct, "text/html") ||
+			strings.HasPrefix(ct, "text/") && bytes.Contains(bytes.ToLower(head), []byte("<html"))
+	}}
+	typeZIP = fileType{"ZIP", []string{".zip"}, func(f *os.File, head []byte) bool {
+		_, ok := openZip(f, head)
+		return ok
+	}}
+)
+
+// The inputs of the tools, for the accepts column of pdfTools.
+var (
+	pdfInput        = []fileType{typePDF}
+	damagedPDFInput = []fileType{typeDamagedPDF}
+	imageInput      = []fileType{typePNG, typeJPEG, typeTIFF}
+	wordInput       = []fileType{typeDOCX, typeXLSX, typePPTX, typeDOC, typeXLS, typePPT, typeHTML}
+	excelInput      = []fileType{typeXLSX, typeXLS}
+	powerPointInput = []fileType{typePPTX, typePPT}
+	htmlInput       = []fileType{typeHTML, typeZIP}
+)
+
+func hasPDFHeader(head []byte) bool {
+	// Readers accept junk before the header, and so does every tool here.
+	return bytes.Contains(head, []byte("%PDF-"))
+}
+
+// hasPDFTrailer reports whether the file ends like a PDF, with %%EOF in its
+// last kilobytes.
+func hasPDFTrailer(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	off := max(fi.Size()-4*sniffLen, 0)
+	tail := make([]byte, fi.Size()-off)
+	if _, err := f.ReadAt(tail, off); err != nil && err != io.EOF {
+		return false
+	}
+	return bytes.Contains(tail, []byte("%%EOF"))
+}
+
+// openZip reads the central directory of a ZIP archive.
+func openZip(f *os.File, head []byte) (*zip.Reader, bool) {
+	if !bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		return nil, false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	return zr, err == nil
+}
+
+// ooxmlType is an Office Open XML document: a ZIP archive with a content
+// types part and the given main part.
+func ooxmlType(name, ext, mainPart string) fileType {
+	return fileType{name, []string{ext}, func(f *os.File, head []byte) bool {
+		zr, ok := openZip(f, head)
+		if !ok {
+			return false
+		}
+		var types, main bool
+		for _, zf := range zr.File {
+			switch zf.Name {
+			case "[Content_Types].xml":
+				types = true
+			case mainPart:
+				main = true
+			}
+		}
+		return types && main
+	}}
+}
+
+func oleType(name, ext string) fileType {
+	return fileType{name, []string{ext}, func(_ *os.File, head []byte) bool {
+		return bytes.HasPrefix(head, []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1})
+	}}
+}
+
+// fileTypeError is an upload that is none of the types its tool accepts.
+type fileTypeError struct {
+	field    string
+	filename string
+	accepted []fileType
+}
+
+func (e *fileTypeError) Error() string {
+	return fmt.Sprintf("%s: %q is not a supported file; accepted types: %s", e.field, e.filename, strings.Join(e.acceptedNames(), ", "))
+}
+
+func (e *fileTypeError) acceptedNames() []string {
+	var names []string
+	for _, t := range e.accepted {
+		if !slices.Contains(names, t.name) {
+			names = append(names, t.name)
+		}
+	}
+	return names
+}
+
+// fileTypeErrorJSON answers 415 with the types that would have been accepted.
+func fileTypeErrorJSON(w http.ResponseWriter, err *fileTypeError) {
+	writeJSON(w, http.StatusUnsupportedMediaType, map[string]any{
+		"error":    err.Error(),
+		"accepted": err.acceptedNames(),
+	})
+}
+
+// detectFileType returns which of types the file at p is. When it could be
+// several, the one with extension ext wins.
+func detectFileType(p string, types []fileType, ext string) (fileType, bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return fileType{}, false
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fileType{}, false
+	}
+	head = head[:n]
+	var found []fileType
+	for _, t := range types {
+		if t.match(f, head) {
+			found = append(found, t)
+		}
+	}
+	if len(found) == 0 {
+		return fileType{}, false
+	}
+	for _, t := range found {
+		if slices.Contains(t.exts, ext) {
+			return t, true
+		}
+	}
+	return found[0], true
+}
+
+// checkFileTypes makes sure every file of a submission, sent as a part or as
+// an upload ID, is of a type the tool accepts. A tool without accepts, the
+// pipeline, checks the input of each step instead.
+func checkFileTypes(t pdfTool, r *http.Request) *fileTypeError {
+	if t.accepts == nil {
+		return nil
+	}
+	for _, field := range uploadFields {
+		for _, f := range formFiles(r, field) {
+			if err := checkFileType(field, f.Filename, f.dataPath(), t.accepts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkFileType(field, filename, p string, accepts []fileType) *fileTypeError {
+	if _, ok := detectFileType(p, accepts, ""); !ok {
+		return &fileTypeError{field: field, filename: filename, accepted: accepts}
+	}
+	return nil
+}
+
+// inputExt is the extension to save an accepted upload under: the client's,
+// if it fits what the file turned out to be, or else the usual one.
+func inputExt(f *uploadedFile, types []fileType) string {
+	ext := strings.ToLower(filepath.Ext(f.Filename))
+	t, ok := detectFileType(f.dataPath(), types, ext)
+	if !ok || slices.Contains(t.exts, ext) {
+		return ext
+	}
+	return t.exts[0]
+}
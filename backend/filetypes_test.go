@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zipBytes is a ZIP archive holding the named, empty entries.
+func zipBytes(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		if _, err := zw.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectFileType(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+	ole := []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1, 0, 0}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		types []fileType
+		ext   string
+		want  string // empty when no type matches
+	}{
+		{"pdf", pdf, pdfInput, "", "PDF"},
+		{"pdf after junk", append([]byte("garbage\n"), pdf...), pdfInput, "", "PDF"},
+		{"truncated pdf", pdf[:20], pdfInput, "", ""},
+		{"truncated pdf to repair", pdf[:20], damagedPDFInput, "", "PDF"},
+		{"png named pdf", []byte("\x89PNG\r\n\x1a\n...."), pdfInput, ".pdf", ""},
+		{"png", []byte("\x89PNG\r\n\x1a\n...."), imageInput, "", "PNG"},
+		{"jpeg", []byte{0xff, 0xd8, 0xff, 0xe0, 0, 0x10}, imageInput, "", "JPEG"},
+		{"tiff little-endian", []byte("II*\x00...."), imageInput, "", "TIFF"},
+		{"tiff big-endian", []byte("MM\x00*...."), imageInput, "", "TIFF"},
+		{"docx", zipBytes(t, "[Content_Types].xml", "word/document.xml"), wordInput, "", "DOCX"},
+		{"xlsx", zipBytes(t, "[Content_Types].xml", "xl/workbook.xml"), excelInput, "", "XLSX"},
+		{"pptx for excel", zipBytes(t, "[Content_Types].xml", "ppt/presentation.xml"), excelInput, "", ""},
+		{"docx without content types", zipBytes(t, "word/document.xml"), wordInput, "", ""},
+		{"plain zip for word", zipBytes(t, "index.html"), wordInput, "", ""},
+		{"html bundle", zipBytes(t, "index.html"), htmlInput, "", "ZIP"},
+		{"ole without extension", ole, wordInput, "", "DOC"},
+		{"ole named xls", ole, wordInput, ".xls", "XLS"},
+		{"ole named ppt", ole, powerPointInput, ".ppt", "PPT"},
+		{"html", []byte("<!DOCTYPE html><html><body>hi</body></html>"), htmlInput, "", "HTML"},
+		{"xhtml", []byte(`<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"></html>`), htmlInput, "", "HTML"},
+		{"plain text", []byte("just some notes"), htmlInput, "", ""},
+		{"empty", nil, pdfInput, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(p, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := detectFileType(p, tt.types, tt.ext)
+			if ok != (tt.want != "") || got.name != tt.want {
+				t.Errorf("detectFileType = %q, %v; want %q", got.name, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestInputExt(t *testing.T) {
+	dir := t.TempDir()
+	docx := filepath.Join(dir, "docx")
+	if err := os.WriteFile(docx, zipBytes(t, "[Content_Types].xml", "word/document.xml"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"report.docx", ".docx"},
+		{"REPORT.DOCX", ".docx"},
+		{"report.doc", ".docx"},
+		{"report", ".docx"},
+		{"report.exe", ".docx"},
+	}
+	for _, tt := range tests {
+		f := &uploadedFile{Filename: tt.filename, path: docx}
+		if got := inputExt(f, wordInput); got != tt.want {
+			t.Errorf("inputExt(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
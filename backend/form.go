@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// partsDirName is where toolHandler streams file parts inside the job
+	// directory; handlers then move them to their final names.
+	partsDirName = ".parts"
+)
+
+// toolForm is a tool submission read by toolHandler. File parts are already on
+// disk in the job directory.
+type toolForm struct {
+	Value url.Values
+	File  map[string][]*uploadedFile
+}
+
+// formError is a submission the server refuses to read further.
+type formError struct {
+	status int
+	msg    string
+}
+
+func (e *formError) Error() string { return e.msg }
+
+var errInvalidForm = &formError{http.StatusBadRequest, "invalid multipart form"}
+
+// requestSizeLimit is the most a request to tool may upload in files.
+func requestSizeLimit(tool string) int64 {
+	if n, ok := cfg.Uploads.ToolRequestSize[tool]; ok {
+		return int64(n)
+	}
+	return int64(cfg.Uploads.MaxRequestSize)
+}
+
+// readToolForm streams a multipart submission: field values are collected,
+// and file parts are written straight to jobDir/.parts while being hashed,
+// without being buffered in memory or spooled to a temporary file first.
+// Sizes are enforced as the bytes arrive; files may total at most limit.
+func readToolForm(r *http.Request, jobDir string, limit int64) (*toolForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, errInvalidForm
+	}
+	form := &toolForm{Value: url.Values{}, File: map[string][]*uploadedFile{}}
+	partsDir := filepath.Join(jobDir, partsDirName)
+	valueBudget := int64(cfg.Uploads.MaxFieldsSize)
+	uploadBudget := limit
+
+	for n := 0; ; n++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return nil, errInvalidForm
+		}
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		if part.FileName() == "" {
+			data, err := io.ReadAll(io.LimitReader(part, valueBudget+1))
+			part.Close()
+			if err != nil {
+				return nil, errInvalidForm
+			}
+			valueBudget -= int64(len(data))
+			if valueBudget < 0 {
+				return nil, &formError{http.StatusRequestEntityTooLarge, "form fields are too large"}
+			}
+			form.Value.Add(name, string(data))
+			continue
+		}
+
+		if err := os.MkdirAll(partsDir, 0o755); err != nil {
+			return nil, err
+		}
+		f, err := writePart(part, filepath.Join(partsDir, fmt.Sprintf("%d_%s", n, sanitizeFilename(part.FileName()))), uploadBudget, limit)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		uploadBudget -= f.Size
+		form.File[name] = append(form.File[name], f)
+	}
+}
+
+func writePart(part *multipart.Part, dst string, budget, limit int64) (*uploadedFile, error) {
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(part, budget+1))
+	if err != nil {
+		return nil, errInvalidForm
+	}
+	if n > budget {
+		return nil, &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads are limited to %s per request", formatByteSize(limit))}
+	}
+	return &uploadedFile{
+		Filename: part.FileName(),
+		Size:     n,
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+		path:     dst,
+	}, nil
+}
+
+// asFormError returns the *formError in err, or err as a formError with
+// status.
+func asFormError(err error, status int) *formError {
+	var fe *formError
+	if errors.As(err, &fe) {
+		return fe
+	}
+	return &formError{status, err.Error()}
+}
+
+// formErrorJSON reports why a submission could not be read.
+func formErrorJSON(w http.ResponseWriter, err error) {
+	var fe *formError
+	if errors.As(err, &fe) {
+		errorJSON(w, fe.status, fe.msg)
+		return
+	}
+	errorJSON(w, http.StatusInternalServerError, "failed to save upload")
+}
+
+type formFilesKey struct{}
+
+// withForm returns a copy of r carrying an already-read form. Field values
+// are where r.FormValue finds them; files are found by formFile and formFiles.
+func withForm(r *http.Request, form *toolForm) *http.Request {
+	r2 := r.Clone(context.WithValue(r.Context(), formFilesKey{}, form.File))
+	r2.Body = http.NoBody
+	r2.MultipartForm = &multipart.Form{Value: form.Value}
+	r2.PostForm = form.Value
+	r2.Form = r2.URL.Query()
+	for k, vs := range form.Value {
+		r2.Form[k] = append(r2.Form[k], vs...)
+	}
+	return r2
+}
+
+func filesFromContext(ctx context.Context) map[string][]*uploadedFile {
+	files, _ := ctx.Value(formFilesKey{}).(map[string][]*uploadedFile)
+	return files
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// multipartRequest posts one file of size bytes to /api/pdf/compress.
+func multipartRequest(t *testing.T, size int) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("level", "high")
+	fw, err := mw.CreateFormFile("file", "in.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("x"), size))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestReadToolFormSizeLimit(t *testing.T) {
+	prev := cfg.Uploads
+	t.Cleanup(func() { cfg.Uploads = prev })
+	cfg.Uploads.MaxRequestSize = 4 << 20
+	cfg.Uploads.ToolRequestSize = map[string]byteSize{"compress": 1 << 20}
+
+	tests := []struct {
+		tool string
+		size int
+		msg  string // empty when accepted
+	}{
+		{"merge", 2 << 20, ""},
+		{"merge", 5 << 20, "uploads are limited to 4 MiB per request"},
+		{"compress", 1 << 20, ""},
+		{"compress", 2 << 20, "uploads are limited to 1 MiB per request"},
+	}
+	for _, tt := range tests {
+		form, err := readToolForm(multipartRequest(t, tt.size), t.TempDir(), requestSizeLimit(tt.tool))
+		if tt.msg == "" {
+			if err != nil || len(form.File["file"]) != 1 || form.File["file"][0].Size != int64(tt.size) {
+				t.Errorf("%s, %d bytes: err = %v, want the file read", tt.tool, tt.size, err)
+			}
+			continue
+		}
+		var fe *formError
+		if !errors.As(err, &fe) || fe.status != http.StatusRequestEntityTooLarge || fe.msg != tt.msg {
+			t.Errorf("%s, %d bytes: err = %v, want 413 %q", tt.tool, tt.size, err, tt.msg)
+		}
+	}
+}
+
+func TestToolRequestSizeConfig(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string // substring of the error, empty when valid
+	}{
+		{"compress=64M,pipeline=4G", ""},
+		{"compress=64M,no-such-tool=1G", `unknown tool "no-such-tool"`},
+		{"compress=lots", "PDF_TOOL_REQUEST_SIZES"},
+		{"compress=0", "uploads.toolRequestSize.compress must be positive"},
+	}
+	for _, tt := range tests {
+		t.Setenv("PDF_TOOL_REQUEST_SIZES", tt.env)
+		c := defaultConfig()
+		err := loadConfigEnv(&c)
+		if err == nil {
+			err = c.validate()
+		}
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.env, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.env, err, tt.want)
+		}
+	}
+}
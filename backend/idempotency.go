@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const maxIdempotencyKeyLen = 255
+
+var idempotencyBucket = []byte("idempotency")
+
+// idempotencyEntry ties an Idempotency-Key to the job it started. Status and
+// Body hold the job's response once it has finished.
+type idempotencyEntry struct {
+	JobID     string    `json:"jobId"`
+	InputHash string    `json:"inputHash"`
+	CreatedAt time.Time `json:"createdAt"`
+	Status    int       `json:"status,omitempty"`
+	Body      []byte    `json:"body,omitempty"`
+}
+
+// idempotencyKeyFor returns the store key for the request's Idempotency-Key
+// header, scoped to the caller and the tool, or "" when the header is absent.
+func idempotencyKeyFor(r *http.Request, t pdfTool) (string, error) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return "", fmt.Errorf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen)
+	}
+	return callerID(r) + "\x00" + t.name + "\x00" + key, nil
+}
+
+// formHash fingerprints a submission: every field value and the checksum of
+// every file, independent of part order.
+func formHash(form *toolForm) string {
+	h := sha256.New()
+	keys := make([]string, 0, len(form.Value))
+	for k := range form.Value {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "v %q %q\n", k, form.Value[k])
+	}
+
+	fields := make([]string, 0, len(form.File))
+	for k := range form.File {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, f := range form.File[field] {
+			fmt.Fprintf(h, "f %q %q %s\n", field, f.Filename, f.SHA256)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyClaimTimeout is how long a reservation may go without a job in
+// memory before it is taken for abandoned, e.g. by a restart. Between the
+// reservation and jobs.create a request only checks its form and quota.
+const idempotencyClaimTimeout = time.Minute
+
+// reserveIdempotencyKey records e under key unless a still-usable entry is
+// already there, in which case that entry is returned along with false. An
+// entry is usable once it holds a response, while its job is in memory, and
+// for idempotencyClaimTimeout after it was reserved, before the job exists;
+// entries expire with the job directories in cleanupOldJobs. The entry
+// carries the job ID from the start, so two requests racing for a key
+// cannot both win it.
+func (s *jobStore) reserveIdempotencyKey(key string, e idempotencyEntry) (idempotencyEntry, bool, error) {
+	var prev idempotencyEntry
+	reserved := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		if v := b.Get([]byte(key)); v != nil && json.Unmarshal(v, &prev) == nil {
+			if prev.Status != 0 || jobs.get(prev.JobID) != nil || e.CreatedAt.Sub(prev.CreatedAt) < idempotencyClaimTimeout {
+				return nil
+			}
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		reserved = true
+		return b.Put([]byte(key), data)
+	})
+	if err != nil || reserved {
+		return e, true, err
+	}
+	return prev, false, nil
+}
+
+func (s *jobStore) getIdempotencyEntry(key string) (idempotencyEntry, bool) {
+	var e idempotencyEntry
+	var found bool
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(idempotencyBucket).Get([]byte(key)); v != nil {
+			found = json.Unmarshal(v, &e) == nil
+		}
+		return nil
+	})
+	return e, found
+}
+
+// settleIdempotencyKey stores the response of a finished job for replay.
+// Server-side failures and cancellations free the key instead, so a retry
+// runs the job again.
+func (s *jobStore) settleIdempotencyKey(key string, status int, body []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		if status == 0 || status >= 500 {
+			return b.Delete([]byte(key))
+		}
+		var e idempotencyEntry
+		v := b.Get([]byte(key))
+		if v == nil || json.Unmarshal(v, &e) != nil {
+			return nil
+		}
+		e.Status = status
+		e.Body = body
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// releaseIdempotencyKey frees a key reserved for a job that was turned away
+// before it started, unless another submission has taken it over since.
+func (s *jobStore) releaseIdempotencyKey(key, jobID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		var e idempotencyEntry
+		if v := b.Get([]byte(key)); v == nil || json.Unmarshal(v, &e) != nil || e.JobID != jobID {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// pruneIdempotencyKeys drops keys created before cutoff.
+func (s *jobStore) pruneIdempotencyKeys(cutoff time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		var stale [][]byte
+		_ = b.ForEach(func(k, v []byte) error {
+			var e idempotencyEntry
+			if json.Unmarshal(v, &e) != nil || e.CreatedAt.Before(cutoff) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replayIdempotent answers a retried submission from the job the key already
+// started. Async retries get the original 202; sync retries wait for the job
+// if needed and get its response.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, key string, prev idempotencyEntry, inputHash string) {
+	if prev.InputHash != inputHash {
+		errorJSON(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with different input")
+		return
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+
+	if wantsAsync(r) {
+		statusURL := fmt.Sprintf("%s/api/jobs/%s", inferBaseURL(r), prev.JobID)
+		status := jobQueued
+		if j := jobs.get(prev.JobID); j != nil {
+			status = j.snapshot().Status
+		} else if rec, ok := store.get(prev.JobID); ok {
+			status = rec.Status
+		}
+		w.Header().Set("Location", statusURL)
+		writeJSON(w, http.StatusAccepted, jobAcceptedResponse{JobID: prev.JobID, Status: status, StatusURL: statusURL})
+		return
+	}
+
+	if prev.Status == 0 {
+		if j := jobs.get(prev.JobID); j != nil {
+			select {
+			case <-j.done:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		var ok bool
+		if prev, ok = store.getIdempotencyEntry(key); !ok || prev.Status == 0 {
+			errorJSON(w, http.StatusConflict, "the original request with this Idempotency-Key did not complete; retry")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(prev.Status)
+	_, _ = w.Write(prev.Body)
+}
+
+// settleIdempotencyKey records how the job ended against its Idempotency-Key;
+// status 0 means it was cancelled.
+func (j *job) settleIdempotencyKey(status int, body []byte) {
+	if j.IdempotencyKey == "" {
+		return
+	}
+	if err := store.settleIdempotencyKey(j.IdempotencyKey, status, body); err != nil {
+		j.log.Error("failed to save idempotent response", "err", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFormHash(t *testing.T) {
+	file := func(name, sum string) []*uploadedFile { return []*uploadedFile{{Filename: name, SHA256: sum}} }
+	base := func() *toolForm {
+		return &toolForm{
+			Value: url.Values{"level": {"high"}, "pages": {"1", "2"}},
+			File:  map[string][]*uploadedFile{"file": file("in.pdf", "aaaa")},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(f *toolForm)
+		same   bool
+	}{
+		{"unchanged", func(f *toolForm) {}, true},
+		{"fields in another order", func(f *toolForm) { f.Value = url.Values{"pages": {"1", "2"}, "level": {"high"}} }, true},
+		{"other value", func(f *toolForm) { f.Value.Set("level", "low") }, false},
+		{"values reordered", func(f *toolForm) { f.Value["pages"] = []string{"2", "1"} }, false},
+		{"values joined", func(f *toolForm) { f.Value["pages"] = []string{`1" "2`} }, false},
+		{"extra field", func(f *toolForm) { f.Value.Set("async", "1") }, false},
+		{"other file content", func(f *toolForm) { f.File["file"] = file("in.pdf", "bbbb") }, false},
+		{"renamed file", func(f *toolForm) { f.File["file"] = file("other.pdf", "aaaa") }, false},
+		{"file under another field", func(f *toolForm) { f.File = map[string][]*uploadedFile{"files": file("in.pdf", "aaaa")} }, false},
+	}
+	want := formHash(base())
+	for _, tt := range tests {
+		f := base()
+		tt.change(f)
+		if got := formHash(f); (got == want) != tt.same {
+			t.Errorf("%s: hash equal = %v, want %v", tt.name, got == want, tt.same)
+		}
+	}
+}
+
+func TestIdempotencyKeyFor(t *testing.T) {
+	compress, merge := pdfTool{name: "compress"}, pdfTool{name: "merge"}
+	request := func(caller, key string) *http.Request {
+		r := requestAs(caller, &toolForm{Value: url.Values{}})
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		return r
+	}
+
+	if k, err := idempotencyKeyFor(request("key:ci", ""), compress); k != "" || err != nil {
+		t.Errorf("no header: %q, %v", k, err)
+	}
+	if _, err := idempotencyKeyFor(request("key:ci", strings.Repeat("k", maxIdempotencyKeyLen+1)), compress); err == nil {
+		t.Error("an overlong key was accepted")
+	}
+	a, _ := idempotencyKeyFor(request("key:ci", "k1"), compress)
+	tests := []struct {
+		name string
+		r    *http.Request
+		t    pdfTool
+		same bool
+	}{
+		{"same request", request("key:ci", "k1"), compress, true},
+		{"padded key", request("key:ci", " k1 "), compress, true},
+		{"other key", request("key:ci", "k2"), compress, false},
+		{"other caller", request("key:web", "k1"), compress, false},
+		{"other tool", request("key:ci", "k1"), merge, false},
+	}
+	for _, tt := range tests {
+		if b, _ := idempotencyKeyFor(tt.r, tt.t); (a == b) != tt.same {
+			t.Errorf("%s: same key = %v, want %v", tt.name, a == b, tt.same)
+		}
+	}
+}
+
+// liveJob registers an unfinished job for the test.
+func liveJob(t *testing.T) *job {
+	t.Helper()
+	j := jobs.create(uuid.NewString(), "compress")
+	t.Cleanup(func() {
+		jobs.mu.Lock()
+		delete(jobs.jobs, j.ID)
+		jobs.mu.Unlock()
+	})
+	return j
+}
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	running := liveJob(t)
+	now := time.Now()
+	held := idempotencyEntry{JobID: "job-1", InputHash: "h", CreatedAt: now}
+
+	tests := []struct {
+		name  string
+		prev  *idempotencyEntry // what the key holds, if anything
+		at    time.Time         // when the new request comes
+		fresh bool
+	}{
+		{"free key", nil, now, true},
+		{"running job", &idempotencyEntry{JobID: running.ID, CreatedAt: now.Add(-time.Hour)}, now, false},
+		{"job not created yet", &held, now.Add(time.Second), false},
+		{"job not created just before the timeout", &held, now.Add(idempotencyClaimTimeout - time.Millisecond), false},
+		// The job is gone without a response, e.g. after a restart.
+		{"abandoned", &held, now.Add(idempotencyClaimTimeout), true},
+		{"settled", &idempotencyEntry{JobID: "job-1", CreatedAt: now.Add(-time.Hour), Status: http.StatusOK}, now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStore(t)
+			if tt.prev != nil {
+				if _, ok, err := store.reserveIdempotencyKey("k", *tt.prev); !ok || err != nil {
+					t.Fatalf("setup: %v, %v", ok, err)
+				}
+				if tt.prev.Status != 0 {
+					if err := store.settleIdempotencyKey("k", tt.prev.Status, []byte(`{}`)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			got, fresh, err := store.reserveIdempotencyKey("k", idempotencyEntry{JobID: "job-2", InputHash: "h", CreatedAt: tt.at})
+			if err != nil || fresh != tt.fresh {
+				t.Fatalf("fresh = %v, %v; want %v", fresh, err, tt.fresh)
+			}
+			want := "job-2"
+			if !fresh {
+				want = tt.prev.JobID
+			}
+			if got.JobID != want {
+				t.Errorf("entry is for %s, want %s", got.JobID, want)
+			}
+		})
+	}
+
+	t.Run("concurrent retries", func(t *testing.T) {
+		withStore(t)
+		const n = 20
+		results := make(chan bool, n)
+		start := make(chan struct{})
+		for i := range n {
+			go func() {
+				<-start
+				_, fresh, err := store.reserveIdempotencyKey("k", idempotencyEntry{JobID: fmt.Sprintf("job-%d", i), InputHash: "h", CreatedAt: time.Now()})
+				results <- fresh && err == nil
+			}()
+		}
+		close(start)
+		won := 0
+		for range n {
+			if <-results {
+				won++
+			}
+		}
+		if won != 1 {
+			t.Errorf("%d of %d requests reserved the key, want 1", won, n)
+		}
+	})
+
+	t.Run("server error frees the key", func(t *testing.T) {
+		withStore(t)
+		if _, ok, _ := store.reserveIdempotencyKey("k", held); !ok {
+			t.Fatal("reservation failed")
+		}
+		if err := store.settleIdempotencyKey("k", http.StatusInternalServerError, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := store.getIdempotencyEntry("k"); found {
+			t.Error("key kept after a server error")
+		}
+	})
+}
+
+func TestReleaseIdempotencyKey(t *testing.T) {
+	withStore(t)
+	if _, ok, err := store.reserveIdempotencyKey("k", idempotencyEntry{JobID: "job-1", CreatedAt: time.Now()}); !ok || err != nil {
+		t.Fatalf("reservation: %v, %v", ok, err)
+	}
+	if err := store.releaseIdempotencyKey("k", "job-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := store.getIdempotencyEntry("k"); !found {
+		t.Error("released by a job that did not hold it")
+	}
+	if err := store.releaseIdempotencyKey("k", "job-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := store.getIdempotencyEntry("k"); found {
+		t.Error("not released by its job")
+	}
+}
+
+func TestReplayIdempotent(t *testing.T) {
+	withStore(t)
+	finished := idempotencyEntry{JobID: "job-1", InputHash: "h", Status: http.StatusOK, Body: []byte(`{"downloadUrl":"x"}`)}
+	unfinished := idempotencyEntry{JobID: "job-2", InputHash: "h"}
+	if err := store.put(jobRecord{ID: "job-1", Tool: "compress", Status: jobSucceeded}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		prev   idempotencyEntry
+		hash   string
+		status int
+		body   string // substring of the response
+	}{
+		{"other input", "/api/pdf/compress", finished, "other", http.StatusUnprocessableEntity, "different input"},
+		{"finished", "/api/pdf/compress", finished, "h", http.StatusOK, `{"downloadUrl":"x"}`},
+		{"finished async", "/api/pdf/compress?async=1", finished, "h", http.StatusAccepted, `"status":"succeeded"`},
+		{"lost async", "/api/pdf/compress?async=1", unfinished, "h", http.StatusAccepted, `"status":"queued"`},
+		{"lost", "/api/pdf/compress", unfinished, "h", http.StatusConflict, "did not complete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			replayIdempotent(rec, httptest.NewRequest(http.MethodPost, tt.target, nil), "k", tt.prev, tt.hash)
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("got %d %s, want %d with %s", rec.Code, rec.Body, tt.status, tt.body)
+			}
+			if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != (tt.status != http.StatusUnprocessableEntity) {
+				t.Errorf("Idempotent-Replayed = %q", rec.Header().Get("Idempotent-Replayed"))
+			}
+		})
+	}
+}
+
+func TestReplayIdempotentWaits(t *testing.T) {
+	withStore(t)
+	j := liveJob(t)
+	prev := idempotencyEntry{JobID: j.ID, InputHash: "h", CreatedAt: time.Now()}
+	if _, ok, err := store.reserveIdempotencyKey("k", prev); !ok || err != nil {
+		t.Fatalf("reservation: %v, %v", ok, err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		replayIdempotent(rec, httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil), "k", prev, "h")
+		done <- rec
+	}()
+	select {
+	case rec := <-done:
+		t.Fatalf("answered %d before the job finished", rec.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	body, _ := json.Marshal(map[string]string{"downloadUrl": "x"})
+	if err := store.settleIdempotencyKey("k", http.StatusOK, body); err != nil {
+		t.Fatal(err)
+	}
+	close(j.done)
+	rec := <-done
+	if rec.Code != http.StatusOK || rec.Body.String() != string(body) {
+		t.Errorf("got %d %s, want the job's response", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Job states reported by GET /api/jobs/{id}.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// job tracks a single tool invocation. Its ID is also the name of the job
+// directory under cfg.WorkDir, so download URLs stay /downloads/{id}/{file}.
+type job struct {
+	mu          sync.Mutex
+	ID          string
+	Tool        string
+	Status      string
+	DownloadURL string
+	Error       string
+	CreatedAt   time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	CallbackURL string
+	Client      string
+	Owner       string
+	Params      map[string][]string
+	Inputs      []jobInput
+	Commands    []jobCommand
+
+	// IdempotencyKey is the store key of the Idempotency-Key the job was
+	// submitted with, if any.
+	IdempotencyKey string
+
+	// usage is what the job's inputs amount to, for quotas and metrics.
+	usage usage
+
+	// log tags entries with the job and the request that submitted it.
+	log *slog.Logger
+
+	events jobEvents
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type jobStatusResponse struct {
+	JobID       string       `json:"jobId"`
+	Tool        string       `json:"tool"`
+	Status      string       `json:"status"`
+	DownloadURL string       `json:"downloadUrl,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	StartedAt   *time.Time   `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time   `json:"finishedAt,omitempty"`
+	Commands    []jobCommand `json:"commands,omitempty"`
+}
+
+type jobAcceptedResponse struct {
+	JobID     string `json:"jobId"`
+	Status    string `json:"status"`
+	StatusURL string `json:"statusUrl"`
+}
+
+func (j *job) owner() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Owner
+}
+
+func (j *job) start() {
+	j.mu.Lock()
+	j.Status = jobRunning
+	j.StartedAt = time.Now()
+	j.mu.Unlock()
+	j.persist()
+	j.events.publish(jobEvent{Type: eventPhase, Message: "tool started"})
+}
+
+// finish records the outcome of a handler from the response it wrote.
+// Handlers report failures as {"error": "..."} and results as {"downloadUrl": "..."}.
+func (j *job) finish(status int, body []byte) {
+	var resp struct {
+		DownloadURL string `json:"downloadUrl"`
+		Error       string `json:"error"`
+	}
+	_ = json.Unmarshal(body, &resp)
+
+	j.mu.Lock()
+	j.FinishedAt = time.Now()
+	if status >= 400 || resp.Error != "" {
+		j.Status = jobFailed
+		j.Error = resp.Error
+		if j.Error == "" {
+			j.Error = http.StatusText(status)
+		}
+	} else {
+		j.Status = jobSucceeded
+		j.DownloadURL = resp.DownloadURL
+	}
+	final := jobEvent{Type: eventStatus, Status: j.Status, DownloadURL: j.DownloadURL, Error: j.Error}
+	j.mu.Unlock()
+	j.persist()
+
+	if final.Status == jobSucceeded {
+		j.events.publish(jobEvent{Type: eventPhase, Message: "output written"})
+	}
+	j.events.publish(final)
+	j.events.close()
+}
+
+// maxJobCommands bounds the tool runs kept per job; tools that run once per
+// page would otherwise grow the record without limit.
+const maxJobCommands = 50
+
+// recordCommand adds a tool run to the job. Once the job has maxJobCommands,
+// the oldest successful run makes room; failures are what the record is for.
+func (j *job) recordCommand(c jobCommand) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Commands) >= maxJobCommands {
+		i := slices.IndexFunc(j.Commands, func(c jobCommand) bool { return c.ExitCode == 0 })
+		j.Commands = slices.Delete(j.Commands, max(i, 0), max(i, 0)+1)
+	}
+	j.Commands = append(j.Commands, c)
+}
+
+// markCancelled records that the job was stopped before it could finish.
+func (j *job) markCancelled() {
+	j.mu.Lock()
+	j.FinishedAt = time.Now()
+	j.Status = jobCancelled
+	j.Error = "job cancelled"
+	final := jobEvent{Type: eventStatus, Status: j.Status, Error: j.Error}
+	j.mu.Unlock()
+	j.persist()
+
+	j.events.publish(final)
+	j.events.close()
+}
+
+func (j *job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status == jobSucceeded || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+func (j *job) snapshot() jobStatusResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	resp := jobStatusResponse{
+		JobID:       j.ID,
+		Tool:        j.Tool,
+		Status:      j.Status,
+		DownloadURL: j.DownloadURL,
+		Error:       j.Error,
+		CreatedAt:   j.CreatedAt,
+		Commands:    slices.Clone(j.Commands),
+	}
+	if !j.StartedAt.IsZero() {
+		t := j.StartedAt
+		resp.StartedAt = &t
+	}
+	if !j.FinishedAt.IsZero() {
+		t := j.FinishedAt
+		resp.FinishedAt = &t
+	}
+	return resp
+}
+
+// jobRegistry holds the jobs started since the process came up.
+type jobRegistry struct {
+	mu   sync.RWMutex
+	jobs map[string]*job
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*job)}
+
+func (reg *jobRegistry) create(id, tool string) *job {
+	j := &job{
+		ID:        id,
+		Tool:      tool,
+		Status:    jobQueued,
+		CreatedAt: time.Now(),
+		log:       slog.Default(),
+		done:      make(chan struct{}),
+	}
+	reg.mu.Lock()
+	reg.jobs[j.ID] = j
+	reg.mu.Unlock()
+	return j
+}
+
+func (reg *jobRegistry) get(id string) *job {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.jobs[id]
+}
+
+// prune forgets jobs created before cutoff; their directories are removed by cleanupOldJobs.
+func (reg *jobRegistry) prune(cutoff time.Time) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for id, j := range reg.jobs {
+		if j.CreatedAt.Before(cutoff) {
+			delete(reg.jobs, id)
+		}
+	}
+}
+
+type jobContextKey struct{}
+
+func withJob(ctx context.Context, j *job) context.Context {
+	return context.WithValue(ctx, jobContextKey{}, j)
+}
+
+func jobFromContext(ctx context.Context) *job {
+	j, _ := ctx.Value(jobContextKey{}).(*job)
+	return j
+}
+
+// wantsAsync reports whether the client opted into async mode, either with
+// ?async=true or with the standard "Prefer: respond-async" header.
+func wantsAsync(r *http.Request) bool {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get("async"))) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toolHandler tracks every call of a tool handler as a job. The multipart
+// form is streamed into the job directory here, before the handler runs. By
+// default the handler then runs inside the request exactly as before. In async
+// mode the client gets 202 with the job ID right away, the handler runs in the
+// background, and the result is available from GET /api/jobs/{id}.
+func toolHandler(t pdfTool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.handler(w, r)
+			return
+		}
+
+		if !allowRequest(w, r) {
+			return
+		}
+
+		// Claim a place in the tool's pool before reading the upload, so a
+		// busy instance turns requests away cheaply.
+		pool := pools[t.class]
+		ticket, ok := pool.admit()
+		if !ok {
+			rejectBusy(w, pool)
+			return
+		}
+
+		// Uploads stream straight into the job directory, so the ID is needed
+		// before the form is read. Every exit before the job is created goes
+		// through drop, which gives back the pool place and the uploads;
+		// reject also answers with err.
+		id := uuid.NewString()
+		r = r.WithContext(withLogAttrs(r.Context(), slog.String("job_id", id), slog.String("tool", t.name)))
+		jobDir := filepath.Join(cfg.WorkDir, id)
+		var reservedKey string
+		drop := func() {
+			ticket.release()
+			_ = os.RemoveAll(jobDir)
+			if reservedKey != "" {
+				if err := store.releaseIdempotencyKey(reservedKey, id); err != nil {
+					slog.ErrorContext(r.Context(), "failed to free idempotency key", "err", err)
+				}
+			}
+		}
+		reject := func(err error) {
+			drop()
+			var typeErr *fileTypeError
+			if errors.As(err, &typeErr) {
+				fileTypeErrorJSON(w, typeErr)
+				return
+			}
+			formErrorJSON(w, err)
+		}
+
+		_, span := startSpan(r.Context(), "read upload")
+		form, err := readToolForm(r, jobDir, requestSizeLimit(t.name))
+		endSpan(span, err)
+		if err != nil {
+			reject(err)
+			return
+		}
+
+		// A retry is answered from the job it repeats before anything below
+		// looks at the form: checkUploadRefs would no longer find an upload
+		// the first attempt used up.
+		idemKey, err := idempotencyKeyFor(r, t)
+		if err != nil {
+			reject(asFormError(err, http.StatusBadRequest))
+			return
+		}
+		if idemKey != "" {
+			inputHash := formHash(form)
+			prev, fresh, err := store.reserveIdempotencyKey(idemKey, idempotencyEntry{JobID: id, InputHash: inputHash, CreatedAt: time.Now()})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "failed to reserve idempotency key", "err", err)
+				reject(&formError{http.StatusInternalServerError, "failed to check Idempotency-Key"})
+				return
+			}
+			if !fresh {
+				drop()
+				replayIdempotent(w, r, idemKey, prev, inputHash)
+				return
+			}
+			reservedKey = idemKey
+		}
+
+		callbackURL, err := callbackURLFrom(r, form)
+		if err == nil {
+			err = checkUploadRefs(r, form)
+		}
+		if err != nil {
+			reject(asFormError(err, http.StatusBadRequest))
+			return
+		}
+		if err := checkFileTypes(t, withForm(r, form)); err != nil {
+			reject(err)
+			return
+		}
+		pages, limitErr := checkDocumentLimits(r.Context(), withForm(r, form))
+		if limitErr != nil {
+			reject(limitErr)
+			return
+		}
+
+		if !beginWork() {
+			reject(&formError{http.StatusServiceUnavailable, "server is shutting down"})
+			return
+		}
+		// Charged only now, so a refused submission costs the client nothing.
+		u, charge := formUsage(form, pages)
+		if err := chargeQuota(w, r, charge); err != nil {
+			endWork()
+			reject(err)
+			return
+		}
+		j := jobs.create(id, t.name)
+		j.CallbackURL = callbackURL
+		j.IdempotencyKey = idemKey
+		j.usage = u
+		j.log = loggerFor(r.Context())
+		j.describe(r, form)
+		j.persist()
+		j.events.publish(jobEvent{Type: eventPhase, Message: "upload saved"})
+
+		async := wantsAsync(r)
+		ctx := r.Context()
+		if async {
+			// The request is finished once we reply; the job must outlive it.
+			// Only DELETE /api/jobs/{id} stops it from then on.
+			ctx = context.WithoutCancel(ctx)
+		}
+		// Either way the job is cancelled if it is still running when the
+		// shutdown deadline passes.
+		ctx, cancel := context.WithCancel(ctx)
+		stopOnAbort := context.AfterFunc(workCtx, cancel)
+		j.mu.Lock()
+		j.cancel = func() {
+			stopOnAbort()
+			cancel()
+		}
+		j.mu.Unlock()
+		jr := withForm(r.WithContext(withJob(ctx, j)), form)
+
+		if !async {
+			runJob(j, t, ticket, w, jr)
+			return
+		}
+
+		go runJob(j, t, ticket, nil, jr)
+
+		statusURL := fmt.Sprintf("%s/api/jobs/%s", inferBaseURL(r), j.ID)
+		w.Header().Set("Location", statusURL)
+		writeJSON(w, http.StatusAccepted, jobAcceptedResponse{
+			JobID:     j.ID,
+			Status:    jobQueued,
+			StatusURL: statusURL,
+		})
+	}
+}
+
+// runJob waits for the job's turn in its pool, runs the tool handler and
+// records the outcome on the job. w may be nil when nobody is waiting for the
+// response. If the job's context was cancelled along the way (client
+// disconnected or DELETE /api/jobs/{id}), whatever the handler left behind is
+// removed. Either way the job's callbackUrl, if any, is notified. The caller
+// must have registered the job with beginWork.
+func runJob(j *job, t pdfTool, ticket *poolTicket, w http.ResponseWriter, r *http.Request) {
+	defer endWork()
+	defer close(j.done)
+	defer observeJob(j)
+	defer notifyCallback(j)
+	defer j.cancel()
+	defer ticket.release()
+
+	ctx, span := startSpan(r.Context(), "job "+t.name,
+		attribute.String("job.id", j.ID),
+		attribute.String("job.tool", t.name),
+		attribute.Bool("job.async", w == nil),
+	)
+	defer func() {
+		j.mu.Lock()
+		span.SetAttributes(attribute.String("job.status", j.Status))
+		if j.Status == jobFailed {
+			span.SetStatus(codes.Error, j.Error)
+		}
+		j.mu.Unlock()
+		span.End()
+	}()
+	r = r.WithContext(ctx)
+
+	var rec *responseRecorder
+	if err := ticket.wait(r.Context()); err == nil {
+		span.AddEvent("started")
+		rec = &responseRecorder{ResponseWriter: w}
+		// With remote storage the response is held back until the job's files
+		// are stored, so its download URL works on every replica.
+		if storage.remote() {
+			rec = &responseRecorder{held: true}
+		}
+		j.start()
+		t.handler(rec, r)
+		if r.Context().Err() == nil {
+			// Uploads the handler did not move into place are of no further use.
+			_ = os.RemoveAll(filepath.Join(cfg.WorkDir, j.ID, partsDirName))
+			if rec.held && rec.statusCode() < 400 {
+				if err := publishDir(r.Context(), filepath.Join(cfg.WorkDir, j.ID)); err != nil {
+					j.log.Error("failed to store job files", "err", err)
+					rec = &responseRecorder{held: true}
+					errorJSON(rec, http.StatusInternalServerError, "failed to store job files")
+				}
+			}
+			j.finish(rec.statusCode(), rec.body.Bytes())
+			j.settleIdempotencyKey(rec.statusCode(), rec.body.Bytes())
+			if rec.held && w != nil {
+				rec.send(w)
+			}
+			return
+		}
+	}
+
+	j.markCancelled()
+	j.settleIdempotencyKey(0, nil)
+	if err := os.RemoveAll(filepath.Join(cfg.WorkDir, j.ID)); err != nil {
+		j.log.Error("failed to remove work dir", "err", err)
+	}
+	// Cut short by shutdown, a waiting client still gets an answer unless the
+	// handler already sent one.
+	answered := rec != nil && !rec.held && rec.status != 0
+	if w != nil && workCtx.Err() != nil && !answered {
+		errorJSON(w, http.StatusServiceUnavailable, "server is shutting down")
+	}
+}
+
+// handleJobStatus serves GET /api/jobs/{id}. Jobs no longer in memory, e.g.
+// from before a restart, are answered from the store.
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	owner, ok := jobOwner(r.PathValue("id"))
+	if !ok || !canAccess(r, owner) {
+		errorJSON(w, http.StatusNotFound, "job not found")
+		return
+	}
+	j := jobs.get(r.PathValue("id"))
+	if j == nil {
+		if rec, ok := store.get(r.PathValue("id")); ok {
+			writeJSON(w, http.StatusOK, rec.statusResponse())
+			return
+		}
+		errorJSON(w, http.StatusNotFound, "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
+
+// handleJobCancel serves DELETE /api/jobs/{id}. It kills the job's external
+// tools, waits briefly for the handler to unwind and reports the final state.
+func handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := jobOwner(r.PathValue("id")); !ok || !canAccess(r, owner) {
+		errorJSON(w, http.StatusNotFound, "job not found")
+		return
+	}
+	j := jobs.get(r.PathValue("id"))
+	if j == nil {
+		// Stored jobs that are not in memory have all finished one way or another.
+		if _, ok := store.get(r.PathValue("id")); ok {
+			errorJSON(w, http.StatusConflict, "job already finished")
+			return
+		}
+		errorJSON(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if j.finished() {
+		errorJSON(w, http.StatusConflict, "job already finished")
+		return
+	}
+
+	j.mu.Lock()
+	cancel := j.cancel
+	j.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+	case <-r.Context().Done():
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
+
+// responseRecorder keeps a copy of what a handler wrote so the job can pick
+// up the download URL or error. With a nil ResponseWriter it only records,
+// which is what async jobs use once the client has already been answered.
+// A held response is recorded whole, to be sent later with send.
+type responseRecorder struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+	held   bool
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	if rec.ResponseWriter != nil {
+		return rec.ResponseWriter.Header()
+	}
+	if rec.header == nil {
+		rec.header = make(http.Header)
+	}
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	if rec.ResponseWriter != nil {
+		rec.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	// Handlers only ever reply with small JSON documents; don't hold on to
+	// anything larger than that.
+	if rec.held || rec.body.Len() < 64<<10 {
+		rec.body.Write(b)
+	}
+	if rec.ResponseWriter != nil {
+		return rec.ResponseWriter.Write(b)
+	}
+	return len(b), nil
+}
+
+// send writes a held response to w.
+func (rec *responseRecorder) send(w http.ResponseWriter) {
+	for k, vs := range rec.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(rec.statusCode())
+	_, _ = w.Write(rec.body.Bytes())
+}
+
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
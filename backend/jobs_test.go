@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withPools gives every class a fresh pool of workers slots and queue places.
+func withPools(t *testing.T, workers, queue int) {
+	t.Helper()
+	prev := pools
+	t.Cleanup(func() { pools = prev })
+	pools = map[string]*workerPool{}
+	for _, class := range []string{classOffice, classOCR, classRaster, classLight, classPipeline} {
+		pools[class] = newWorkerPool(class, workers, queue, 5*time.Second)
+	}
+}
+
+// postFields posts a multipart form of plain fields to the tool route.
+func postFields(t *testing.T, target string, fields map[string]string, header http.Header) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	return r
+}
+
+func TestIdempotentRetryOfConsumedUpload(t *testing.T) {
+	withStore(t)
+	withUploadDir(t)
+	withStorage(t, localBackend)
+	withPools(t, 1, 1)
+	up := makeUpload(t, "", []byte("not a document"))
+
+	runs := 0
+	tool := pdfTool{name: "echo", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		f, err := formFile(r, "file")
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, "file required")
+			return
+		}
+		_, dir, _ := newJobDir(r)
+		if err := saveUploadedFile(f, filepath.Join(dir, "input")); err != nil {
+			errorJSON(w, http.StatusInternalServerError, "save failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"run": runs})
+	}}
+	h := toolHandler(tool)
+
+	attempts := []struct {
+		key    string
+		status int
+		body   string
+	}{
+		{"k1", http.StatusOK, `{"run":1}`},
+		// The upload is gone, but the retry is answered from the first run.
+		{"k1", http.StatusOK, `{"run":1}`},
+		{"k2", http.StatusBadRequest, "unknown upload"},
+	}
+	for i, a := range attempts {
+		rec := httptest.NewRecorder()
+		h(rec, postFields(t, "/api/pdf/echo", map[string]string{"file": up.ID}, http.Header{"Idempotency-Key": {a.key}}))
+		if rec.Code != a.status || !bytes.Contains(rec.Body.Bytes(), []byte(a.body)) {
+			t.Errorf("attempt %d (%s): %d %s, want %d with %s", i+1, a.key, rec.Code, rec.Body, a.status, a.body)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("the tool ran %d times, want 1", runs)
+	}
+}
+
+// draining puts the server into shutdown for the test.
+func draining(t *testing.T) {
+	t.Helper()
+	inflight.mu.Lock()
+	inflight.draining = true
+	inflight.mu.Unlock()
+	t.Cleanup(func() {
+		inflight.mu.Lock()
+		inflight.draining = false
+		inflight.mu.Unlock()
+	})
+}
+
+func TestQuotaChargedForAcceptedJobs(t *testing.T) {
+	tests := []struct {
+		name     string
+		drain    bool
+		want     int
+		wantUsed int64
+	}{
+		{"accepted", false, http.StatusOK, 100},
+		{"shutting down", true, http.StatusServiceUnavailable, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStore(t)
+			withStorage(t, localBackend)
+			withPools(t, 1, 1)
+			withQuota(t, rateSettings{}, quotaSettings{Bytes: 1 << 20})
+			if tt.drain {
+				draining(t)
+			}
+			h := toolHandler(pdfTool{name: "compress", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]string{})
+			}})
+
+			r := multipartRequest(t, 100)
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status %d %s, want %d", rec.Code, rec.Body, tt.want)
+			}
+			if used := usedToday(t, clientIdentity(r)); used.Bytes != tt.wantUsed {
+				t.Errorf("charged %d bytes, want %d", used.Bytes, tt.wantUsed)
+			}
+		})
+	}
+}
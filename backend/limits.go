@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Names of the limits an external tool can hit, as reported to clients.
+const (
+	limitTimeout   = "timeout"
+	limitMaxRSS    = "max_rss"
+	limitMaxCPU    = "max_cpu"
+	limitMaxOutput = "max_output"
+)
+
+// commandLimits caps a single run of an external tool. Zero means unlimited.
+type commandLimits struct {
+	Timeout   time.Duration // wall-clock time
+	MaxRSS    int64         // resident memory of the whole process group, in bytes
+	MaxCPU    time.Duration // CPU time per process
+	MaxOutput int64         // largest file the tool may write, in bytes
+}
+
+// defaultCommandLimits are tuned per binary: office and OCR conversions are
+// legitimately slow and hungry, pdfcpu/qpdf/poppler calls should be quick.
+var defaultCommandLimits = map[string]commandLimits{
+	"pdfcpu":      {Timeout: 2 * time.Minute, MaxRSS: 1 << 30, MaxCPU: 2 * time.Minute, MaxOutput: 1 << 30},
+	"qpdf":        {Timeout: 2 * time.Minute, MaxRSS: 1 << 30, MaxCPU: 2 * time.Minute, MaxOutput: 1 << 30},
+	"gs":          {Timeout: 5 * time.Minute, MaxRSS: 2 << 30, MaxCPU: 5 * time.Minute, MaxOutput: 2 << 30},
+	"pdfinfo":     {Timeout: 30 * time.Second, MaxRSS: 512 << 20, MaxCPU: 30 * time.Second, MaxOutput: 16 << 20},
+	"pdftoppm":    {Timeout: 5 * time.Minute, MaxRSS: 1 << 30, MaxCPU: 5 * time.Minute, MaxOutput: 512 << 20},
+	"pdftotext":   {Timeout: 2 * time.Minute, MaxRSS: 1 << 30, MaxCPU: 2 * time.Minute, MaxOutput: 512 << 20},
+	"pdfimages":   {Timeout: 2 * time.Minute, MaxRSS: 1 << 30, MaxCPU: 2 * time.Minute, MaxOutput: 512 << 20},
+	"pdftohtml":   {Timeout: 2 * time.Minute, MaxRSS: 1 << 30, MaxCPU: 2 * time.Minute, MaxOutput: 512 << 20},
+	"convert":     {Timeout: 5 * time.Minute, MaxRSS: 2 << 30, MaxCPU: 5 * time.Minute, MaxOutput: 2 << 30},
+	"identify":    {Timeout: 30 * time.Second, MaxRSS: 512 << 20, MaxCPU: 30 * time.Second, MaxOutput: 16 << 20},
+	"ocrmypdf":    {Timeout: 30 * time.Minute, MaxRSS: 4 << 30, MaxCPU: 30 * time.Minute, MaxOutput: 2 << 30},
+	"libreoffice": {Timeout: 10 * time.Minute, MaxRSS: 3 << 30, MaxCPU: 10 * time.Minute, MaxOutput: 1 << 30},
+	"wkhtmltopdf": {Timeout: 2 * time.Minute, MaxRSS: 2 << 30, MaxCPU: 2 * time.Minute, MaxOutput: 1 << 30},
+	"python3":     {Timeout: 10 * time.Minute, MaxRSS: 3 << 30, MaxCPU: 10 * time.Minute, MaxOutput: 1 << 30},
+	"diff":        {Timeout: time.Minute, MaxRSS: 512 << 20, MaxCPU: time.Minute, MaxOutput: 64 << 20},
+}
+
+// fallbackCommandLimits apply to binaries missing from defaultCommandLimits.
+var fallbackCommandLimits = commandLimits{Timeout: 5 * time.Minute, MaxRSS: 2 << 30, MaxCPU: 5 * time.Minute, MaxOutput: 1 << 30}
+
+// commandLimitOverrides holds the per-binary overrides read at startup.
+var commandLimitOverrides = map[string]commandLimits{}
+
+// prlimitPath is where prlimit(1) lives, if it is installed. Without it the
+// CPU and output limits cannot be applied to the child process.
+var prlimitPath, _ = exec.LookPath("prlimit")
+
+func commandLimitsFor(name string) commandLimits {
+	name = filepath.Base(name)
+	if l, ok := commandLimitOverrides[name]; ok {
+		return l
+	}
+	if l, ok := defaultCommandLimits[name]; ok {
+		return l
+	}
+	return fallbackCommandLimits
+}
+
+// loadCommandLimits reads per-binary overrides from the limits section of the
+// config, e.g. PDF_LIMITS_GS="timeout=10m,rss=4G,cpu=10m,output=2G".
+// Fields that are not given keep the binary's default; 0 disables a limit.
+func loadCommandLimits() error {
+	for name, raw := range cfg.Limits {
+		l, err := parseCommandLimits(raw, commandLimitsFor(name))
+		if err != nil {
+			return fmt.Errorf("PDF_LIMITS_%s: %w", envName(name), err)
+		}
+		commandLimitOverrides[name] = l
+	}
+
+	if prlimitPath == "" {
+		slog.Warn("prlimit not found: CPU and output size limits are not enforced")
+	}
+	return nil
+}
+
+func envName(binary string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, binary)
+}
+
+func parseCommandLimits(raw string, l commandLimits) (commandLimits, error) {
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return l, fmt.Errorf("expected key=value, got %q", field)
+		}
+		val = strings.TrimSpace(val)
+		var err error
+		switch strings.TrimSpace(key) {
+		case "timeout":
+			l.Timeout, err = parseLimitDuration(val)
+		case "cpu":
+			l.MaxCPU, err = parseLimitDuration(val)
+		case "rss":
+			l.MaxRSS, err = parseByteSize(val)
+		case "output":
+			l.MaxOutput, err = parseByteSize(val)
+		default:
+			return l, fmt.Errorf("unknown limit %q", key)
+		}
+		if err != nil {
+			return l, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return l, nil
+}
+
+func parseLimitDuration(s string) (time.Duration, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = errors.New("must not be negative")
+	}
+	return d, err
+}
+
+// parseByteSize accepts plain byte counts and K/M/G/T suffixes (powers of
+// 1024, with or without a trailing "B" or "iB").
+func parseByteSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%d GiB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%d MiB", n>>20)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// limitError reports that a tool was stopped for exceeding one of its limits.
+type limitError struct {
+	Tool  string
+	Limit string
+	Value string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s exceeded its %s limit (%s)", e.Tool, e.Limit, e.Value)
+}
+
+// status is 504 for wall-clock timeouts and 422 for resource limits, which
+// are a property of the submitted document rather than of the server.
+func (e *limitError) status() int {
+	if e.Limit == limitTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// commandErrorJSON reports a failed tool run. Limit violations get their own
+// status and name the limit, tools killed by shutdown a 503; anything else is
+// a 500 with msg.
+func commandErrorJSON(w http.ResponseWriter, err error, msg string) {
+	if workCtx.Err() != nil {
+		// The tool was killed because the server is going away.
+		errorJSON(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	var le *limitError
+	if errors.As(err, &le) {
+		writeJSON(w, le.status(), map[string]string{
+			"error": le.Error(),
+			"limit": le.Limit,
+			"tool":  le.Tool,
+		})
+		return
+	}
+	errorJSON(w, http.StatusInternalServerError, msg)
+}
+
+// limitArgs wraps a command line in prlimit so the kernel enforces the CPU
+// and file size limits on the tool itself.
+func limitArgs(l commandLimits, name string, args []string) (string, []string) {
+	if prlimitPath == "" || (l.MaxCPU <= 0 && l.MaxOutput <= 0) {
+		return name, args
+	}
+	// Left unwrapped, a missing tool fails to start as it would without
+	// prlimit, rather than as prlimit exiting with 127.
+	if _, err := exec.LookPath(name); err != nil {
+		return name, args
+	}
+	wrapped := []string{}
+	if l.MaxCPU > 0 {
+		// SIGXCPU at the soft limit; the hard limit (SIGKILL) only catches
+		// tools that ignore it.
+		secs := int64((l.MaxCPU + time.Second - 1) / time.Second)
+		wrapped = append(wrapped, fmt.Sprintf("--cpu=%d:%d", secs, secs+5))
+	}
+	if l.MaxOutput > 0 {
+		wrapped = append(wrapped, "--fsize="+strconv.FormatInt(l.MaxOutput, 10))
+	}
+	wrapped = append(wrapped, "--", name)
+	return prlimitPath, append(wrapped, args...)
+}
+
+// classifyCommandError turns the way a limited tool died into a limitError.
+// ctx is the command's own context, including its timeout.
+func classifyCommandError(ctx context.Context, parent context.Context, name string, l commandLimits, cmd *exec.Cmd, rssExceeded bool, err error) error {
+	tool := filepath.Base(name)
+	if rssExceeded {
+		return &limitError{Tool: tool, Limit: limitMaxRSS, Value: formatByteSize(l.MaxRSS)}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+		return &limitError{Tool: tool, Limit: limitTimeout, Value: l.Timeout.String()}
+	}
+	if cmd.ProcessState == nil {
+		return err
+	}
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return err
+	}
+	sig := ws.Signal()
+	if !ws.Signaled() {
+		// Wrapper scripts report a child killed by a signal as 128+signal.
+		code := ws.ExitStatus()
+		if code <= 128 {
+			return err
+		}
+		sig = syscall.Signal(code - 128)
+	}
+	switch sig {
+	case syscall.SIGXCPU:
+		return &limitError{Tool: tool, Limit: limitMaxCPU, Value: l.MaxCPU.String()}
+	case syscall.SIGXFSZ:
+		return &limitError{Tool: tool, Limit: limitMaxOutput, Value: formatByteSize(l.MaxOutput)}
+	case syscall.SIGKILL:
+		// The hard CPU limit is enforced with SIGKILL if SIGXCPU was ignored.
+		used := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+		if l.MaxCPU > 0 && used >= l.MaxCPU {
+			return &limitError{Tool: tool, Limit: limitMaxCPU, Value: l.MaxCPU.String()}
+		}
+	}
+	return err
+}
+
+// errOutputLimit stops the copying of a tool's output once outputCap is hit.
+var errOutputLimit = errors.New("output limit exceeded")
+
+// outputCap holds what a tool prints, on stdout and stderr together, to a
+// number of bytes, and kills its process group once that is passed.
+type outputCap struct {
+	mu   sync.Mutex
+	left int64
+	pgid int
+	over bool
+}
+
+// started records the tool's process group, killing it if the cap was hit
+// before it was known.
+func (c *outputCap) started(pgid int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pgid = pgid
+	if c.over {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+func (c *outputCap) exceeded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.over
+}
+
+func (c *outputCap) wrap(w io.Writer) io.Writer {
+	return cappedWriter{c, w}
+}
+
+type cappedWriter struct {
+	cap *outputCap
+	w   io.Writer
+}
+
+func (cw cappedWriter) Write(p []byte) (int, error) {
+	c := cw.cap
+	c.mu.Lock()
+	if c.over {
+		c.mu.Unlock()
+		return 0, errOutputLimit
+	}
+	if int64(len(p)) > c.left {
+		c.over = true
+		if c.pgid != 0 {
+			_ = syscall.Kill(-c.pgid, syscall.SIGKILL)
+		}
+		c.mu.Unlock()
+		return 0, errOutputLimit
+	}
+	c.left -= int64(len(p))
+	c.mu.Unlock()
+	return cw.w.Write(p)
+}
+
+// watchRSS kills the process group once its combined resident memory goes
+// over max. RLIMIT_RSS is not enforced by Linux, so this polls /proc instead.
+func watchRSS(done <-chan struct{}, pgid int, max int64, exceeded *atomic.Bool) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if processGroupRSS(pgid) > max {
+				exceeded.Store(true)
+				_ = syscall.Kill(-pgid, syscall.SIGKILL)
+				return
+			}
+		}
+	}
+}
+
+// processGroupRSS sums the resident set size of every process in the group.
+func processGroupRSS(pgid int) int64 {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	pageSize := int64(os.Getpagesize())
+	var total int64
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces; fields start after its ')'.
+		i := strings.LastIndexByte(string(stat), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		// fields[2] is pgrp, fields[21] is rss in pages (stat fields 5 and 24).
+		if len(fields) < 22 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		pages, _ := strconv.ParseInt(fields[21], 10, 64)
+		total += pages * pageSize
+	}
+	return total
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"4096", 4096, true},
+		{"512K", 512 << 10, true},
+		{"64M", 64 << 20, true},
+		{"64mb", 64 << 20, true},
+		{"2G", 2 << 30, true},
+		{"2GiB", 2 << 30, true},
+		{"1.5G", 3 << 29, true},
+		{" 1T ", 1 << 40, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"-1M", 0, false},
+		{"lots", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.raw)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCommandLimits(t *testing.T) {
+	base := commandLimits{Timeout: time.Minute, MaxRSS: 1 << 30, MaxCPU: time.Minute, MaxOutput: 1 << 30}
+	tests := []struct {
+		raw  string
+		want commandLimits
+		ok   bool
+	}{
+		{"", base, true},
+		{"timeout=10m", commandLimits{Timeout: 10 * time.Minute, MaxRSS: 1 << 30, MaxCPU: time.Minute, MaxOutput: 1 << 30}, true},
+		{"timeout=10m, rss=4G,cpu=0,output=2G", commandLimits{Timeout: 10 * time.Minute, MaxRSS: 4 << 30, MaxOutput: 2 << 30}, true},
+		{"timeout=0,rss=0,cpu=0,output=0", commandLimits{}, true},
+		{"timeout=-1s", base, false},
+		{"rss=lots", base, false},
+		{"memory=1G", base, false},
+		{"timeout", base, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCommandLimits(tt.raw, base)
+		if (err == nil) != tt.ok || tt.ok && got != tt.want {
+			t.Errorf("parseCommandLimits(%q) = %+v, %v; want %+v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	commandLimitOverrides["sleep"] = commandLimits{Timeout: 100 * time.Millisecond}
+	t.Cleanup(func() { delete(commandLimitOverrides, "sleep") })
+
+	err := execCommand(context.Background(), t.TempDir(), io.Discard, io.Discard, "sleep", "10")
+	var le *limitError
+	if !errors.As(err, &le) || le.Limit != limitTimeout || le.Tool != "sleep" {
+		t.Fatalf("err = %v, want a timeout limitError", err)
+	}
+	if le.status() != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", le.status())
+	}
+
+	// A cancelled request is not the tool's timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := execCommand(ctx, t.TempDir(), io.Discard, io.Discard, "sleep", "10"); errors.As(err, &le) {
+		t.Errorf("cancellation reported as %v", err)
+	}
+}
+
+func TestCommandOutputLimit(t *testing.T) {
+	commandLimitOverrides["sh"] = commandLimits{MaxOutput: 1 << 10}
+	t.Cleanup(func() { delete(commandLimitOverrides, "sh") })
+
+	tests := []struct {
+		name   string
+		script string
+		capped bool
+	}{
+		{"fits", "echo hello", false},
+		{"endless stdout", "yes", true},
+		{"endless stderr", "yes >&2", true},
+		{"both streams together", "head -c 600 /dev/zero; head -c 600 /dev/zero >&2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runCommandOutput(context.Background(), t.TempDir(), "sh", "-c", tt.script)
+			var le *limitError
+			if !tt.capped {
+				if err != nil || out != "hello\n" {
+					t.Fatalf("runCommandOutput = %q, %v", out, err)
+				}
+				return
+			}
+			if !errors.As(err, &le) || le.Limit != limitMaxOutput || le.Tool != "sh" {
+				t.Fatalf("err = %v, want a max_output limitError", err)
+			}
+			if le.status() != http.StatusUnprocessableEntity {
+				t.Errorf("status = %d, want 422", le.status())
+			}
+			if len(out) > 1<<10 {
+				t.Errorf("kept %d bytes of output, want at most 1 KiB", len(out))
+			}
+		})
+	}
+}
+
+func TestLimitArgs(t *testing.T) {
+	if prlimitPath == "" {
+		t.Skip("prlimit is not installed")
+	}
+	tests := []struct {
+		name   string
+		limits commandLimits
+		bin    string
+		want   []string
+	}{
+		{"no limits", commandLimits{}, "sh", []string{"sh", "-c", "true"}},
+		{"cpu", commandLimits{MaxCPU: 1500 * time.Millisecond}, "sh", []string{prlimitPath, "--cpu=2:7", "--", "sh", "-c", "true"}},
+		{"output", commandLimits{MaxOutput: 1 << 20}, "sh", []string{prlimitPath, "--fsize=1048576", "--", "sh", "-c", "true"}},
+		{"missing binary", commandLimits{MaxCPU: time.Second, MaxOutput: 1 << 20}, "no-such-binary", []string{"no-such-binary", "-c", "true"}},
+	}
+	for _, tt := range tests {
+		path, argv := limitArgs(tt.limits, tt.bin, []string{"-c", "true"})
+		if got := append([]string{path}, argv...); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// It fails to start rather than running prlimit to no avail.
+	commandLimitOverrides["no-such-binary"] = commandLimits{MaxOutput: 1 << 20}
+	t.Cleanup(func() { delete(commandLimitOverrides, "no-such-binary") })
+	if err := execCommand(context.Background(), t.TempDir(), io.Discard, io.Discard, "no-such-binary"); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("err = %v, want exec.ErrNotFound", err)
+	}
+}
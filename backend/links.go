@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Download and preview URLs carry an expiry and an HMAC over the path, so a
+// link cannot be extended or pointed at another job's files:
+//
+//	/downloads/{id}/{file}?expires=<unix>&sig=<hex>
+//
+// A download link can be made single-use (once=1) by sending singleUse=true
+// with the tool request. Spent links are claimed in the storage backend, so
+// with S3 every replica sees them, and their files are streamed rather than
+// redirected to a reusable presigned URL. The links secret (PDF_LINK_SECRET)
+// must be the same on every replica; links.ttl (PDF_LINK_TTL) sets how long
+// links stay valid.
+var linkSecret []byte
+
+var usedLinksBucket = []byte("used_links")
+
+// usedLinksPrefix is where spent single-use links are claimed in storage.
+const usedLinksPrefix = ".used-links/"
+
+func loadLinkSigning() error {
+	if cfg.Links.Secret != "" {
+		linkSecret = []byte(cfg.Links.Secret)
+		return nil
+	}
+	// Links then only work on this instance and until it restarts.
+	slog.Warn("PDF_LINK_SECRET is not set; using a random key for download links")
+	linkSecret = make([]byte, 32)
+	_, err := rand.Read(linkSecret)
+	return err
+}
+
+func linkSignature(p string, expires int64, once bool) string {
+	mac := hmac.New(sha256.New, linkSecret)
+	fmt.Fprintf(mac, "%s\n%d\n%t", p, expires, once)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signLink returns p with its expiry and signature appended.
+func signLink(p string, once bool) string {
+	expires := time.Now().Add(cfg.Links.TTL).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	if once {
+		q.Set("once", "1")
+	}
+	q.Set("sig", linkSignature(p, expires, once))
+	return p + "?" + q.Encode()
+}
+
+// wantsSingleUse reports whether the tool request asked for links that
+// stop working after the first download.
+func wantsSingleUse(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.FormValue("singleUse"))
+	return v
+}
+
+// checkLink verifies the signature and expiry of a download or preview link
+// and answers 403 when they do not hold. It does not spend a single-use link;
+// claimLink does, once the file is known to be served.
+func checkLink(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	once := q.Get("once") == "1"
+	sig, decErr := hex.DecodeString(q.Get("sig"))
+	if err != nil || decErr != nil {
+		http.Error(w, "invalid link", http.StatusForbidden)
+		return false
+	}
+	want, _ := hex.DecodeString(linkSignature(r.URL.Path, expires, once))
+	if !hmac.Equal(sig, want) {
+		http.Error(w, "invalid link", http.StatusForbidden)
+		return false
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "link has expired", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// claimLink spends a single-use link checked by checkLink, answering 403 if
+// it was spent already. A HEAD does not spend it, and other links pass.
+func claimLink(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	if q.Get("once") != "1" || r.Method != http.MethodGet {
+		return true
+	}
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	fresh, err := storage.claim(r.Context(), usedLinksPrefix+q.Get("sig"), time.Unix(expires, 0))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to spend link", "err", err)
+		http.Error(w, "failed to check link", http.StatusInternalServerError)
+		return false
+	}
+	if !fresh {
+		http.Error(w, "link has already been used", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// spendLink marks a single-use link as used, reporting false if it already
+// was. Entries are kept until the link would have expired anyway.
+func (s *jobStore) spendLink(sig string, expires time.Time) (bool, error) {
+	fresh := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usedLinksBucket)
+		if b.Get([]byte(sig)) != nil {
+			return nil
+		}
+		fresh = true
+		return b.Put([]byte(sig), []byte(strconv.FormatInt(expires.Unix(), 10)))
+	})
+	return fresh, err
+}
+
+// pruneUsedLinks drops used links that have expired since.
+func (s *jobStore) pruneUsedLinks(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usedLinksBucket)
+		var stale [][]byte
+		_ = b.ForEach(func(k, v []byte) error {
+			if exp, err := strconv.ParseInt(string(v), 10, 64); err != nil || exp < now.Unix() {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withStorage serves job files from a fresh work directory for the test.
+func withStorage(t *testing.T, backend func(root string) storageBackend) string {
+	t.Helper()
+	prevStorage, prevWork := storage, cfg.WorkDir
+	cfg.WorkDir = t.TempDir()
+	storage = backend(cfg.WorkDir)
+	t.Cleanup(func() { storage, cfg.WorkDir = prevStorage, prevWork })
+	return cfg.WorkDir
+}
+
+func localBackend(root string) storageBackend { return localStorage{root: root} }
+
+func withLinkSecret(t *testing.T) {
+	t.Helper()
+	prev := linkSecret
+	t.Cleanup(func() { linkSecret = prev })
+	linkSecret = []byte("link-secret")
+}
+
+func TestCheckLink(t *testing.T) {
+	withLinkSecret(t)
+	withStore(t)
+	withStorage(t, localBackend)
+	const p = "/downloads/job-1/output.pdf"
+	expired := time.Now().Add(-time.Minute).Unix()
+	expiredQuery := url.Values{"expires": {strconv.FormatInt(expired, 10)}, "sig": {linkSignature(p, expired, false)}}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"valid", signLink(p, false), http.StatusOK},
+		{"other file", strings.Replace(signLink(p, false), "output.pdf", "input.pdf", 1), http.StatusForbidden},
+		{"other job", strings.Replace(signLink(p, false), "job-1", "job-2", 1), http.StatusForbidden},
+		{"extended", strings.Replace(signLink(p, false), "expires=", "expires=9", 1), http.StatusForbidden},
+		{"once dropped", strings.Replace(signLink(p, true), "once=1&", "", 1), http.StatusForbidden},
+		{"expired", p + "?" + expiredQuery.Encode(), http.StatusForbidden},
+		{"unsigned", p, http.StatusForbidden},
+		{"bad signature", p + "?expires=9999999999&sig=zz", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if checkLink(rec, httptest.NewRequest(http.MethodGet, tt.target, nil)) {
+				rec.WriteHeader(http.StatusOK)
+			}
+			if rec.Code != tt.want {
+				t.Errorf("GET %s: %d, want %d", tt.target, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSingleUseDownload(t *testing.T) {
+	withLinkSecret(t)
+	withStore(t)
+	withAuth(t, "alice", "mallory")
+	root := withStorage(t, localBackend)
+	if err := store.put(jobRecord{ID: "job-1", Tool: "compress", Status: jobSucceeded, Owner: "key:alice"}); err != nil {
+		t.Fatal(err)
+	}
+	link := signLink("/downloads/job-1/output.pdf", true)
+	get := func(method, caller string) int {
+		r := httptest.NewRequest(method, link, nil)
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal{ID: caller, Method: "api-key"}))
+		rec := httptest.NewRecorder()
+		serveDownload(rec, r)
+		return rec.Code
+	}
+
+	// None of these may spend the link: the file is not there yet, the
+	// caller is not its owner, or the request is a HEAD.
+	steps := []struct {
+		name   string
+		method string
+		caller string
+		want   int
+	}{
+		{"missing file", http.MethodGet, "key:alice", http.StatusNotFound},
+		{"not the owner", http.MethodGet, "key:mallory", http.StatusNotFound},
+		{"head", http.MethodHead, "key:alice", http.StatusOK},
+		{"first download", http.MethodGet, "key:alice", http.StatusOK},
+		{"second download", http.MethodGet, "key:alice", http.StatusForbidden},
+	}
+	for _, st := range steps {
+		if st.name == "not the owner" {
+			if err := os.MkdirAll(filepath.Join(root, "job-1"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "job-1", "output.pdf"), []byte("%PDF-1.4"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := get(st.method, st.caller); got != st.want {
+			t.Errorf("%s: %d, want %d", st.name, got, st.want)
+		}
+	}
+}
+
+// presigningStorage is a local backend that hands out presigned URLs the way
+// S3 does.
+type presigningStorage struct {
+	localStorage
+}
+
+func (s presigningStorage) presign(ctx context.Context, key, filename string, inline bool) (string, error) {
+	return "https://bucket.example/" + key + "?X-Amz-Signature=x", nil
+}
+
+func TestServeStoredSingleUse(t *testing.T) {
+	withStore(t)
+	root := withStorage(t, func(root string) storageBackend { return presigningStorage{localStorage{root: root}} })
+	if err := os.MkdirAll(filepath.Join(root, "job-1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "job-1", "output.pdf"), []byte("%PDF-1.4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusFound},
+		{"?once=1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		if !serveStored(rec, httptest.NewRequest(http.MethodGet, "/downloads/job-1/output.pdf"+tt.query, nil), "job-1/output.pdf", false) {
+			t.Fatalf("%q: not served", tt.query)
+		}
+		if rec.Code != tt.want {
+			t.Errorf("%q: %d, want %d", tt.query, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestStorageKey(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want string
+		ok   bool
+	}{
+		{"job-1/output.pdf", "job-1/output.pdf", true},
+		{"job-1/previews/page-1.png", "job-1/previews/page-1.png", true},
+		{"../etc/passwd", "", false},
+		{"job-1/../../x", "", false},
+		{".used-links/abc", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := storageKey(tt.rel)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("storageKey(%q) = %q, %v; want %q, %v", tt.rel, got, ok, tt.want, tt.ok)
+		}
+	}
+}
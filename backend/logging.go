@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logs are structured (log/slog), JSON by default, on stderr. Entries written
+// with a request's context carry its request_id and caller, and those of a
+// tool request also job_id and tool, so every line of one job can be found:
+//
+//	{"level":"ERROR","msg":"compress failed","request_id":"…","caller":"key:ci","job_id":"…","tool":"compress","err":"…"}
+//
+// With a trace in the context (tracing.go) they carry its trace_id too.
+//
+// log.level (PDF_LOG_LEVEL) is debug, info, warn or error; log.format
+// (PDF_LOG_FORMAT) is json or text.
+func setupLogging() {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.Log.Level)) // checked by validate
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if cfg.Log.Format == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	// The standard logger, still used by net/http, goes through it as well.
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
+
+// fatal logs msg and exits; it is for startup errors.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+type logAttrsKey struct{}
+
+// requestLog identifies the request a context belongs to. The caller is
+// filled in by requireAuth once known.
+type requestLog struct {
+	id     string
+	caller string
+}
+
+type requestLogKey struct{}
+
+// withLogAttrs returns ctx with attrs added to every entry logged with it.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	all := make([]slog.Attr, 0, len(prev)+len(attrs))
+	all = append(append(all, prev...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, all)
+}
+
+// contextHandler adds the attributes attached with withLogAttrs.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	rec.AddAttrs(logAttrs(ctx)...)
+	return h.Handler.Handle(ctx, rec)
+}
+
+// logAttrs returns what entries logged with ctx are tagged with.
+func logAttrs(ctx context.Context) []slog.Attr {
+	var attrs []slog.Attr
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		attrs = append(attrs, slog.String("request_id", rl.id))
+		if rl.caller != "" {
+			attrs = append(attrs, slog.String("caller", rl.caller))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+	if more, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		attrs = append(attrs, more...)
+	}
+	return attrs
+}
+
+// loggerFor returns a logger that tags entries like ctx does, for work that
+// outlives the request.
+func loggerFor(ctx context.Context) *slog.Logger {
+	attrs := logAttrs(ctx)
+	args := make([]any, len(attrs))
+	for i, a := range attrs {
+		args[i] = a
+	}
+	return slog.With(args...)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDs gives every request an ID, the client's X-Request-ID if it sent a
+// usable one, echoes it in the response and logs the request when it is done.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestLogKey{}, &requestLog{id: id})
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch r.URL.Path {
+		case "/health", "/ready", "/metrics":
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client", clientAddr(r),
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(c rune) bool {
+		return c <= ' ' || c > '~'
+	})
+}
+
+// setLogCaller records who made the request for its log entries.
+func setLogCaller(ctx context.Context, caller string) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.caller = caller
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withLogOutput sends the default logger's JSON entries to the returned
+// buffer for the test.
+func withLogOutput(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	return &buf
+}
+
+func TestJobLogContext(t *testing.T) {
+	withStore(t)
+	withStorage(t, localBackend)
+	withPools(t, 1, 1)
+	logs := withLogOutput(t)
+
+	var j *job
+	tool := pdfTool{name: "echo", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+		j = jobFromContext(r.Context())
+		slog.InfoContext(r.Context(), "working")
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}}
+	h := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setLogCaller(r.Context(), "key:ci")
+		toolHandler(tool)(w, r)
+	}))
+	r := multipartRequest(t, 10)
+	r.URL.Path = "/api/pdf/echo"
+	r.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Request-ID") != "req-1" || j == nil {
+		t.Fatalf("%d %s, X-Request-ID %q", rec.Code, rec.Body, rec.Header().Get("X-Request-ID"))
+	}
+	// Work that outlives the request logs through the job's logger.
+	j.log.Warn("after the request")
+
+	entries := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("not JSON: %q", line)
+		}
+		entries[e["msg"].(string)] = e
+	}
+
+	tests := []struct {
+		msg  string
+		want map[string]any
+	}{
+		{"working", map[string]any{"level": "INFO", "request_id": "req-1", "caller": "key:ci", "job_id": j.ID, "tool": "echo"}},
+		{"after the request", map[string]any{"level": "WARN", "request_id": "req-1", "caller": "key:ci", "job_id": j.ID, "tool": "echo"}},
+		{"request", map[string]any{"level": "INFO", "request_id": "req-1", "caller": "key:ci", "method": "POST", "path": "/api/pdf/echo", "status": 200.0}},
+	}
+	for _, tt := range tests {
+		e, ok := entries[tt.msg]
+		if !ok {
+			t.Errorf("no %q entry in %s", tt.msg, logs)
+			continue
+		}
+		for k, v := range tt.want {
+			if e[k] != v {
+				t.Errorf("%q: %s = %v, want %v", tt.msg, k, e[k], v)
+			}
+		}
+	}
+	// The request line is not about the job.
+	if id, ok := entries["request"]["job_id"]; ok {
+		t.Errorf("request entry has job_id %v", id)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	tests := []struct {
+		header string
+		kept   bool
+	}{
+		{"req-1", true},
+		{"3f1c9e2a-6d1b-4c3e-9b8a-0c2d4e6f8a1b", true},
+		{"", false},
+		{"has space", false},
+		{"new\nline", false},
+		{"ünïcode", false},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		var seen string
+		h := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Context().Value(requestLogKey{}).(*requestLog).id
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		r.Header["X-Request-Id"] = []string{tt.header}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		got := rec.Header().Get("X-Request-ID")
+		if got != seen || (got == tt.header) != tt.kept || got == "" {
+			t.Errorf("X-Request-ID %q: answered %q, logged %q; kept = %v", tt.header, got, seen, tt.kept)
+		}
+	}
+}
@@ -4,27 +4,35 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	baseWorkDir     = "/app/work"
-	defaultFilename = "output.pdf"
-)
+const defaultFilename = "output.pdf"
 
 type downloadResponse struct {
 	DownloadURL string `json:"downloadUrl"`
@@ -40,8 +48,41 @@ type previewResponse struct {
 }
 
 func main() {
-	if err := os.MkdirAll(baseWorkDir, 0o755); err != nil {
-		log.Fatalf("failed to create work dir: %v", err)
+	if err := loadConfig(); err != nil {
+		fatal("invalid configuration", err)
+	}
+	setupLogging()
+	flushTraces, err := setupTracing()
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+	if err := os.MkdirAll(cfg.WorkDir, 0o755); err != nil {
+		fatal("failed to create work dir", err)
+	}
+	if err := os.MkdirAll(cfg.UploadDir, 0o755); err != nil {
+		fatal("failed to create upload dir", err)
+	}
+	if err := loadCommandLimits(); err != nil {
+		fatal("invalid tool limits", err)
+	}
+	if err := loadPools(); err != nil {
+		fatal("invalid worker pools", err)
+	}
+	if err := loadRateLimits(); err != nil {
+		fatal("invalid rate limits", err)
+	}
+	if err := loadAuth(); err != nil {
+		fatal("invalid authentication settings", err)
+	}
+	if err := loadLinkSigning(); err != nil {
+		fatal("invalid link signing", err)
+	}
+	if store, err = openJobStore(); err != nil {
+		fatal("failed to open job store", err)
+	}
+	defer store.Close()
+	if storage, err = openStorage(); err != nil {
+		fatal("failed to open storage", err)
 	}
 
 	mux := http.NewServeMux()
@@ -50,106 +91,128 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("GET /health/details", handleHealthDetails)
+	mux.HandleFunc("GET /ready", handleReady)
+	mux.Handle("GET /metrics", metricsHandler())
+
+	// Every tool is served under the backwards-compatible /pdf/ prefix and the
+	// preferred API base for the frontend: VITE_PDF_API_BASE_URL="/api/pdf"
+	for _, t := range pdfTools {
+		if !cfg.toolEnabled(t.name) {
+			continue
+		}
+		h := instrumentTool(t.name, toolHandler(t))
+		mux.HandleFunc("/pdf/"+t.name, h)
+		mux.HandleFunc("/api/pdf/"+t.name, h)
+	}
 
-	// Backwards-compatible routes:
-	mux.HandleFunc("/pdf/merge", handleMerge)
-	mux.HandleFunc("/pdf/split", handleSplit)
-	mux.HandleFunc("/pdf/remove-pages", handleRemovePages)
-	mux.HandleFunc("/pdf/extract-pages", handleExtractPages)
-	mux.HandleFunc("/pdf/scan-to-pdf", handleScanToPDF)
-	mux.HandleFunc("/pdf/compress", handleCompress)
-	mux.HandleFunc("/pdf/repair", handleRepair)
-	mux.HandleFunc("/pdf/ocr", handleOCR)
-	mux.HandleFunc("/pdf/convert-to-pdfa", handleConvertToPDFA)
-	mux.HandleFunc("/pdf/image-to-pdf", handleImageToPDF)
-	mux.HandleFunc("/pdf/word-to-pdf", handleWordToPDF)
-	mux.HandleFunc("/pdf/preview", handlePreview)
-	mux.HandleFunc("/pdf/organize", handleOrganize)
-	mux.HandleFunc("/pdf/rotate", handleRotate)
-	mux.HandleFunc("/pdf/crop", handleCrop)
-	mux.HandleFunc("/pdf/page-numbers", handlePageNumbers)
-	mux.HandleFunc("/pdf/watermark", handleWatermark)
-
-	// Preferred API base for the frontend: VITE_PDF_API_BASE_URL="/api/pdf"
-	mux.HandleFunc("/api/pdf/merge", handleMerge)
-	mux.HandleFunc("/api/pdf/split", handleSplit)
-	mux.HandleFunc("/api/pdf/remove-pages", handleRemovePages)
-	mux.HandleFunc("/api/pdf/extract-pages", handleExtractPages)
-	mux.HandleFunc("/api/pdf/scan-to-pdf", handleScanToPDF)
-	mux.HandleFunc("/api/pdf/compress", handleCompress)
-	mux.HandleFunc("/api/pdf/repair", handleRepair)
-	mux.HandleFunc("/api/pdf/ocr", handleOCR)
-	mux.HandleFunc("/api/pdf/convert-to-pdfa", handleConvertToPDFA)
-	mux.HandleFunc("/api/pdf/image-to-pdf", handleImageToPDF)
-	mux.HandleFunc("/api/pdf/word-to-pdf", handleWordToPDF)
-	mux.HandleFunc("/api/pdf/preview", handlePreview)
-	mux.HandleFunc("/api/pdf/organize", handleOrganize)
-	mux.HandleFunc("/api/pdf/rotate", handleRotate)
-	mux.HandleFunc("/api/pdf/crop", handleCrop)
-	mux.HandleFunc("/api/pdf/page-numbers", handlePageNumbers)
-	mux.HandleFunc("/api/pdf/watermark", handleWatermark)
+	mux.HandleFunc("POST /api/pipelines", instrumentTool(pipelineTool.name, toolHandler(pipelineTool)))
 
-	// PDF Security Tools
-	mux.HandleFunc("/api/pdf/protect", handleProtectPDF)
-	mux.HandleFunc("/pdf/protect", handleProtectPDF)
-	mux.HandleFunc("/api/pdf/unlock", handleUnlockPDF)
-	mux.HandleFunc("/pdf/unlock", handleUnlockPDF)
-	mux.HandleFunc("/api/pdf/redact", handleRedactPDF)
-	mux.HandleFunc("/pdf/redact", handleRedactPDF)
-	mux.HandleFunc("/api/pdf/flatten", handleFlattenPDF)
-	mux.HandleFunc("/pdf/flatten", handleFlattenPDF)
+	mux.HandleFunc("GET /api/jobs", handleJobList)
+	mux.HandleFunc("GET /api/jobs/{id}", handleJobStatus)
+	mux.HandleFunc("GET /api/jobs/{id}/events", handleJobEvents)
+	mux.HandleFunc("GET /api/jobs/{id}/manifest", handleJobManifest)
+	mux.HandleFunc("DELETE /api/jobs/{id}", handleJobCancel)
+	mux.HandleFunc("GET /api/queue", handleQueue)
 
-	// PDF Conversion Tools
-	mux.HandleFunc("/api/pdf/pdf-to-word", handlePDFToWord)
-	mux.HandleFunc("/pdf/pdf-to-word", handlePDFToWord)
-	mux.HandleFunc("/api/pdf/pdf-to-excel", handlePDFToExcel)
-	mux.HandleFunc("/pdf/pdf-to-excel", handlePDFToExcel)
-	mux.HandleFunc("/api/pdf/pdf-to-powerpoint", handlePDFToPowerPoint)
-	mux.HandleFunc("/pdf/pdf-to-powerpoint", handlePDFToPowerPoint)
-	mux.HandleFunc("/api/pdf/pdf-to-jpg", handlePDFToJPG)
-	mux.HandleFunc("/pdf/pdf-to-jpg", handlePDFToJPG)
-	mux.HandleFunc("/api/pdf/extract-text", handleExtractText)
-	mux.HandleFunc("/pdf/extract-text", handleExtractText)
-	mux.HandleFunc("/api/pdf/extract-images", handleExtractImages)
-	mux.HandleFunc("/pdf/extract-images", handleExtractImages)
-	mux.HandleFunc("/api/pdf/html-to-pdf", handleHTMLToPDF)
-	mux.HandleFunc("/pdf/html-to-pdf", handleHTMLToPDF)
-	mux.HandleFunc("/api/pdf/excel-to-pdf", handleExcelToPDF)
-	mux.HandleFunc("/pdf/excel-to-pdf", handleExcelToPDF)
-	mux.HandleFunc("/api/pdf/powerpoint-to-pdf", handlePowerPointToPDF)
-	mux.HandleFunc("/pdf/powerpoint-to-pdf", handlePowerPointToPDF)
-
-	// Advanced PDF Tools
-	mux.HandleFunc("/api/pdf/compare", handleComparePDFs)
-	mux.HandleFunc("/pdf/compare", handleComparePDFs)
-	mux.HandleFunc("/api/pdf/digital-signature", handleDigitalSignature)
-	mux.HandleFunc("/pdf/digital-signature", handleDigitalSignature)
-	mux.HandleFunc("/api/pdf/validate-pdfa", handleValidatePDFA)
-	mux.HandleFunc("/pdf/validate-pdfa", handleValidatePDFA)
-	mux.HandleFunc("/api/pdf/pdf-to-html", handlePDFToHTML)
-	mux.HandleFunc("/pdf/pdf-to-html", handlePDFToHTML)
-	mux.HandleFunc("/api/pdf/add-header-footer", handleAddHeaderFooter)
-	mux.HandleFunc("/pdf/add-header-footer", handleAddHeaderFooter)
+	mux.HandleFunc("POST /api/uploads", handleUploadCreate)
+	mux.HandleFunc("HEAD /api/uploads/{id}", handleUploadHead)
+	mux.HandleFunc("GET /api/uploads/{id}", handleUploadStatus)
+	mux.HandleFunc("PATCH /api/uploads/{id}", handleUploadPatch)
+	mux.HandleFunc("DELETE /api/uploads/{id}", handleUploadDelete)
 
 	mux.HandleFunc("/downloads/", serveDownload)
 	mux.HandleFunc("/previews/", servePreview)
 
+	go probeLoop()
+
 	// Simple background cleanup for old jobs.
 	go func() {
-		ticker := time.NewTicker(30 * time.Minute)
+		ticker := time.NewTicker(cfg.CleanupInterval)
 		defer ticker.Stop()
 		for range ticker.C {
-			cleanupOldJobs(2 * time.Hour) // adjust retention as needed
+			cleanupOldJobs(cfg.Retention)
+			cleanupOldUploads()
 		}
 	}()
 
-	addr := ":8080"
-	log.Printf("PDF backend listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("server error: %v", err)
+	addr := cfg.Listen
+	srv := &http.Server{Addr: addr, Handler: traceRequests(mux, requestIDs(requireAuth(mux)))}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		slog.Info("PDF backend listening", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("server error", err)
+		}
+	}()
+	<-ctx.Done()
+	// A second signal kills the process right away.
+	stop()
+	shutdown(srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("failed to flush traces", "err", err)
 	}
 }
 
+// pdfTool is a tool endpoint; name is the last path segment of its route and
+// class picks the worker pool its jobs run in. needs lists the dependencies
+// (see readiness.go) the handler cannot work without, accepts the types its
+// input files may be (see filetypes.go).
+type pdfTool struct {
+	name    string
+	class   string
+	handler http.HandlerFunc
+	needs   []string
+	accepts []fileType
+}
+
+var pdfTools = []pdfTool{
+	{name: "merge", class: classLight, handler: handleMerge, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "split", class: classLight, handler: handleSplit, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "remove-pages", class: classLight, handler: handleRemovePages, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "extract-pages", class: classLight, handler: handleExtractPages, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "scan-to-pdf", class: classOCR, handler: handleScanToPDF, needs: []string{"convert", "ocrmypdf"}, accepts: imageInput},
+	{name: "compress", class: classRaster, handler: handleCompress, needs: []string{"gs", "pdfinfo"}, accepts: pdfInput},
+	{name: "repair", class: classLight, handler: handleRepair, needs: []string{"pdfcpu", "pdfinfo"}, accepts: damagedPDFInput},
+	{name: "ocr", class: classOCR, handler: handleOCR, needs: []string{"ocrmypdf", "pdfinfo"}, accepts: pdfInput},
+	{name: "convert-to-pdfa", class: classRaster, handler: handleConvertToPDFA, needs: []string{"gs", "pdfinfo"}, accepts: pdfInput},
+	{name: "image-to-pdf", class: classRaster, handler: handleImageToPDF, needs: []string{"convert"}, accepts: imageInput},
+	{name: "word-to-pdf", class: classOffice, handler: handleWordToPDF, needs: []string{"libreoffice"}, accepts: wordInput},
+	{name: "preview", class: classLight, handler: handlePreview, needs: []string{"pdfcpu", "pdfinfo", "pdftoppm"}, accepts: pdfInput},
+	{name: "organize", class: classLight, handler: handleOrganize, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "rotate", class: classLight, handler: handleRotate, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "crop", class: classLight, handler: handleCrop, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "page-numbers", class: classLight, handler: handlePageNumbers, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+	{name: "watermark", class: classLight, handler: handleWatermark, needs: []string{"pdfcpu", "pdfinfo"}, accepts: pdfInput},
+
+	// PDF Security Tools
+	{name: "protect", class: classLight, handler: handleProtectPDF, needs: []string{"qpdf", "pdfinfo"}, accepts: pdfInput},
+	{name: "unlock", class: classLight, handler: handleUnlockPDF, needs: []string{"qpdf", "pdfinfo"}, accepts: pdfInput},
+	{name: "redact", class: classRaster, handler: handleRedactPDF, needs: []string{"pdfinfo", "pdftoppm", "convert", "identify", "qpdf"}, accepts: pdfInput},
+	{name: "flatten", class: classLight, handler: handleFlattenPDF, needs: []string{"qpdf", "pdfinfo"}, accepts: pdfInput},
+
+	// PDF Conversion Tools
+	{name: "pdf-to-word", class: classOffice, handler: handlePDFToWord, needs: []string{"python3", "pdf2docx", "pdfinfo"}, accepts: pdfInput},
+	{name: "pdf-to-excel", class: classOffice, handler: handlePDFToExcel, needs: []string{"python3", "tabula", "pandas", "pdfinfo"}, accepts: pdfInput},
+	{name: "pdf-to-powerpoint", class: classOffice, handler: handlePDFToPowerPoint, needs: []string{"python3", "pdf2image", "pptx", "pdftoppm", "pdfinfo"}, accepts: pdfInput},
+	{name: "pdf-to-jpg", class: classRaster, handler: handlePDFToJPG, needs: []string{"pdfinfo", "pdftoppm"}, accepts: pdfInput},
+	{name: "extract-text", class: classLight, handler: handleExtractText, needs: []string{"pdftotext", "pdfinfo"}, accepts: pdfInput},
+	{name: "extract-images", class: classRaster, handler: handleExtractImages, needs: []string{"pdfimages", "pdfinfo"}, accepts: pdfInput},
+	{name: "html-to-pdf", class: classOffice, handler: handleHTMLToPDF, needs: []string{"wkhtmltopdf"}, accepts: htmlInput},
+	{name: "excel-to-pdf", class: classOffice, handler: handleExcelToPDF, needs: []string{"libreoffice"}, accepts: excelInput},
+	{name: "powerpoint-to-pdf", class: classOffice, handler: handlePowerPointToPDF, needs: []string{"libreoffice"}, accepts: powerPointInput},
+
+	// Advanced PDF Tools
+	{name: "compare", class: classLight, handler: handleComparePDFs, needs: []string{"pdftotext", "diff", "pdfinfo"}, accepts: pdfInput},
+	{name: "digital-signature", class: classLight, handler: handleDigitalSignature, needs: []string{"qpdf", "pdfinfo"}, accepts: pdfInput},
+	{name: "validate-pdfa", class: classLight, handler: handleValidatePDFA, needs: []string{"qpdf", "pdfinfo"}, accepts: pdfInput},
+	{name: "pdf-to-html", class: classLight, handler: handlePDFToHTML, needs: []string{"pdftohtml", "pdfinfo"}, accepts: pdfInput},
+	{name: "add-header-footer", class: classRaster, handler: handleAddHeaderFooter, needs: []string{"pdfinfo", "gs"}, accepts: pdfInput},
+}
+
 func parseIntDefault(s string, def int) int {
 	s = strings.TrimSpace(s)
 	if s == "" {
@@ -191,9 +254,14 @@ func baseNameWithoutExt(filename string) string {
 	return strings.TrimSuffix(filename, filepath.Ext(filename))
 }
 
-func pageCountPoppler(dir, inPath string) (int, error) {
+func pageCountPoppler(ctx context.Context, dir, inPath string) (n int, err error) {
+	ctx, span := startSpan(ctx, "page count", attribute.String("page_count.method", "pdfinfo"))
+	defer func() {
+		span.SetAttributes(attribute.Int("pdf.pages", n))
+		endSpan(span, err)
+	}()
 	// Uses poppler-utils (pdfinfo), which is already a required dependency for previews.
-	out, err := runCommandOutput(dir, "pdfinfo", inPath)
+	out, err := runCommandOutput(ctx, dir, "pdfinfo", inPath)
 	if err != nil {
 		return 0, fmt.Errorf("pdfinfo failed: %w", err)
 	}
@@ -212,8 +280,13 @@ func pageCountPoppler(dir, inPath string) (int, error) {
 	return 0, fmt.Errorf("could not parse page count")
 }
 
-func pageCountPDF(dir, inPath string) (int, error) {
-	out, err := runCommandOutput(dir, "pdfcpu", "info", inPath)
+func pageCountPDF(ctx context.Context, dir, inPath string) (n int, err error) {
+	ctx, span := startSpan(ctx, "page count", attribute.String("page_count.method", "pdfcpu"))
+	defer func() {
+		span.SetAttributes(attribute.Int("pdf.pages", n))
+		endSpan(span, err)
+	}()
+	out, err := runCommandOutput(ctx, dir, "pdfcpu", "info", inPath)
 	if err != nil {
 		return 0, fmt.Errorf("pdfcpu info failed: %w", err)
 	}
@@ -238,12 +311,8 @@ func handleRotate(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
@@ -255,7 +324,7 @@ func handleRotate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -270,9 +339,9 @@ func handleRotate(w http.ResponseWriter, r *http.Request) {
 	outName := defaultFilename
 	outPath := filepath.Join(dir, outName)
 
-	if err := runCommand(dir, "pdfcpu", "rotate", inPath, strconv.Itoa(degrees), outPath); err != nil {
-		log.Printf("rotate error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to rotate PDF")
+	if err := runCommand(r.Context(), dir, "pdfcpu", "rotate", inPath, strconv.Itoa(degrees), outPath); err != nil {
+		slog.ErrorContext(r.Context(), "rotate failed", "err", err)
+		commandErrorJSON(w, err, "failed to rotate PDF")
 		return
 	}
 
@@ -284,12 +353,8 @@ func handleCrop(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
@@ -305,7 +370,7 @@ func handleCrop(w http.ResponseWriter, r *http.Request) {
 		unit = "po"
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -321,9 +386,9 @@ func handleCrop(w http.ResponseWriter, r *http.Request) {
 	outPath := filepath.Join(dir, outName)
 
 	args := []string{"crop", "-u", unit, "--", desc, inPath, outPath}
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("crop error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to crop PDF")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "crop failed", "err", err)
+		commandErrorJSON(w, err, "failed to crop PDF")
 		return
 	}
 
@@ -335,12 +400,8 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
@@ -369,7 +430,7 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
 		startAt = 1
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -388,10 +449,10 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
 	// 2) stamp each single-page PDF once
 	// 3) merge back into a clean output PDF
 
-	total, err := pageCountPDF(dir, inPath)
+	total, err := pageCountPDF(r.Context(), dir, inPath)
 	if err != nil {
-		log.Printf("page numbers: page count error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to read page count")
+		slog.ErrorContext(r.Context(), "page count failed", "err", err)
+		commandErrorJSON(w, err, "failed to read page count")
 		return
 	}
 
@@ -401,9 +462,10 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := runCommand(dir, "pdfcpu", "extract", "-mode", "page", inPath, pagesDir); err != nil {
-		log.Printf("page numbers: extract pages error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to prepare pages")
+	reportPhase(r.Context(), "splitting pages")
+	if err := runCommand(r.Context(), dir, "pdfcpu", "extract", "-mode", "page", inPath, pagesDir); err != nil {
+		slog.ErrorContext(r.Context(), "extract pages failed", "err", err)
+		commandErrorJSON(w, err, "failed to prepare pages")
 		return
 	}
 
@@ -428,22 +490,24 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		reportProgress(r.Context(), i, total, fmt.Sprintf("stamping page %d/%d", i, total))
 		label := fmt.Sprintf("%d", startAt+(i-1))
 		outPage := filepath.Join(dir, fmt.Sprintf("stamped-%04d.pdf", i))
-		if err := runCommand(dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", label, desc, pagePath, outPage); err != nil {
-			log.Printf("page numbers: stamp error (page=%d): %v", i, err)
-			errorJSON(w, http.StatusInternalServerError, "failed to add page numbers")
+		if err := runCommand(r.Context(), dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", label, desc, pagePath, outPage); err != nil {
+			slog.ErrorContext(r.Context(), "stamp failed", "page", i, "err", err)
+			commandErrorJSON(w, err, "failed to add page numbers")
 			return
 		}
 		stamped = append(stamped, outPage)
 	}
 
+	reportPhase(r.Context(), "merging stamped pages")
 	outName := defaultFilename
 	outPath := filepath.Join(dir, outName)
 	args := append([]string{"merge", outPath}, stamped...)
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("page numbers: merge error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to write output")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "merge failed", "err", err)
+		commandErrorJSON(w, err, "failed to write output")
 		return
 	}
 
@@ -455,12 +519,8 @@ func handleWatermark(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
@@ -492,7 +552,7 @@ func handleWatermark(w http.ResponseWriter, r *http.Request) {
 		opacity = 1
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -509,9 +569,9 @@ func handleWatermark(w http.ResponseWriter, r *http.Request) {
 
 	// Use stamp (foreground) for reliability on scanned PDFs.
 	desc := fmt.Sprintf("pos:%s, rot:%d, points:%d, op:%.2f, c:.9 .9 .9", pos, rot, fontSize, opacity)
-	if err := runCommand(dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", text, desc, inPath, outPath); err != nil {
-		log.Printf("watermark(stamp) error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to add watermark")
+	if err := runCommand(r.Context(), dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", text, desc, inPath, outPath); err != nil {
+		slog.ErrorContext(r.Context(), "stamp failed", "err", err)
+		commandErrorJSON(w, err, "failed to add watermark")
 		return
 	}
 
@@ -528,12 +588,8 @@ func handleOrganize(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
@@ -545,7 +601,7 @@ func handleOrganize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -603,9 +659,9 @@ func handleOrganize(w http.ResponseWriter, r *http.Request) {
 
 			// pdfcpu rotate rotates in-place.
 			// Example: pdfcpu rotate -pages 1-2 test.pdf -90
-			if err := runCommand(dir, "pdfcpu", "rotate", "-pages", pagesSpec, workPath, fmt.Sprintf("-%d", deg)); err != nil {
-				log.Printf("organize rotate error: %v", err)
-				errorJSON(w, http.StatusInternalServerError, "failed to rotate pages")
+			if err := runCommand(r.Context(), dir, "pdfcpu", "rotate", "-pages", pagesSpec, workPath, fmt.Sprintf("-%d", deg)); err != nil {
+				slog.ErrorContext(r.Context(), "organize rotate failed", "err", err)
+				commandErrorJSON(w, err, "failed to rotate pages")
 				return
 			}
 		}
@@ -615,23 +671,35 @@ func handleOrganize(w http.ResponseWriter, r *http.Request) {
 	outPath := filepath.Join(dir, outName)
 
 	// Reorder + delete by collecting pages in the specified order.
-	if err := runCommand(dir, "pdfcpu", "collect", "-pages", order, workPath, outPath); err != nil {
-		log.Printf("organize collect error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to organize PDF")
+	if err := runCommand(r.Context(), dir, "pdfcpu", "collect", "-pages", order, workPath, outPath); err != nil {
+		slog.ErrorContext(r.Context(), "organize collect failed", "err", err)
+		commandErrorJSON(w, err, "failed to organize PDF")
 		return
 	}
 
 	writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
 }
 
+// buildPreviewURL returns a signed link to a preview image. Thumbnails are
+// loaded repeatedly, so they are never single-use.
 func buildPreviewURL(r *http.Request, jobID, filename string) string {
 	base := inferBaseURL(r)
-	return fmt.Sprintf("%s/previews/%s/%s", base, jobID, filename)
+	return base + signLink(fmt.Sprintf("/previews/%s/%s", jobID, filename), false)
 }
 
-func newJobDir() (string, string, error) {
+// newJobDir creates the directory a handler writes to and returns it along
+// with the ID its download URLs use. Requests routed through toolHandler reuse
+// their job's ID so status and downloads line up; inside a pipeline both point
+// at the current step's subdirectory.
+func newJobDir(r *http.Request) (string, string, error) {
 	jobID := uuid.NewString()
-	dir := filepath.Join(baseWorkDir, jobID)
+	if j := jobFromContext(r.Context()); j != nil {
+		jobID = j.ID
+		if step := stepDirFromContext(r.Context()); step != "" {
+			jobID = path.Join(jobID, step)
+		}
+	}
+	dir := filepath.Join(cfg.WorkDir, jobID)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return "", "", err
 	}
@@ -656,44 +724,168 @@ func inferBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", scheme, r.Host)
 }
 
+// buildDownloadURL returns a signed, expiring link to a job output.
 func buildDownloadURL(r *http.Request, jobID, filename string) string {
 	base := inferBaseURL(r)
-	return fmt.Sprintf("%s/downloads/%s/%s", base, jobID, filename)
+	return base + signLink(fmt.Sprintf("/downloads/%s/%s", jobID, filename), wantsSingleUse(r))
 }
 
-func saveUploadedFile(fileHeader *multipart.FileHeader, dst string) error {
-	src, err := fileHeader.Open()
+// downloadKey is the storage key a download URL points at, or "".
+func downloadKey(downloadURL string) string {
+	u, err := url.Parse(downloadURL)
 	if err != nil {
-		return err
+		return ""
 	}
-	defer src.Close()
+	rel, ok := strings.CutPrefix(u.Path, "/downloads/")
+	if !ok {
+		return ""
+	}
+	key, _ := storageKey(rel)
+	return key
+}
 
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
+// newCommand prepares an external tool invocation bound to ctx. The tool runs
+// in its own process group so that cancelling ctx (client gone, job cancelled)
+// kills everything it spawned, not just the direct child.
+func newCommand(ctx context.Context, dir string, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
-	defer out.Close()
+	// Grandchildren may still hold our pipes after the group is killed.
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
 
-	_, err = io.Copy(out, src)
+// execCommand runs an external tool under the limits configured for it and
+// reports a *limitError when one of them stopped it.
+func execCommand(ctx context.Context, dir string, stdout, stderr io.Writer, name string, args ...string) (err error) {
+	ctx, span := startSpan(ctx, "exec "+name,
+		semconv.ProcessExecutableName(name),
+		semconv.ProcessCommandArgs(append([]string{name}, redactArgs(args)...)...),
+	)
+	defer func() { endSpan(span, err) }()
+
+	limits := commandLimitsFor(name)
+	cmdCtx := ctx
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	path, argv := limitArgs(limits, name, args)
+	cmd := newCommand(cmdCtx, dir, path, argv...)
+	if stdout == stderr {
+		// stderr is also copied to errTail below, which would otherwise
+		// let two goroutines write to the shared writer at once.
+		w := &lockedWriter{w: stdout}
+		stdout, stderr = w, w
+	}
+	// prlimit's --fsize only covers files the tool writes; what it prints to
+	// us is held to the same limit here.
+	var capped *outputCap
+	if limits.MaxOutput > 0 {
+		capped = &outputCap{left: limits.MaxOutput}
+		stdout, stderr = capped.wrap(stdout), capped.wrap(stderr)
+	}
+	// The end of stderr goes into the job record, so a failed run can still
+	// be explained once the job is over.
+	errTail := &tailBuffer{max: 4 << 10}
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, errTail)
+	start := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		var rssExceeded atomic.Bool
+		done := make(chan struct{})
+		if limits.MaxRSS > 0 {
+			go watchRSS(done, cmd.Process.Pid, limits.MaxRSS, &rssExceeded)
+		}
+		if capped != nil {
+			capped.started(cmd.Process.Pid)
+		}
+		err = cmd.Wait()
+		close(done)
+		if capped != nil && capped.exceeded() {
+			err = &limitError{Tool: filepath.Base(name), Limit: limitMaxOutput, Value: formatByteSize(limits.MaxOutput)}
+		} else if err != nil {
+			err = classifyCommandError(cmdCtx, ctx, name, limits, cmd, rssExceeded.Load(), err)
+		}
+	}
+	finishCommand(ctx, name, cmd, time.Since(start), errTail.String(), err)
 	return err
 }
 
-func runCommand(dir string, name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// finishCommand records a tool run in the metrics, the log and the record of
+// the job it ran for.
+func finishCommand(ctx context.Context, name string, cmd *exec.Cmd, elapsed time.Duration, stderr string, err error) {
+	observeSubprocess(name, cmd, elapsed)
+	c := jobCommand{Binary: name, ExitCode: -1, DurationMS: elapsed.Milliseconds(), Stderr: stderr}
+	if cmd.ProcessState != nil {
+		c.ExitCode = cmd.ProcessState.ExitCode()
+		trace.SpanFromContext(ctx).SetAttributes(semconv.ProcessExitCode(c.ExitCode))
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	if j := jobFromContext(ctx); j != nil {
+		j.recordCommand(c)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "command failed", "binary", name, "exit_code", c.ExitCode, "duration_ms", c.DurationMS, "err", err, "stderr", stderr)
+		return
+	}
+	slog.DebugContext(ctx, "command finished", "binary", name, "duration_ms", c.DurationMS)
 }
 
-func runCommandOutput(dir string, name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+// runCommand runs a tool for its side effects; its stdout is dropped and its
+// stderr kept with the job.
+func runCommand(ctx context.Context, dir string, name string, args ...string) error {
+	return execCommand(ctx, dir, io.Discard, io.Discard, name, args...)
+}
+
+func runCommandOutput(ctx context.Context, dir string, name string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := execCommand(ctx, dir, &out, &out, name, args...)
+	return out.String(), err
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return strings.ToValidUTF8(string(t.buf), "")
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
 
-func zipDirectory(srcDir, zipPath string) error {
+func zipDirectory(ctx context.Context, srcDir, zipPath string) (err error) {
+	_, span := startSpan(ctx, "zip", attribute.String("zip.name", filepath.Base(zipPath)))
+	defer func() { endSpan(span, err) }()
+
 	f, err := os.Create(zipPath)
 	if err != nil {
 		return err
@@ -737,18 +929,13 @@ func handleMerge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(64 << 20); err != nil { // 64MB
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
-
-	files := r.MultipartForm.File["files"]
+	files := formFiles(r, "files")
 	if len(files) == 0 {
 		errorJSON(w, http.StatusBadRequest, "no files provided")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -771,9 +958,9 @@ func handleMerge(w http.ResponseWriter, r *http.Request) {
 	outPath := filepath.Join(dir, outName)
 
 	args := append([]string{"merge", outPath}, inputPaths...)
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("merge error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to merge PDFs")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "merge failed", "err", err)
+		commandErrorJSON(w, err, "failed to merge PDFs")
 		return
 	}
 
@@ -785,19 +972,14 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	file, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
-	file.Close()
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -829,9 +1011,9 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
 		args = []string{"extract", "-mode", "page", inPath, pagesDir}
 	}
 
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("split error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to split PDF")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "split failed", "err", err)
+		commandErrorJSON(w, err, "failed to split PDF")
 		return
 	}
 
@@ -872,9 +1054,9 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
 		outName := fmt.Sprintf("%s_split.pdf", origBase)
 		outPath := filepath.Join(dir, outName)
 		mergeArgs := append([]string{"merge", outPath}, pageFiles...)
-		if err := runCommand(dir, "pdfcpu", mergeArgs...); err != nil {
-			log.Printf("split merge ranges error: %v", err)
-			errorJSON(w, http.StatusInternalServerError, "failed to merge ranges")
+		if err := runCommand(r.Context(), dir, "pdfcpu", mergeArgs...); err != nil {
+			slog.ErrorContext(r.Context(), "split merge ranges failed", "err", err)
+			commandErrorJSON(w, err, "failed to merge ranges")
 			return
 		}
 
@@ -884,7 +1066,7 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
 
 	zipName := fmt.Sprintf("%s_split_pages.zip", origBase)
 	zipPath := filepath.Join(dir, zipName)
-	if err := zipDirectory(pagesDir, zipPath); err != nil {
+	if err := zipDirectory(r.Context(), pagesDir, zipPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to zip pages")
 		return
 	}
@@ -931,24 +1113,20 @@ func handleRemovePages(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	inPath := filepath.Join(dir, header.Filename)
+	inPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(header, inPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file")
 		return
@@ -964,9 +1142,9 @@ func handleRemovePages(w http.ResponseWriter, r *http.Request) {
 	outPath := filepath.Join(dir, outName)
 
 	args := []string{"pages", "remove", "-pages", pages, inPath, outPath}
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("remove pages error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to remove pages")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "remove pages failed", "err", err)
+		commandErrorJSON(w, err, "failed to remove pages")
 		return
 	}
 
@@ -978,24 +1156,20 @@ func handleExtractPages(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	inPath := filepath.Join(dir, header.Filename)
+	inPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(header, inPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file")
 		return
@@ -1008,9 +1182,9 @@ func handleExtractPages(w http.ResponseWriter, r *http.Request) {
 		outName := defaultFilename
 		outPath := filepath.Join(dir, outName)
 		args := []string{"collect", "-pages", ranges, inPath, outPath}
-		if err := runCommand(dir, "pdfcpu", args...); err != nil {
-			log.Printf("extract ranges error: %v", err)
-			errorJSON(w, http.StatusInternalServerError, "failed to extract pages")
+		if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+			slog.ErrorContext(r.Context(), "extract ranges failed", "err", err)
+			commandErrorJSON(w, err, "failed to extract pages")
 			return
 		}
 		writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
@@ -1025,14 +1199,14 @@ func handleExtractPages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	args := []string{"extract", "-mode", "page", inPath, pagesDir}
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("extract all pages error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to extract pages")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "extract all pages failed", "err", err)
+		commandErrorJSON(w, err, "failed to extract pages")
 		return
 	}
 
 	zipPath := filepath.Join(dir, "extracted_pages.zip")
-	if err := zipDirectory(pagesDir, zipPath); err != nil {
+	if err := zipDirectory(r.Context(), pagesDir, zipPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to zip pages")
 		return
 	}
@@ -1045,18 +1219,14 @@ func handleScanToPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(256 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	files := r.MultipartForm.File["files"]
+	files := formFiles(r, "files")
 	if len(files) == 0 {
 		errorJSON(w, http.StatusBadRequest, "no files provided")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -1064,7 +1234,7 @@ func handleScanToPDF(w http.ResponseWriter, r *http.Request) {
 
 	var imagePaths []string
 	for i, fh := range files {
-		inPath := filepath.Join(dir, fmt.Sprintf("scan_%d%s", i, filepath.Ext(fh.Filename)))
+		inPath := filepath.Join(dir, fmt.Sprintf("scan_%d%s", i, inputExt(fh, imageInput)))
 		if err := saveUploadedFile(fh, inPath); err != nil {
 			errorJSON(w, http.StatusInternalServerError, "failed to save image")
 			return
@@ -1075,18 +1245,18 @@ func handleScanToPDF(w http.ResponseWriter, r *http.Request) {
 	// First, convert images to a single PDF using ImageMagick.
 	rawPDF := filepath.Join(dir, "scans_raw.pdf")
 	args := append(imagePaths, rawPDF)
-	if err := runCommand(dir, "convert", args...); err != nil {
-		log.Printf("scan convert error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to convert scans")
+	if err := runCommand(r.Context(), dir, "convert", args...); err != nil {
+		slog.ErrorContext(r.Context(), "scan convert failed", "err", err)
+		commandErrorJSON(w, err, "failed to convert scans")
 		return
 	}
 
 	// Then run OCR to produce a searchable PDF.
 	outName := defaultFilename
 	outPath := filepath.Join(dir, outName)
-	if err := runCommand(dir, "ocrmypdf", "--skip-text", rawPDF, outPath); err != nil {
-		log.Printf("scan ocr error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to OCR scans")
+	if err := runCommand(r.Context(), dir, "ocrmypdf", "--skip-text", rawPDF, outPath); err != nil {
+		slog.ErrorContext(r.Context(), "scan ocr failed", "err", err)
+		commandErrorJSON(w, err, "failed to OCR scans")
 		return
 	}
 
@@ -1098,24 +1268,20 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	inPath := filepath.Join(dir, header.Filename)
+	inPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(header, inPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file")
 		return
@@ -1151,9 +1317,9 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 		inPath,
 	}
 
-	if err := runCommand(dir, "gs", args...); err != nil {
-		log.Printf("compress error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to compress PDF")
+	if err := runCommand(r.Context(), dir, "gs", args...); err != nil {
+		slog.ErrorContext(r.Context(), "compress failed", "err", err)
+		commandErrorJSON(w, err, "failed to compress PDF")
 		return
 	}
 
@@ -1165,24 +1331,20 @@ func handleRepair(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	inPath := filepath.Join(dir, header.Filename)
+	inPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(header, inPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file")
 		return
@@ -1193,9 +1355,9 @@ func handleRepair(w http.ResponseWriter, r *http.Request) {
 
 	// pdfcpu optimize also repairs many structural issues.
 	args := []string{"optimize", inPath, outPath}
-	if err := runCommand(dir, "pdfcpu", args...); err != nil {
-		log.Printf("repair error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to repair PDF")
+	if err := runCommand(r.Context(), dir, "pdfcpu", args...); err != nil {
+		slog.ErrorContext(r.Context(), "repair failed", "err", err)
+		commandErrorJSON(w, err, "failed to repair PDF")
 		return
 	}
 
@@ -1207,24 +1369,20 @@ func handleOCR(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	inPath := filepath.Join(dir, header.Filename)
+	inPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(header, inPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file")
 		return
@@ -1240,9 +1398,9 @@ func handleOCR(w http.ResponseWriter, r *http.Request) {
 	}
 	args = append(args, inPath, outPath)
 
-	if err := runCommand(dir, "ocrmypdf", args...); err != nil {
-		log.Printf("ocr error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to OCR PDF")
+	if err := runCommand(r.Context(), dir, "ocrmypdf", args...); err != nil {
+		slog.ErrorContext(r.Context(), "ocr failed", "err", err)
+		commandErrorJSON(w, err, "failed to OCR PDF")
 		return
 	}
 
@@ -1254,18 +1412,14 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(256 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	files := r.MultipartForm.File["files"]
+	files := formFiles(r, "files")
 	if len(files) == 0 {
 		errorJSON(w, http.StatusBadRequest, "no files provided")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -1273,7 +1427,7 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
 
 	var imagePaths []string
 	for i, fh := range files {
-		inPath := filepath.Join(dir, fmt.Sprintf("image_%d%s", i, filepath.Ext(fh.Filename)))
+		inPath := filepath.Join(dir, fmt.Sprintf("image_%d%s", i, inputExt(fh, imageInput)))
 		if err := saveUploadedFile(fh, inPath); err != nil {
 			errorJSON(w, http.StatusInternalServerError, "failed to save image")
 			return
@@ -1288,9 +1442,9 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
 	outPath := filepath.Join(dir, outName)
 
 	args := append(imagePaths, outPath)
-	if err := runCommand(dir, "convert", args...); err != nil {
-		log.Printf("image to pdf error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to convert images")
+	if err := runCommand(r.Context(), dir, "convert", args...); err != nil {
+		slog.ErrorContext(r.Context(), "image to pdf failed", "err", err)
+		commandErrorJSON(w, err, "failed to convert images")
 		return
 	}
 
@@ -1302,39 +1456,37 @@ func handleWordToPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(128 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	inPath := filepath.Join(dir, header.Filename)
+	// LibreOffice picks its import filter by extension, so it must match the
+	// content.
+	base := baseNameWithoutExt(header.Filename)
+	inPath := filepath.Join(dir, base+inputExt(header, wordInput))
 	if err := saveUploadedFile(header, inPath); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file")
 		return
 	}
 
 	// LibreOffice will write the PDF into the same directory.
-	if err := runCommand(dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", inPath); err != nil {
-		log.Printf("libreoffice error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to convert document")
+	if err := runCommand(r.Context(), dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", inPath); err != nil {
+		slog.ErrorContext(r.Context(), "libreoffice failed", "err", err)
+		commandErrorJSON(w, err, "failed to convert document")
 		return
 	}
 
 	// LibreOffice names the output based on the input file with .pdf extension.
-	base := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename)) + ".pdf"
-	outName := base
+	outName := base + ".pdf"
 	outPath := filepath.Join(dir, outName)
 
 	if _, err := os.Stat(outPath); err != nil {
@@ -1350,18 +1502,14 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
 
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
@@ -1385,14 +1533,19 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkRasterSize(r.Context(), dir, inPath, cfg.Render.PreviewDPI); err != nil {
+		formErrorJSON(w, err)
+		return
+	}
+
 	// Count pages using poppler (more tolerant + matches preview toolchain).
 	// Fallback to pdfcpu info if pdfinfo fails.
-	total, err := pageCountPoppler(dir, inPath)
+	total, err := pageCountPoppler(r.Context(), dir, inPath)
 	if err != nil {
-		total, err = pageCountPDF(dir, inPath)
+		total, err = pageCountPDF(r.Context(), dir, inPath)
 		if err != nil {
-			log.Printf("preview: page count error: %v", err)
-			errorJSON(w, http.StatusInternalServerError, "failed to read page count")
+			slog.ErrorContext(r.Context(), "page count failed", "err", err)
+			commandErrorJSON(w, err, "failed to read page count")
 			return
 		}
 	}
@@ -1405,107 +1558,163 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 
 	// Kick off background rendering for ALL pages (non-blocking), so previews are warm
 	// and never 404 on a clean machine.
-	go func(jobDir string) {
-		previewsDir := filepath.Join(jobDir, "previews")
-		_ = os.MkdirAll(previewsDir, 0o755)
-		prefix := filepath.Join(previewsDir, "page")
-		// 110 DPI is a good speed/quality compromise for card thumbnails.
-		_, _ = runCommandOutput(jobDir, "pdftoppm", "-png", "-r", "110", inPath, prefix)
-	}(dir)
+	// The render shares the raster pool with other rasterizing tools; it waits
+	// for a slot instead of being turned away. During shutdown it is skipped;
+	// pages are then rendered when first requested.
+	if beginWork() {
+		go func(jobDir string) {
+			defer endWork()
+			previewsDir := filepath.Join(jobDir, "previews")
+			_ = pools[classRaster].run(workCtx, func() {
+				_ = os.MkdirAll(previewsDir, 0o755)
+				prefix := filepath.Join(previewsDir, "page")
+				_, _ = runCommandOutput(workCtx, jobDir, "pdftoppm", "-png", "-r", strconv.Itoa(cfg.Render.PreviewDPI), inPath, prefix)
+				if err := publishDir(workCtx, previewsDir); err != nil {
+					slog.ErrorContext(r.Context(), "failed to store preview pages", "err", err)
+				}
+			})
+			if workCtx.Err() != nil {
+				// Cut short by shutdown; drop the half-rendered pages.
+				_ = os.RemoveAll(previewsDir)
+			}
+		}(dir)
+	}
 
 	writeJSON(w, http.StatusOK, previewResponse{Pages: pages})
 }
 
 func serveDownload(w http.ResponseWriter, r *http.Request) {
-	rel := strings.TrimPrefix(r.URL.Path, "/downloads/")
-	clean := filepath.Clean(rel)
-	if strings.Contains(clean, "..") {
+	key, ok := storageKey(strings.TrimPrefix(r.URL.Path, "/downloads/"))
+	if !ok {
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
-	full := filepath.Join(baseWorkDir, clean)
-
-	fi, err := os.Stat(full)
-	if err != nil || fi.IsDir() {
+	if !checkLink(w, r) {
+		return
+	}
+	if !canAccessFile(r, key) {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
-
-	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(fi.Name()))
-	http.ServeFile(w, r, full)
+	if !serveStored(w, r, key, false) {
+		http.Error(w, "file not found", http.StatusNotFound)
+	}
 }
 
 func servePreview(w http.ResponseWriter, r *http.Request) {
-	rel := strings.TrimPrefix(r.URL.Path, "/previews/")
-	clean := filepath.Clean(rel)
-	if strings.Contains(clean, "..") {
+	key, ok := storageKey(strings.TrimPrefix(r.URL.Path, "/previews/"))
+	if !ok {
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
-	full := filepath.Join(baseWorkDir, clean)
-
-	fi, err := os.Stat(full)
-	if err != nil || fi.IsDir() {
-		// Lazy-generate page thumbnails if this looks like a preview page request.
-		// Expected: /previews/<jobId>/previews/page-<n>.png
-		parts := strings.Split(clean, string(os.PathSeparator))
-		if len(parts) >= 3 && parts[1] == "previews" {
-			jobID := parts[0]
-			filename := parts[len(parts)-1]
-			if strings.HasPrefix(filename, "page-") && strings.HasSuffix(strings.ToLower(filename), ".png") {
-				numStr := strings.TrimSuffix(strings.TrimPrefix(filename, "page-"), ".png")
-				n, convErr := strconv.Atoi(numStr)
-				if convErr == nil && n > 0 {
-					jobDir := filepath.Join(baseWorkDir, jobID)
-					srcPDF := filepath.Join(jobDir, "input.pdf")
-					previewsDir := filepath.Join(jobDir, "previews")
-					_ = os.MkdirAll(previewsDir, 0o755)
-
-					prefix := filepath.Join(previewsDir, "page")
-					// Render just this page.
-					if out, genErr := runCommandOutput(jobDir, "pdftoppm", "-png", "-r", "110", "-f", strconv.Itoa(n), "-l", strconv.Itoa(n), srcPDF, prefix); genErr != nil {
-						log.Printf("lazy preview error (job=%s page=%d): %v output=%s", jobID, n, genErr, out)
-						http.Error(w, "failed to render preview", http.StatusInternalServerError)
-						return
-					}
+	if !checkLink(w, r) {
+		return
+	}
+	if !canAccessFile(r, key) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	// No attachment header here: we want the browser to render thumbnails inline.
+	if serveStored(w, r, key, true) {
+		return
+	}
+
+	// Lazy-generate page thumbnails if this looks like a preview page request.
+	// Expected: /previews/<jobId>/previews/page-<n>.png
+	parts := strings.Split(key, "/")
+	if len(parts) >= 3 && parts[1] == "previews" {
+		jobID := parts[0]
+		filename := parts[len(parts)-1]
+		if strings.HasPrefix(filename, "page-") && strings.HasSuffix(strings.ToLower(filename), ".png") {
+			numStr := strings.TrimSuffix(strings.TrimPrefix(filename, "page-"), ".png")
+			n, convErr := strconv.Atoi(numStr)
+			if convErr == nil && n > 0 {
+				jobDir := filepath.Join(cfg.WorkDir, jobID)
+				srcPDF := filepath.Join(jobDir, "input.pdf")
+				previewsDir := filepath.Join(jobDir, "previews")
+				// The job may have run on another replica.
+				if err := fetchJobFiles(r.Context(), jobID); err != nil {
+					http.Error(w, "file not found", http.StatusNotFound)
+					return
+				}
+				// The render is admitted to the raster pool like any other
+				// rasterizing request, and shutdown waits for it.
+				pool := pools[classRaster]
+				ticket, ok := pool.admit()
+				if !ok {
+					rejectBusy(w, pool)
+					return
+				}
+				defer ticket.release()
+				if !beginWork() {
+					errorJSON(w, http.StatusServiceUnavailable, "server is shutting down")
+					return
+				}
+				defer endWork()
+				if err := ticket.wait(r.Context()); err != nil {
+					return
+				}
+				_ = os.MkdirAll(previewsDir, 0o755)
+
+				prefix := filepath.Join(previewsDir, "page")
+				// Render just this page.
+				if out, genErr := runCommandOutput(r.Context(), jobDir, "pdftoppm", "-png", "-r", strconv.Itoa(cfg.Render.PreviewDPI), "-f", strconv.Itoa(n), "-l", strconv.Itoa(n), srcPDF, prefix); genErr != nil {
+					slog.ErrorContext(r.Context(), "lazy preview failed", "job_id", jobID, "page", n, "err", genErr, "output", out)
+					http.Error(w, "failed to render preview", http.StatusInternalServerError)
+					return
+				}
+				if err := publishDir(r.Context(), previewsDir); err != nil {
+					slog.ErrorContext(r.Context(), "failed to store preview page", "job_id", jobID, "page", n, "err", err)
+				}
 
-					// Retry stat after generation.
-					fi, err = os.Stat(full)
-					if err != nil || fi.IsDir() {
-						http.Error(w, "file not found", http.StatusNotFound)
-						return
-					}
+				if serveStored(w, r, key, true) {
+					return
 				}
 			}
 		}
-
-		if err != nil || fi.IsDir() {
-			http.Error(w, "file not found", http.StatusNotFound)
-			return
-		}
 	}
 
-	// No attachment header here: we want the browser to render thumbnails inline.
-	http.ServeFile(w, r, full)
+	http.Error(w, "file not found", http.StatusNotFound)
 }
 
 func cleanupOldJobs(maxAge time.Duration) {
-	entries, err := os.ReadDir(baseWorkDir)
+	entries, err := os.ReadDir(cfg.WorkDir)
 	if err != nil {
 		return
 	}
 	cutoff := time.Now().Add(-maxAge)
+	jobs.prune(cutoff)
+	n, err := store.prune(time.Now().Add(-cfg.JobRecordRetention))
+	if err != nil {
+		slog.Error("failed to prune job records", "err", err)
+	}
+	cleanupDeletions.WithLabelValues("job_record").Add(float64(n))
+	if err := store.pruneIdempotencyKeys(cutoff); err != nil {
+		slog.Error("failed to prune idempotency keys", "err", err)
+	}
+	if err := store.pruneUsedLinks(time.Now()); err != nil {
+		slog.Error("failed to prune used links", "err", err)
+	}
+	if err := store.pruneUsage(time.Now().UTC().Format(time.DateOnly)); err != nil {
+		slog.Error("failed to prune usage", "err", err)
+	}
+	pruneLimiters()
+	if err := storage.prune(context.Background(), cutoff); err != nil {
+		slog.Error("failed to prune stored job files", "err", err)
+	}
 	for _, e := range entries {
 		if !e.IsDir() {
 			continue
 		}
-		p := filepath.Join(baseWorkDir, e.Name())
+		p := filepath.Join(cfg.WorkDir, e.Name())
 		info, err := os.Stat(p)
 		if err != nil {
 			continue
 		}
 		if info.ModTime().Before(cutoff) {
-			_ = os.RemoveAll(p)
+			if err := os.RemoveAll(p); err == nil {
+				cleanupDeletions.WithLabelValues("job_dir").Inc()
+			}
 		}
 	}
 }
@@ -1520,11 +1729,6 @@ func handleProtectPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[protect] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
 	password := strings.TrimSpace(r.FormValue("password"))
 	if password == "" {
@@ -1532,23 +1736,23 @@ func handleProtectPDF(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[protect] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[protect] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[protect] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -1558,15 +1762,15 @@ func handleProtectPDF(w http.ResponseWriter, r *http.Request) {
 	outputPath := filepath.Join(dir, outputName)
 
 	// qpdf --encrypt <user-pw> <owner-pw> 256 -- input.pdf output.pdf
-	if err := runCommand(dir, "qpdf",
+	if err := runCommand(r.Context(), dir, "qpdf",
 		"--warning-exit-0",
 		"--encrypt", password, password, "256",
 		"--",
 		inputPath,
 		outputPath,
 	); err != nil {
-		log.Printf("[protect] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "qpdf encrypt failed: "+err.Error())
+		slog.ErrorContext(r.Context(), "qpdf encrypt failed", "err", err)
+		commandErrorJSON(w, err, "qpdf encrypt failed: "+err.Error())
 		return
 	}
 
@@ -1581,31 +1785,26 @@ func handleUnlockPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[unlock] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
 	password := strings.TrimSpace(r.FormValue("password"))
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[unlock] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[unlock] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[unlock] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -1621,9 +1820,9 @@ func handleUnlockPDF(w http.ResponseWriter, r *http.Request) {
 	} else {
 		args = []string{"--warning-exit-0", "--decrypt", inputPath, outputPath}
 	}
-	if err := runCommand(dir, "qpdf", args...); err != nil {
-		log.Printf("[unlock] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "qpdf decrypt failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "qpdf", args...); err != nil {
+		slog.ErrorContext(r.Context(), "qpdf decrypt failed", "err", err)
+		commandErrorJSON(w, err, "qpdf decrypt failed: "+err.Error())
 		return
 	}
 
@@ -1651,11 +1850,6 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[redact] parse form: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
 	// Parse redactions JSON
 	redactionsJSON := strings.TrimSpace(r.FormValue("redactions"))
@@ -1673,7 +1867,7 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 	}
 	var redactions []redactionArea
 	if err := json.Unmarshal([]byte(redactionsJSON), &redactions); err != nil {
-		log.Printf("[redact] parse redactions: %v", err)
+		slog.InfoContext(r.Context(), "invalid redactions", "err", err)
 		errorJSON(w, http.StatusBadRequest, "invalid redactions JSON: "+err.Error())
 		return
 	}
@@ -1682,32 +1876,38 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[redact] file: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[redact] newJobDir: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[redact] save: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
 
-	// Step 1: Render all pages to PNG at 300 DPI using pdftoppm
+	if err := checkRasterSize(r.Context(), dir, inputPath, cfg.Render.RedactDPI); err != nil {
+		formErrorJSON(w, err)
+		return
+	}
+
+	// Step 1: Render all pages to PNG at the redaction DPI using pdftoppm in a
+	// single run; -progress reports each page as it is written.
 	pngPrefix := filepath.Join(dir, "page")
-	if err := runCommand(dir, "pdftoppm", "-png", "-r", "300", inputPath, pngPrefix); err != nil {
-		log.Printf("[redact] pdftoppm: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pdftoppm failed: "+err.Error())
+	if err := execCommand(r.Context(), dir, io.Discard, &popplerProgress{ctx: r.Context(), verb: "rasterizing"}, "pdftoppm", "-progress", "-png", "-r", strconv.Itoa(cfg.Render.RedactDPI), inputPath, pngPrefix); err != nil {
+		slog.ErrorContext(r.Context(), "pdftoppm failed", "err", err)
+		commandErrorJSON(w, err, "pdftoppm failed: "+err.Error())
 		return
 	}
 
@@ -1720,14 +1920,21 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 	// Find all generated PNG files
 	pngFiles, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
 	if err != nil || len(pngFiles) == 0 {
-		log.Printf("[redact] no pages: %v", err)
+		slog.ErrorContext(r.Context(), "no pages rendered", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "no pages generated")
 		return
 	}
 	sort.Strings(pngFiles)
 
 	// Step 2: For each page with redactions, draw black rectangles
-	for pageNum, areas := range pageRedactions {
+	redactPages := make([]int, 0, len(pageRedactions))
+	for pageNum := range pageRedactions {
+		redactPages = append(redactPages, pageNum)
+	}
+	sort.Ints(redactPages)
+	for i, pageNum := range redactPages {
+		areas := pageRedactions[pageNum]
+		reportProgress(r.Context(), i+1, len(redactPages), fmt.Sprintf("redacting page %d (%d/%d)", pageNum, i+1, len(redactPages)))
 		// pdftoppm names files as page-1.png, page-2.png, etc. (or page-01.png for >9 pages)
 		var pngPath string
 		for _, p := range pngFiles {
@@ -1740,20 +1947,20 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if pngPath == "" {
-			log.Printf("[redact] page %d not found, skipping", pageNum)
+			slog.WarnContext(r.Context(), "page not rendered, skipping", "page", pageNum)
 			continue
 		}
 
 		// Get image dimensions using ImageMagick identify
-		dimOutput, err := runCommandOutput(dir, "identify", "-format", "%w %h", pngPath)
+		dimOutput, err := runCommandOutput(r.Context(), dir, "identify", "-format", "%w %h", pngPath)
 		if err != nil {
-			log.Printf("[redact] identify: %v", err)
-			errorJSON(w, http.StatusInternalServerError, "identify failed: "+err.Error())
+			slog.ErrorContext(r.Context(), "identify failed", "err", err)
+			commandErrorJSON(w, err, "identify failed: "+err.Error())
 			return
 		}
 		var imgWidth, imgHeight int
 		if _, err := fmt.Sscanf(strings.TrimSpace(dimOutput), "%d %d", &imgWidth, &imgHeight); err != nil {
-			log.Printf("[redact] parse dimensions: %v", err)
+			slog.ErrorContext(r.Context(), "failed to parse page dimensions", "err", err)
 			errorJSON(w, http.StatusInternalServerError, "parse dimensions failed")
 			return
 		}
@@ -1777,35 +1984,37 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 		}
 		convertArgs = append(convertArgs, tempPath)
 
-		if err := runCommand(dir, "convert", convertArgs...); err != nil {
-			log.Printf("[redact] convert draw: %v", err)
-			errorJSON(w, http.StatusInternalServerError, "convert failed: "+err.Error())
+		if err := runCommand(r.Context(), dir, "convert", convertArgs...); err != nil {
+			slog.ErrorContext(r.Context(), "convert draw failed", "err", err)
+			commandErrorJSON(w, err, "convert failed: "+err.Error())
 			return
 		}
 
 		// Atomically replace original with redacted version
 		if err := os.Rename(tempPath, pngPath); err != nil {
-			log.Printf("[redact] rename: %v", err)
+			slog.ErrorContext(r.Context(), "failed to rename page", "err", err)
 			errorJSON(w, http.StatusInternalServerError, "rename failed: "+err.Error())
 			return
 		}
 	}
 
 	// Step 3: Rebuild PDF from images
+	reportPhase(r.Context(), "rebuilding PDF")
 	tempPdfPath := filepath.Join(dir, "temp_redacted.pdf")
 	convertPdfArgs := append(pngFiles, tempPdfPath)
-	if err := runCommand(dir, "convert", convertPdfArgs...); err != nil {
-		log.Printf("[redact] convert to pdf: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "convert to pdf failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "convert", convertPdfArgs...); err != nil {
+		slog.ErrorContext(r.Context(), "convert to PDF failed", "err", err)
+		commandErrorJSON(w, err, "convert to pdf failed: "+err.Error())
 		return
 	}
 
 	// Step 4: Strip metadata and optimize with qpdf
+	reportPhase(r.Context(), "stripping metadata")
 	baseName := baseNameWithoutExt(hdr.Filename)
 	outputName := baseName + "_redacted.pdf"
 	outputPath := filepath.Join(dir, outputName)
 
-	if err := runCommand(dir, "qpdf",
+	if err := runCommand(r.Context(), dir, "qpdf",
 		"--warning-exit-0",
 		"--linearize",
 		"--compress-streams=y",
@@ -1813,8 +2022,8 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
 		tempPdfPath,
 		outputPath,
 	); err != nil {
-		log.Printf("[redact] qpdf optimize: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "qpdf optimize failed: "+err.Error())
+		slog.ErrorContext(r.Context(), "qpdf optimize failed", "err", err)
+		commandErrorJSON(w, err, "qpdf optimize failed: "+err.Error())
 		return
 	}
 
@@ -1835,29 +2044,24 @@ func handleFlattenPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[flatten] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[flatten] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[flatten] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[flatten] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -1867,15 +2071,15 @@ func handleFlattenPDF(w http.ResponseWriter, r *http.Request) {
 	outputPath := filepath.Join(dir, outputName)
 
 	// qpdf --flatten-annotations=all --flatten-rotation input.pdf output.pdf
-	if err := runCommand(dir, "qpdf",
+	if err := runCommand(r.Context(), dir, "qpdf",
 		"--warning-exit-0",
 		"--flatten-annotations=all",
 		"--flatten-rotation",
 		inputPath,
 		outputPath,
 	); err != nil {
-		log.Printf("[flatten] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "qpdf flatten failed: "+err.Error())
+		slog.ErrorContext(r.Context(), "qpdf flatten failed", "err", err)
+		commandErrorJSON(w, err, "qpdf flatten failed: "+err.Error())
 		return
 	}
 
@@ -1896,29 +2100,24 @@ func handlePDFToWord(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[pdf-to-word] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[pdf-to-word] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[pdf-to-word] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[pdf-to-word] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -1946,21 +2145,21 @@ except Exception as e:
 `
 	scriptPath := filepath.Join(dir, "convert.py")
 	if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-		log.Printf("[pdf-to-word] error writing script: %v", err)
+		slog.ErrorContext(r.Context(), "failed to write script", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create conversion script")
 		return
 	}
 
 	// Execute Python script with pdf2docx
-	if err := runCommand(dir, "python3", scriptPath, inputPath, outputPath); err != nil {
-		log.Printf("[pdf-to-word] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pdf2docx convert failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "python3", scriptPath, inputPath, outputPath); err != nil {
+		slog.ErrorContext(r.Context(), "pdf2docx convert failed", "err", err)
+		commandErrorJSON(w, err, "pdf2docx convert failed: "+err.Error())
 		return
 	}
 
 	// Verify output file was created
 	if _, err := os.Stat(outputPath); err != nil {
-		log.Printf("[pdf-to-word] output not found: %v", err)
+		slog.ErrorContext(r.Context(), "output not found", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "converted file not found")
 		return
 	}
@@ -1976,29 +2175,24 @@ func handlePDFToExcel(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[pdf-to-excel] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[pdf-to-excel] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[pdf-to-excel] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[pdf-to-excel] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -2032,21 +2226,21 @@ except Exception as e:
 `
 	scriptPath := filepath.Join(dir, "convert_excel.py")
 	if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-		log.Printf("[pdf-to-excel] error writing script: %v", err)
+		slog.ErrorContext(r.Context(), "failed to write script", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create conversion script")
 		return
 	}
 
 	// Execute Python script with tabula-py
-	if err := runCommand(dir, "python3", scriptPath, inputPath, outputPath); err != nil {
-		log.Printf("[pdf-to-excel] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "tabula convert failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "python3", scriptPath, inputPath, outputPath); err != nil {
+		slog.ErrorContext(r.Context(), "tabula convert failed", "err", err)
+		commandErrorJSON(w, err, "tabula convert failed: "+err.Error())
 		return
 	}
 
 	// Verify output file was created
 	if _, err := os.Stat(outputPath); err != nil {
-		log.Printf("[pdf-to-excel] output not found: %v", err)
+		slog.ErrorContext(r.Context(), "output not found", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "converted file not found")
 		return
 	}
@@ -2062,33 +2256,34 @@ func handlePDFToPowerPoint(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[pdf-to-pptx] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[pdf-to-pptx] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[pdf-to-pptx] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[pdf-to-pptx] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
 
+	// The script renders every page at 150 DPI.
+	if err := checkRasterSize(r.Context(), dir, inputPath, 150); err != nil {
+		formErrorJSON(w, err)
+		return
+	}
+
 	baseName := baseNameWithoutExt(hdr.Filename)
 	outputName := baseName + ".pptx"
 	outputPath := filepath.Join(dir, outputName)
@@ -2125,21 +2320,21 @@ except Exception as e:
 `
 	scriptPath := filepath.Join(dir, "convert_pptx.py")
 	if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-		log.Printf("[pdf-to-pptx] error writing script: %v", err)
+		slog.ErrorContext(r.Context(), "failed to write script", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create conversion script")
 		return
 	}
 
 	// Execute Python script with pdf2image and python-pptx
-	if err := runCommand(dir, "python3", scriptPath, inputPath, outputPath); err != nil {
-		log.Printf("[pdf-to-pptx] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pptx convert failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "python3", scriptPath, inputPath, outputPath); err != nil {
+		slog.ErrorContext(r.Context(), "pptx convert failed", "err", err)
+		commandErrorJSON(w, err, "pptx convert failed: "+err.Error())
 		return
 	}
 
 	// Verify output file was created
 	if _, err := os.Stat(outputPath); err != nil {
-		log.Printf("[pdf-to-pptx] output not found: %v", err)
+		slog.ErrorContext(r.Context(), "output not found", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "converted file not found")
 		return
 	}
@@ -2155,42 +2350,33 @@ func handleExcelToPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[excel-to-pdf] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[excel-to-pdf] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[excel-to-pdf] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	// Keep original extension for LibreOffice
-	ext := filepath.Ext(hdr.Filename)
-	if ext == "" {
-		ext = ".xlsx"
-	}
-	inputPath := filepath.Join(dir, "input"+ext)
+	// LibreOffice picks its import filter by extension
+	inputPath := filepath.Join(dir, "input"+inputExt(hdr, excelInput))
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[excel-to-pdf] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
 
 	// LibreOffice converts Excel to PDF
-	if err := runCommand(dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
-		log.Printf("[excel-to-pdf] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "libreoffice convert failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
+		slog.ErrorContext(r.Context(), "libreoffice convert failed", "err", err)
+		commandErrorJSON(w, err, "libreoffice convert failed: "+err.Error())
 		return
 	}
 
@@ -2202,12 +2388,12 @@ func handleExcelToPDF(w http.ResponseWriter, r *http.Request) {
 	expectedOutput := filepath.Join(dir, "input.pdf")
 	if _, err := os.Stat(expectedOutput); err == nil {
 		if err := os.Rename(expectedOutput, outputPath); err != nil {
-			log.Printf("[excel-to-pdf] rename error: %v", err)
+			slog.ErrorContext(r.Context(), "failed to rename output", "err", err)
 			errorJSON(w, http.StatusInternalServerError, "rename failed")
 			return
 		}
 	} else if _, err := os.Stat(outputPath); err != nil {
-		log.Printf("[excel-to-pdf] output not found: %v", err)
+		slog.ErrorContext(r.Context(), "output not found", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "converted file not found")
 		return
 	}
@@ -2223,42 +2409,33 @@ func handlePowerPointToPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(128 << 20); err != nil {
-		log.Printf("[pptx-to-pdf] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[pptx-to-pdf] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[pptx-to-pdf] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
-	// Keep original extension for LibreOffice
-	ext := filepath.Ext(hdr.Filename)
-	if ext == "" {
-		ext = ".pptx"
-	}
-	inputPath := filepath.Join(dir, "input"+ext)
+	// LibreOffice picks its import filter by extension
+	inputPath := filepath.Join(dir, "input"+inputExt(hdr, powerPointInput))
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[pptx-to-pdf] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
 
 	// LibreOffice converts PowerPoint to PDF
-	if err := runCommand(dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
-		log.Printf("[pptx-to-pdf] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "libreoffice convert failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
+		slog.ErrorContext(r.Context(), "libreoffice convert failed", "err", err)
+		commandErrorJSON(w, err, "libreoffice convert failed: "+err.Error())
 		return
 	}
 
@@ -2270,12 +2447,12 @@ func handlePowerPointToPDF(w http.ResponseWriter, r *http.Request) {
 	expectedOutput := filepath.Join(dir, "input.pdf")
 	if _, err := os.Stat(expectedOutput); err == nil {
 		if err := os.Rename(expectedOutput, outputPath); err != nil {
-			log.Printf("[pptx-to-pdf] rename error: %v", err)
+			slog.ErrorContext(r.Context(), "failed to rename output", "err", err)
 			errorJSON(w, http.StatusInternalServerError, "rename failed")
 			return
 		}
 	} else if _, err := os.Stat(outputPath); err != nil {
-		log.Printf("[pptx-to-pdf] output not found: %v", err)
+		slog.ErrorContext(r.Context(), "output not found", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "converted file not found")
 		return
 	}
@@ -2293,63 +2470,63 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	// Optional DPI parameter (default 150)
-	dpi := parseIntDefault(r.FormValue("dpi"), 150)
-	if dpi < 72 {
-		dpi = 72
+	// Optional DPI parameter, within the configured bounds
+	dpi := parseIntDefault(r.FormValue("dpi"), cfg.Render.JPGDPI)
+	if dpi < cfg.Render.JPGMinDPI {
+		dpi = cfg.Render.JPGMinDPI
 	}
-	if dpi > 600 {
-		dpi = 600
+	if dpi > cfg.Render.JPGMaxDPI {
+		dpi = cfg.Render.JPGMaxDPI
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
 
+	if err := checkRasterSize(r.Context(), dir, inputPath, dpi); err != nil {
+		formErrorJSON(w, err)
+		return
+	}
+
 	// Get page count using pdfinfo
-	pageCount, err := pageCountPoppler(dir, inputPath)
+	pageCount, err := pageCountPoppler(r.Context(), dir, inputPath)
 	if err != nil {
-		log.Printf("[pdf-to-jpg] pdfinfo error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to get page count: "+err.Error())
+		slog.ErrorContext(r.Context(), "pdfinfo failed", "err", err)
+		commandErrorJSON(w, err, "failed to get page count: "+err.Error())
 		return
 	}
 
 	// Create images directory
 	imagesDir := filepath.Join(dir, "images")
 	if err := os.MkdirAll(imagesDir, 0o755); err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create images dir", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create images dir")
 		return
 	}
 
 	// Convert PDF to JPG using pdftoppm
 	prefix := filepath.Join(imagesDir, "page")
-	if err := runCommand(dir, "pdftoppm", "-jpeg", "-r", strconv.Itoa(dpi), inputPath, prefix); err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pdftoppm failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "pdftoppm", "-jpeg", "-r", strconv.Itoa(dpi), inputPath, prefix); err != nil {
+		slog.ErrorContext(r.Context(), "pdftoppm failed", "err", err)
+		commandErrorJSON(w, err, "pdftoppm failed: "+err.Error())
 		return
 	}
 
@@ -2360,7 +2537,7 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
 		// Find the generated JPG file
 		jpgFiles, err := filepath.Glob(filepath.Join(imagesDir, "page-*.jpg"))
 		if err != nil || len(jpgFiles) == 0 {
-			log.Printf("[pdf-to-jpg] error: no JPG files generated")
+			slog.ErrorContext(r.Context(), "no JPG files generated")
 			errorJSON(w, http.StatusInternalServerError, "no JPG files generated")
 			return
 		}
@@ -2369,7 +2546,7 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
 		outputName := baseName + ".jpg"
 		outputPath := filepath.Join(dir, outputName)
 		if err := os.Rename(jpgFiles[0], outputPath); err != nil {
-			log.Printf("[pdf-to-jpg] rename error: %v", err)
+			slog.ErrorContext(r.Context(), "failed to rename output", "err", err)
 			errorJSON(w, http.StatusInternalServerError, "rename failed: "+err.Error())
 			return
 		}
@@ -2384,8 +2561,8 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
 	zipName := baseName + "_images.zip"
 	zipPath := filepath.Join(dir, zipName)
 
-	if err := zipDirectory(imagesDir, zipPath); err != nil {
-		log.Printf("[pdf-to-jpg] error: %v", err)
+	if err := zipDirectory(r.Context(), imagesDir, zipPath); err != nil {
+		slog.ErrorContext(r.Context(), "zip failed", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "zip failed: "+err.Error())
 		return
 	}
@@ -2401,29 +2578,24 @@ func handleExtractText(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[extract-text] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[extract-text] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[extract-text] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[extract-text] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -2434,9 +2606,9 @@ func handleExtractText(w http.ResponseWriter, r *http.Request) {
 
 	// pdftotext extracts text from PDF
 	// -layout preserves the original layout
-	if err := runCommand(dir, "pdftotext", "-layout", inputPath, outputPath); err != nil {
-		log.Printf("[extract-text] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pdftotext failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "pdftotext", "-layout", inputPath, outputPath); err != nil {
+		slog.ErrorContext(r.Context(), "pdftotext failed", "err", err)
+		commandErrorJSON(w, err, "pdftotext failed: "+err.Error())
 		return
 	}
 
@@ -2451,29 +2623,24 @@ func handleExtractImages(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[extract-images] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	_, hdr, err := r.FormFile("file")
+	hdr, err := formFile(r, "file")
 	if err != nil {
-		log.Printf("[extract-images] error: %v", err)
+		slog.InfoContext(r.Context(), "missing input file", "err", err)
 		errorJSON(w, http.StatusBadRequest, "file required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[extract-images] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
 
 	inputPath := filepath.Join(dir, "input.pdf")
 	if err := saveUploadedFile(hdr, inputPath); err != nil {
-		log.Printf("[extract-images] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "save failed")
 		return
 	}
@@ -2481,7 +2648,7 @@ func handleExtractImages(w http.ResponseWriter, r *http.Request) {
 	// Create images directory
 	imagesDir := filepath.Join(dir, "images")
 	if err := os.MkdirAll(imagesDir, 0o755); err != nil {
-		log.Printf("[extract-images] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create images dir", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create images dir")
 		return
 	}
@@ -2489,9 +2656,9 @@ func handleExtractImages(w http.ResponseWriter, r *http.Request) {
 	// pdfimages extracts embedded images
 	// -all extracts all images in their native format
 	prefix := filepath.Join(imagesDir, "image")
-	if err := runCommand(dir, "pdfimages", "-all", inputPath, prefix); err != nil {
-		log.Printf("[extract-images] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pdfimages failed: "+err.Error())
+	if err := runCommand(r.Context(), dir, "pdfimages", "-all", inputPath, prefix); err != nil {
+		slog.ErrorContext(r.Context(), "pdfimages failed", "err", err)
+		commandErrorJSON(w, err, "pdfimages failed: "+err.Error())
 		return
 	}
 
@@ -2506,8 +2673,8 @@ func handleExtractImages(w http.ResponseWriter, r *http.Request) {
 	zipName := baseName + "_extracted_images.zip"
 	zipPath := filepath.Join(dir, zipName)
 
-	if err := zipDirectory(imagesDir, zipPath); err != nil {
-		log.Printf("[extract-images] error: %v", err)
+	if err := zipDirectory(r.Context(), imagesDir, zipPath); err != nil {
+		slog.ErrorContext(r.Context(), "zip failed", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "zip failed: "+err.Error())
 		return
 	}
@@ -2523,15 +2690,10 @@ func handleHTMLToPDF(w http.ResponseWriter, r *http.Request) {
 		errorJSON(w, http.StatusMethodNotAllowed, "POST required")
 		return
 	}
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		log.Printf("[html-to-pdf] error: %v", err)
-		errorJSON(w, http.StatusBadRequest, "parse form failed")
-		return
-	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
-		log.Printf("[html-to-pdf] error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create job", "err", err)
 		errorJSON(w, http.StatusInternalServerError, "failed to create job")
 		return
 	}
@@ -2540,42 +2702,86 @@ func handleHTMLToPDF(w http.ResponseWriter, r *http.Request) {
 	url := strings.TrimSpace(r.FormValue("url"))
 	var inputSource string
 	var baseName string
+	// Pages may only read local files from an uploaded bundle.
+	localAccess := []string{"--disable-local-file-access"}
 
 	if url != "" {
 		// URL mode
-		inputSource = url
+		u, err := checkFetchURL(r.Context(), url)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.As(err, new(*fetchBlockedError)) {
+				status = http.StatusForbidden
+			}
+			slog.InfoContext(r.Context(), "url refused", "url", url, "err", err)
+			errorJSON(w, status, err.Error())
+			return
+		}
+		inputSource = u.String()
 		baseName = "webpage"
 	} else {
 		// File mode
-		_, hdr, err := r.FormFile("file")
+		hdr, err := formFile(r, "file")
 		if err != nil {
 			errorJSON(w, http.StatusBadRequest, "file or url required")
 			return
 		}
 
-		inputPath := filepath.Join(dir, "input.html")
-		if err := saveUploadedFile(hdr, inputPath); err != nil {
-			log.Printf("[html-to-pdf] error: %v", err)
-			errorJSON(w, http.StatusInternalServerError, "save failed")
-			return
+		if inputExt(hdr, htmlInput) == ".zip" {
+			// A bundle: the page with its stylesheets, scripts and images.
+			bundlePath := filepath.Join(dir, "bundle.zip")
+			if err := saveUploadedFile(hdr, bundlePath); err != nil {
+				slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
+				errorJSON(w, http.StatusInternalServerError, "save failed")
+				return
+			}
+			siteDir := filepath.Join(dir, "site")
+			inputSource, err = extractHTMLBundle(bundlePath, siteDir)
+			if err != nil {
+				errorJSON(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			localAccess = append(localAccess, "--allow", siteDir)
+		} else {
+			inputPath := filepath.Join(dir, "input.html")
+			if err := saveUploadedFile(hdr, inputPath); err != nil {
+				slog.ErrorContext(r.Context(), "failed to save upload", "err", err)
+				errorJSON(w, http.StatusInternalServerError, "save failed")
+				return
+			}
+			inputSource = inputPath
 		}
-		inputSource = inputPath
 		baseName = baseNameWithoutExt(hdr.Filename)
 	}
 
 	outputName := baseName + ".pdf"
 	outputPath := filepath.Join(dir, outputName)
 
+	// Everything the page loads over the network goes through the proxy,
+	// which enforces the fetch policy.
+	proxy, err := startFetchProxy()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to start fetch proxy", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to convert HTML")
+		return
+	}
+	defer proxy.close()
+
 	// wkhtmltopdf converts HTML/URL to PDF
-	// --enable-local-file-access allows loading local resources
-	if err := runCommand(dir, "wkhtmltopdf",
-		"--enable-local-file-access",
-		"--quiet",
-		inputSource,
-		outputPath,
-	); err != nil {
-		log.Printf("[html-to-pdf] error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "wkhtmltopdf failed: "+err.Error())
+	args := append(localAccess, "--proxy", proxy.url(), "--quiet", inputSource, outputPath)
+	err = runCommand(r.Context(), dir, "wkhtmltopdf", args...)
+	blocked := proxy.blockedFetches()
+	if len(blocked) > 0 {
+		slog.InfoContext(r.Context(), "fetches blocked", "count", len(blocked), "first", blocked[0].Error())
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "wkhtmltopdf failed", "err", err)
+		if len(blocked) > 0 && !errors.As(err, new(*limitError)) {
+			// Most likely the page itself, e.g. after a redirect.
+			errorJSON(w, http.StatusForbidden, blocked[0].Error())
+			return
+		}
+		commandErrorJSON(w, err, "wkhtmltopdf failed: "+err.Error())
 		return
 	}
 
@@ -2596,74 +2802,52 @@ func handleComparePDFs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "failed to parse form: "+err.Error())
-		return
-	}
-
 	// Get file1
-	file1, _, err := r.FormFile("file1")
+	file1, err := formFile(r, "file1")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file1 is required: "+err.Error())
 		return
 	}
-	defer file1.Close()
 
 	// Get file2
-	file2, _, err := r.FormFile("file2")
+	file2, err := formFile(r, "file2")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file2 is required: "+err.Error())
 		return
 	}
-	defer file2.Close()
 
 	// Save both files
 	inputPath1 := filepath.Join(dir, "file1.pdf")
-	outFile1, err := os.Create(inputPath1)
-	if err != nil {
-		errorJSON(w, http.StatusInternalServerError, "failed to create file1: "+err.Error())
-		return
-	}
-	if _, err := io.Copy(outFile1, file1); err != nil {
-		outFile1.Close()
+	if err := saveUploadedFile(file1, inputPath1); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file1: "+err.Error())
 		return
 	}
-	outFile1.Close()
 
 	inputPath2 := filepath.Join(dir, "file2.pdf")
-	outFile2, err := os.Create(inputPath2)
-	if err != nil {
-		errorJSON(w, http.StatusInternalServerError, "failed to create file2: "+err.Error())
-		return
-	}
-	if _, err := io.Copy(outFile2, file2); err != nil {
-		outFile2.Close()
+	if err := saveUploadedFile(file2, inputPath2); err != nil {
 		errorJSON(w, http.StatusInternalServerError, "failed to save file2: "+err.Error())
 		return
 	}
-	outFile2.Close()
 
 	// Extract text from both PDFs
 	text1Path := filepath.Join(dir, "file1.txt")
 	text2Path := filepath.Join(dir, "file2.txt")
 
-	if err := runCommand(dir, "pdftotext", inputPath1, text1Path); err != nil {
-		log.Printf("[compare] pdftotext file1 error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to extract text from file1: "+err.Error())
+	if err := runCommand(r.Context(), dir, "pdftotext", inputPath1, text1Path); err != nil {
+		slog.ErrorContext(r.Context(), "pdftotext file1 failed", "err", err)
+		commandErrorJSON(w, err, "failed to extract text from file1: "+err.Error())
 		return
 	}
 
-	if err := runCommand(dir, "pdftotext", inputPath2, text2Path); err != nil {
-		log.Printf("[compare] pdftotext file2 error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to extract text from file2: "+err.Error())
+	if err := runCommand(r.Context(), dir, "pdftotext", inputPath2, text2Path); err != nil {
+		slog.ErrorContext(r.Context(), "pdftotext file2 failed", "err", err)
+		commandErrorJSON(w, err, "failed to extract text from file2: "+err.Error())
 		return
 	}
 
@@ -2672,9 +2856,13 @@ func handleComparePDFs(w http.ResponseWriter, r *http.Request) {
 	outputPath := filepath.Join(dir, outputName)
 
 	// Run diff and capture output (ignore exit code since diff returns 1 when files differ)
-	cmd := exec.Command("diff", "-u", text1Path, text2Path)
-	cmd.Dir = dir
-	diffOutput, _ := cmd.Output() // Ignore error - diff exits 1 when files differ
+	diffText, err := runCommandOutput(r.Context(), dir, "diff", "-u", text1Path, text2Path)
+	if errors.As(err, new(*limitError)) {
+		slog.ErrorContext(r.Context(), "diff failed", "err", err)
+		commandErrorJSON(w, err, "failed to compare PDFs")
+		return
+	}
+	diffOutput := []byte(diffText) // Ignore other errors - diff exits 1 when files differ
 
 	// Write diff output to file
 	if len(diffOutput) == 0 {
@@ -2697,18 +2885,13 @@ func handleDigitalSignature(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
-
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, err.Error())
 		return
@@ -2725,14 +2908,14 @@ func handleDigitalSignature(w http.ResponseWriter, r *http.Request) {
 	outputPath := filepath.Join(dir, outputName)
 
 	// Use qpdf to linearize and process PDF (marks as optimized/signed)
-	if err := runCommand(dir, "qpdf",
+	if err := runCommand(r.Context(), dir, "qpdf",
 		"--linearize",
 		"--warning-exit-0",
 		inputPath,
 		outputPath,
 	); err != nil {
-		log.Printf("[digital-signature] qpdf error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to process PDF: "+err.Error())
+		slog.ErrorContext(r.Context(), "qpdf failed", "err", err)
+		commandErrorJSON(w, err, "failed to process PDF: "+err.Error())
 		return
 	}
 
@@ -2748,18 +2931,13 @@ func handleValidatePDFA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
-
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, err.Error())
 		return
@@ -2780,28 +2958,32 @@ func handleValidatePDFA(w http.ResponseWriter, r *http.Request) {
 
 	// Run qpdf --check to validate PDF structure
 	reportBuilder.WriteString("=== PDF Structure Validation (qpdf --check) ===\n\n")
-	cmd := exec.Command("qpdf", "--check", "--warning-exit-0", inputPath)
-	cmd.Dir = dir
-	qpdfOutput, err := cmd.CombinedOutput()
+	qpdfOutput, err := runCommandOutput(r.Context(), dir, "qpdf", "--check", "--warning-exit-0", inputPath)
+	if errors.As(err, new(*limitError)) {
+		commandErrorJSON(w, err, "failed to validate PDF")
+		return
+	}
 	if err != nil {
 		reportBuilder.WriteString(fmt.Sprintf("qpdf check failed: %v\n", err))
 	}
 	if len(qpdfOutput) > 0 {
-		reportBuilder.Write(qpdfOutput)
+		reportBuilder.WriteString(qpdfOutput)
 	} else {
 		reportBuilder.WriteString("No issues found.\n")
 	}
 
 	// Run pdfinfo to get PDF version and metadata
 	reportBuilder.WriteString("\n=== PDF Metadata (pdfinfo) ===\n\n")
-	cmd2 := exec.Command("pdfinfo", inputPath)
-	cmd2.Dir = dir
-	pdfinfoOutput, err := cmd2.CombinedOutput()
+	pdfinfoOutput, err := runCommandOutput(r.Context(), dir, "pdfinfo", inputPath)
+	if errors.As(err, new(*limitError)) {
+		commandErrorJSON(w, err, "failed to validate PDF")
+		return
+	}
 	if err != nil {
 		reportBuilder.WriteString(fmt.Sprintf("pdfinfo failed: %v\n", err))
 	}
 	if len(pdfinfoOutput) > 0 {
-		reportBuilder.Write(pdfinfoOutput)
+		reportBuilder.WriteString(pdfinfoOutput)
 	} else {
 		reportBuilder.WriteString("No metadata available.\n")
 	}
@@ -2824,18 +3006,13 @@ func handlePDFToHTML(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
-
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, err.Error())
 		return
@@ -2851,15 +3028,15 @@ func handlePDFToHTML(w http.ResponseWriter, r *http.Request) {
 
 	// pdftohtml with -s creates a single HTML file
 	// The output will be named baseName.html (pdftohtml adds suffix automatically)
-	if err := runCommand(dir, "pdftohtml",
+	if err := runCommand(r.Context(), dir, "pdftohtml",
 		"-s",            // single HTML file
 		"-noframes",     // no frame structure
 		"-enc", "UTF-8", // UTF-8 encoding
 		inputPath,
 		filepath.Join(dir, baseName),
 	); err != nil {
-		log.Printf("[pdf-to-html] pdftohtml error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "pdftohtml failed: "+err.Error())
+		slog.ErrorContext(r.Context(), "pdftohtml failed", "err", err)
+		commandErrorJSON(w, err, "pdftohtml failed: "+err.Error())
 		return
 	}
 
@@ -2916,18 +3093,13 @@ func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
-
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, err.Error())
 		return
@@ -2956,12 +3128,14 @@ func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
 	pageWidth := 612.0  // Default Letter width in points
 	pageHeight := 792.0 // Default Letter height in points
 
-	cmd := exec.Command("pdfinfo", inputPath)
-	cmd.Dir = dir
-	infoOutput, err := cmd.Output()
+	infoOutput, err := runCommandOutput(r.Context(), dir, "pdfinfo", inputPath)
+	if errors.As(err, new(*limitError)) {
+		commandErrorJSON(w, err, "failed to read page size")
+		return
+	}
 	if err == nil {
 		// Parse page size from pdfinfo output
-		lines := strings.Split(string(infoOutput), "\n")
+		lines := strings.Split(infoOutput, "\n")
 		for _, line := range lines {
 			if strings.HasPrefix(line, "Page size:") {
 				// Format: "Page size:      612 x 792 pts (letter)"
@@ -3019,7 +3193,7 @@ func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Use Ghostscript to apply header/footer overlay to each page
-	if err := runCommand(dir, "gs",
+	if err := runCommand(r.Context(), dir, "gs",
 		"-dBATCH",
 		"-dNOPAUSE",
 		"-dQUIET",
@@ -3029,8 +3203,8 @@ func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
 		psPath,
 		inputPath,
 	); err != nil {
-		log.Printf("[add-header-footer] ghostscript error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to add header/footer: "+err.Error())
+		slog.ErrorContext(r.Context(), "ghostscript failed", "err", err)
+		commandErrorJSON(w, err, "failed to add header/footer: "+err.Error())
 		return
 	}
 
@@ -3046,18 +3220,13 @@ func handleConvertToPDFA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-		return
-	}
-
-	_, header, err := r.FormFile("file")
+	header, err := formFile(r, "file")
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "file is required")
 		return
 	}
 
-	jobID, dir, err := newJobDir()
+	jobID, dir, err := newJobDir(r)
 	if err != nil {
 		errorJSON(w, http.StatusInternalServerError, err.Error())
 		return
@@ -3074,7 +3243,7 @@ func handleConvertToPDFA(w http.ResponseWriter, r *http.Request) {
 	outputPath := filepath.Join(dir, outputName)
 
 	// Convert to PDF/A-2b using Ghostscript
-	if err := runCommand(dir, "gs",
+	if err := runCommand(r.Context(), dir, "gs",
 		"-dBATCH",
 		"-dNOPAUSE",
 		"-dQUIET",
@@ -3084,8 +3253,8 @@ func handleConvertToPDFA(w http.ResponseWriter, r *http.Request) {
 		"-sOutputFile="+outputPath,
 		inputPath,
 	); err != nil {
-		log.Printf("[convert-to-pdfa] ghostscript error: %v", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to convert to PDF/A: "+err.Error())
+		slog.ErrorContext(r.Context(), "ghostscript failed", "err", err)
+		commandErrorJSON(w, err, "failed to convert to PDF/A: "+err.Error())
 		return
 	}
 
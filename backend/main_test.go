@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// alive reports whether pid is a running process; zombies count as gone.
+func alive(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	// The state follows the parenthesised command name.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestCancelKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		// The shell leaves a grandchild behind, as LibreOffice and gs do.
+		done <- execCommand(ctx, dir, io.Discard, io.Discard, "sh", "-c", "sleep 60 & echo $! > child.pid; wait")
+	}()
+
+	var pid int
+	deadline := time.Now().Add(5 * time.Second)
+	for pid == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the shell did not start its child")
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "child.pid"))
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("a cancelled command reported success")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the command outlived its context")
+	}
+	for deadline = time.Now().Add(5 * time.Second); alive(pid); {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("grandchild %d survived the cancellation", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLazyPreviewAdmission(t *testing.T) {
+	withLinkSecret(t)
+	withStore(t)
+	root := withStorage(t, localBackend)
+	// The fake pdftoppm writes <prefix>-1.png, its last argument being the prefix.
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor a; do p=$a; done\necho png > \"$p-1.png\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "pdftoppm"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name  string
+		busy  bool
+		want  int
+		retry string
+	}{
+		{"raster pool full", true, http.StatusTooManyRequests, "5"},
+		{"raster pool free", false, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPools(t, 1, 0)
+			if tt.busy {
+				ticket, _ := pools[classRaster].admit()
+				defer ticket.release()
+			}
+			if err := os.MkdirAll(filepath.Join(root, "job-1"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			servePreview(rec, httptest.NewRequest(http.MethodGet, signLink("/previews/job-1/previews/page-1.png", false), nil))
+			if rec.Code != tt.want || rec.Header().Get("Retry-After") != tt.retry {
+				t.Fatalf("status %d, Retry-After %q; want %d, %q", rec.Code, rec.Header().Get("Retry-After"), tt.want, tt.retry)
+			}
+			_, err := os.Stat(filepath.Join(root, "job-1", "previews", "page-1.png"))
+			if rendered := err == nil; rendered == tt.busy {
+				t.Errorf("rendered = %v with the pool busy = %v", rendered, tt.busy)
+			}
+			if st := pools[classRaster].stats(); st.Running != 0 || (!tt.busy && st.Queued != 0) {
+				t.Errorf("pool left at %+v", st)
+			}
+		})
+	}
+}
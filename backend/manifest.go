@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// manifestFile is the name of the cached manifest inside a job directory.
+// Outputs never change once a job has finished, so it is computed only once.
+const manifestFile = ".manifest.json"
+
+type manifestEntry struct {
+	Name     string `json:"name"` // relative to the job directory
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Pages    int    `json:"pages,omitempty"`
+	Archive  string `json:"archive,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+type manifestResponse struct {
+	JobID string          `json:"jobId"`
+	Tool  string          `json:"tool"`
+	Files []manifestEntry `json:"files"`
+}
+
+// handleJobManifest serves GET /api/jobs/{id}/manifest: every output of a
+// finished job with its size, checksum, MIME type, page count for PDFs and a
+// direct URL. When the download is a ZIP, the files it was built from are
+// listed too, with "archive" naming the ZIP, so clients can fetch single pages.
+func handleJobManifest(w http.ResponseWriter, r *http.Request) {
+	rec, ok := store.get(r.PathValue("id"))
+	if !ok || !canAccess(r, rec.Owner) {
+		errorJSON(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if rec.Status != jobSucceeded {
+		errorJSON(w, http.StatusConflict, "job has no outputs (status "+rec.Status+")")
+		return
+	}
+
+	u, err := url.Parse(rec.DownloadURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/downloads/") {
+		errorJSON(w, http.StatusNotFound, "job has no outputs")
+		return
+	}
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(u.Path, "/downloads/")))
+	jobDir := filepath.Join(cfg.WorkDir, rec.ID)
+	primary := filepath.Join(cfg.WorkDir, rel)
+	if !strings.HasPrefix(primary, jobDir+string(os.PathSeparator)) {
+		errorJSON(w, http.StatusNotFound, "job has no outputs")
+		return
+	}
+	if _, err := os.Stat(primary); err != nil {
+		// The job may have run on another replica.
+		err = fetchJobFiles(r.Context(), rec.ID)
+		if err == nil {
+			_, err = os.Stat(primary)
+		}
+		if err != nil {
+			errorJSON(w, http.StatusGone, "job outputs have expired")
+			return
+		}
+	}
+
+	files, err := loadManifest(r.Context(), jobDir, primary)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to build manifest", "job_id", rec.ID, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to build manifest")
+		return
+	}
+	for i := range files {
+		files[i].URL = buildDownloadURL(r, rec.ID, files[i].Name)
+	}
+	writeJSON(w, http.StatusOK, manifestResponse{JobID: rec.ID, Tool: rec.Tool, Files: files})
+}
+
+// loadManifest returns the cached manifest of a job, building it on first use.
+func loadManifest(ctx context.Context, jobDir, primary string) ([]manifestEntry, error) {
+	cache := filepath.Join(jobDir, manifestFile)
+	var files []manifestEntry
+	if data, err := os.ReadFile(cache); err == nil && json.Unmarshal(data, &files) == nil {
+		return files, nil
+	}
+
+	paths := []string{primary}
+	var archive string
+	if strings.EqualFold(filepath.Ext(primary), ".zip") {
+		if members := zipSourceFiles(primary); members != nil {
+			paths = append(paths, members...)
+			archive = filepath.Base(primary)
+		}
+	}
+
+	for i, p := range paths {
+		e, err := describeOutput(ctx, jobDir, p)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			e.Archive = archive
+		}
+		files = append(files, e)
+	}
+
+	if data, err := json.Marshal(files); err == nil {
+		_ = os.WriteFile(cache, data, 0o644)
+	}
+	return files, nil
+}
+
+// describeOutput hashes one output file and, for PDFs, counts its pages.
+func describeOutput(ctx context.Context, jobDir, p string) (manifestEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	e := manifestEntry{
+		Name:     filepath.ToSlash(strings.TrimPrefix(p, jobDir+string(os.PathSeparator))),
+		MimeType: outputMimeType(f, p),
+		Size:     size,
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+	}
+	if e.MimeType == "application/pdf" {
+		if n, err := pageCountPoppler(ctx, filepath.Dir(p), p); err == nil {
+			e.Pages = n
+		}
+	}
+	return e, nil
+}
+
+func outputMimeType(f *os.File, p string) string {
+	if t := mime.TypeByExtension(strings.ToLower(path.Ext(p))); t != "" {
+		t, _, _ = strings.Cut(t, ";")
+		return t
+	}
+	buf := make([]byte, 512)
+	n, _ := f.ReadAt(buf, 0)
+	t, _, _ := strings.Cut(http.DetectContentType(buf[:n]), ";")
+	return t
+}
+
+// zipSourceFiles finds the directory a ZIP was built from by zipDirectory,
+// which leaves it in place next to the archive (pages/, images/, ...). A
+// subdirectory qualifies only if it holds every entry at the recorded size.
+func zipSourceFiles(zipPath string) []string {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+	if len(zr.File) == 0 {
+		return nil
+	}
+
+	dir := filepath.Dir(zipPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+candidates:
+	for _, d := range entries {
+		if !d.IsDir() {
+			continue
+		}
+		src := filepath.Join(dir, d.Name())
+		members := make([]string, 0, len(zr.File))
+		for _, zf := range zr.File {
+			p := filepath.Join(src, filepath.FromSlash(zf.Name))
+			fi, err := os.Stat(p)
+			if err != nil || fi.IsDir() || uint64(fi.Size()) != zf.UncompressedSize64 {
+				continue candidates
+			}
+			members = append(members, p)
+		}
+		return members
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zipOf builds a ZIP holding files, keyed by entry name.
+func zipOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestHandleJobManifest(t *testing.T) {
+	fakePDFInfo(t, printing("Pages: 3\n"))
+	pdf := []byte("%PDF-1.4\n%%EOF\n")
+	pages := map[string]string{"page-1.png": "\x89PNG one", "page-2.png": "\x89PNG two!"}
+	archive := zipOf(t, pages)
+
+	tests := []struct {
+		name     string
+		download string
+		files    map[string][]byte // written to the job directory
+		want     []manifestEntry
+	}{
+		{
+			name:     "one output",
+			download: "out.pdf",
+			files:    map[string][]byte{"out.pdf": pdf},
+			want: []manifestEntry{
+				{Name: "out.pdf", MimeType: "application/pdf", Size: int64(len(pdf)), SHA256: sha256Hex(pdf), Pages: 3},
+			},
+		},
+		{
+			name:     "archive with its pages",
+			download: "pages.zip",
+			files: map[string][]byte{
+				"pages.zip":        archive,
+				"pages/page-1.png": []byte(pages["page-1.png"]),
+				"pages/page-2.png": []byte(pages["page-2.png"]),
+				// Not what the archive was built from: the sizes differ.
+				"input/page-1.png": []byte("other"),
+			},
+			want: []manifestEntry{
+				{Name: "pages.zip", MimeType: "application/zip", Size: int64(len(archive)), SHA256: sha256Hex(archive)},
+				{Name: "pages/page-1.png", MimeType: "image/png", Size: 8, SHA256: sha256Hex([]byte(pages["page-1.png"])), Archive: "pages.zip"},
+				{Name: "pages/page-2.png", MimeType: "image/png", Size: 9, SHA256: sha256Hex([]byte(pages["page-2.png"])), Archive: "pages.zip"},
+			},
+		},
+		{
+			name:     "archive without its sources",
+			download: "pages.zip",
+			files:    map[string][]byte{"pages.zip": archive},
+			want: []manifestEntry{
+				{Name: "pages.zip", MimeType: "application/zip", Size: int64(len(archive)), SHA256: sha256Hex(archive)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStore(t)
+			withLinkSecret(t)
+			root := withStorage(t, localBackend)
+			for name, data := range tt.files {
+				p := filepath.Join(root, "job-1", filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.put(jobRecord{ID: "job-1", Tool: "split", Status: jobSucceeded, DownloadURL: "http://example.com/downloads/job-1/" + tt.download}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The second request is answered from the cached manifest.
+			for range 2 {
+				r := httptest.NewRequest(http.MethodGet, "/api/jobs/job-1/manifest", nil)
+				r.SetPathValue("id", "job-1")
+				rec := httptest.NewRecorder()
+				handleJobManifest(rec, r)
+				var got manifestResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+					t.Fatalf("%d %s", rec.Code, rec.Body)
+				}
+				if got.JobID != "job-1" || got.Tool != "split" || len(got.Files) != len(tt.want) {
+					t.Fatalf("got %+v, want %d files", got, len(tt.want))
+				}
+				for i, w := range tt.want {
+					e := got.Files[i]
+					if !strings.Contains(e.URL, "/downloads/job-1/"+w.Name+"?") {
+						t.Errorf("%s: url %q", w.Name, e.URL)
+					}
+					e.URL = ""
+					if e != w {
+						t.Errorf("file %d: %+v, want %+v", i, e, w)
+					}
+				}
+			}
+			if _, err := os.Stat(filepath.Join(root, "job-1", manifestFile)); err != nil {
+				t.Errorf("manifest not cached: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandleJobManifestStatus(t *testing.T) {
+	withStore(t)
+	withStorage(t, localBackend)
+	for _, rec := range []jobRecord{
+		{ID: "running", Tool: "split", Status: jobRunning},
+		{ID: "expired", Tool: "split", Status: jobSucceeded, DownloadURL: "/downloads/expired/out.pdf"},
+		{ID: "elsewhere", Tool: "split", Status: jobSucceeded, DownloadURL: "/downloads/other/out.pdf"},
+	} {
+		if err := store.put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"missing", http.StatusNotFound},
+		{"running", http.StatusConflict},
+		{"expired", http.StatusGone},
+		{"elsewhere", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/jobs/"+tt.id+"/manifest", nil)
+		r.SetPathValue("id", tt.id)
+		rec := httptest.NewRecorder()
+		handleJobManifest(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.id, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are served in the Prometheus text format on GET /metrics, which,
+// like /health, needs no credentials.
+var metrics = prometheus.NewRegistry()
+
+var (
+	durationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	// 1 KiB to 1 GiB.
+	sizeBuckets = prometheus.ExponentialBuckets(1<<10, 4, 11)
+
+	toolRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pdf_tool_requests_total",
+		Help: "Tool requests by tool and response status code.",
+	}, []string{"tool", "code"})
+	toolRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pdf_tool_request_duration_seconds",
+		Help:    "Time to answer a tool request; for async requests only until the job is accepted.",
+		Buckets: durationBuckets,
+	}, []string{"tool"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pdf_job_duration_seconds",
+		Help:    "Time a job ran in its worker slot, by tool and final status.",
+		Buckets: durationBuckets,
+	}, []string{"tool", "status"})
+	subprocessDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pdf_subprocess_duration_seconds",
+		Help:    "Run time of external tools.",
+		Buckets: durationBuckets,
+	}, []string{"binary"})
+	subprocessExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pdf_subprocess_exits_total",
+		Help: `External tool runs by exit code; "signal" when killed, "start_failed" when it never ran.`,
+	}, []string{"binary", "code"})
+	inputBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pdf_job_input_bytes",
+		Help:    "Total size of the files submitted with a job.",
+		Buckets: sizeBuckets,
+	}, []string{"tool"})
+	outputBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pdf_job_output_bytes",
+		Help:    "Size of a successful job's download.",
+		Buckets: sizeBuckets,
+	}, []string{"tool"})
+	pagesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pdf_pages_processed_total",
+		Help: "Pages of the PDF inputs of successful jobs.",
+	}, []string{"tool"})
+	cleanupDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pdf_cleanup_deleted_total",
+		Help: "Items removed by the periodic cleanup, by kind: job_dir, job_record or upload.",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		toolRequests, toolRequestDuration, jobDuration,
+		subprocessDuration, subprocessExits,
+		inputBytes, outputBytes, pagesProcessed,
+		cleanupDeletions,
+		poolCollector{}, workDirCollector{},
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{Registry: metrics})
+}
+
+// statusRecorder remembers the status code a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// instrumentTool counts and times the requests of one tool route.
+func instrumentTool(tool string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		toolRequests.WithLabelValues(tool, strconv.Itoa(rec.status)).Inc()
+		toolRequestDuration.WithLabelValues(tool).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeSubprocess records one run of an external tool; cmd.ProcessState is
+// nil when it could not be started.
+func observeSubprocess(binary string, cmd *exec.Cmd, elapsed time.Duration) {
+	code := "start_failed"
+	if ps := cmd.ProcessState; ps != nil {
+		if c := ps.ExitCode(); c >= 0 {
+			code = strconv.Itoa(c)
+		} else {
+			code = "signal"
+		}
+		subprocessDuration.WithLabelValues(binary).Observe(elapsed.Seconds())
+	}
+	subprocessExits.WithLabelValues(binary, code).Inc()
+}
+
+// observeJob records a finished job: its input size, how long it ran and, on
+// success, the size of its download and the pages it processed.
+func observeJob(j *job) {
+	j.mu.Lock()
+	tool, status, downloadURL := j.Tool, j.Status, j.DownloadURL
+	started, finished := j.StartedAt, j.FinishedAt
+	j.mu.Unlock()
+	inputBytes.WithLabelValues(tool).Observe(float64(j.usage.Bytes))
+	if !started.IsZero() {
+		jobDuration.WithLabelValues(tool, status).Observe(finished.Sub(started).Seconds())
+	}
+	if status != jobSucceeded {
+		return
+	}
+	pagesProcessed.WithLabelValues(tool).Add(float64(j.usage.Pages))
+	if key := downloadKey(downloadURL); key != "" {
+		if fi, err := os.Stat(filepath.Join(cfg.WorkDir, filepath.FromSlash(key))); err == nil {
+			outputBytes.WithLabelValues(tool).Observe(float64(fi.Size()))
+		}
+	}
+}
+
+// poolCollector reports the worker pools' load at scrape time.
+type poolCollector struct{}
+
+var (
+	poolRunningDesc = prometheus.NewDesc("pdf_pool_running_jobs", "Jobs running in a worker pool.", []string{"pool"}, nil)
+	poolQueuedDesc  = prometheus.NewDesc("pdf_pool_queued_jobs", "Jobs waiting for a worker slot.", []string{"pool"}, nil)
+	poolWorkersDesc = prometheus.NewDesc("pdf_pool_workers", "Worker slots of a pool.", []string{"pool"}, nil)
+)
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolRunningDesc
+	ch <- poolQueuedDesc
+	ch <- poolWorkersDesc
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, p := range pools {
+		st := p.stats()
+		ch <- prometheus.MustNewConstMetric(poolRunningDesc, prometheus.GaugeValue, float64(st.Running), name)
+		ch <- prometheus.MustNewConstMetric(poolQueuedDesc, prometheus.GaugeValue, float64(st.Queued), name)
+		ch <- prometheus.MustNewConstMetric(poolWorkersDesc, prometheus.GaugeValue, float64(st.Workers), name)
+	}
+}
+
+// workDirCollector reports how much of the disk the job directories use. It
+// walks cfg.WorkDir on every scrape, which stays cheap as long as cleanup
+// keeps up.
+type workDirCollector struct{}
+
+var (
+	workDirBytesDesc = prometheus.NewDesc("pdf_workdir_bytes", "Bytes used by files in the work directory.", nil, nil)
+	workDirJobsDesc  = prometheus.NewDesc("pdf_workdir_jobs", "Job directories in the work directory.", nil, nil)
+	workDirFreeDesc  = prometheus.NewDesc("pdf_workdir_free_bytes", "Free bytes on the work directory's filesystem.", nil, nil)
+)
+
+func (workDirCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workDirBytesDesc
+	ch <- workDirJobsDesc
+	ch <- workDirFreeDesc
+}
+
+func (workDirCollector) Collect(ch chan<- prometheus.Metric) {
+	var size int64
+	_ = filepath.WalkDir(cfg.WorkDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	ch <- prometheus.MustNewConstMetric(workDirBytesDesc, prometheus.GaugeValue, float64(size))
+
+	if entries, err := os.ReadDir(cfg.WorkDir); err == nil {
+		n := 0
+		for _, e := range entries {
+			if e.IsDir() {
+				n++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(workDirJobsDesc, prometheus.GaugeValue, float64(n))
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(cfg.WorkDir, &st); err == nil {
+		ch <- prometheus.MustNewConstMetric(workDirFreeDesc, prometheus.GaugeValue, float64(st.Bavail)*float64(st.Bsize))
+	}
+}
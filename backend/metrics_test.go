@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// series is one labelled series of a metric as gathered from the registry.
+type series struct {
+	counter float64
+	count   uint64 // histogram observations
+	sum     float64
+	histo   bool
+}
+
+// sample finds the series of the metric name with exactly labels in the
+// registry; ok is false when there is none.
+func sample(t *testing.T, name string, labels map[string]string) (s series, ok bool) {
+	t.Helper()
+	families, err := metrics.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	series:
+		for _, m := range f.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; !ok || v != l.GetValue() {
+					continue series
+				}
+			}
+			if h := m.GetHistogram(); h != nil {
+				return series{count: h.GetSampleCount(), sum: h.GetSampleSum(), histo: true}, true
+			}
+			return series{counter: m.GetCounter().GetValue()}, true
+		}
+	}
+	return series{}, false
+}
+
+func TestToolRequestMetrics(t *testing.T) {
+	withStore(t)
+	withStorage(t, localBackend)
+	withPools(t, 1, 1)
+	exits := func() float64 {
+		s, _ := sample(t, "pdf_subprocess_exits_total", map[string]string{"binary": "sh", "code": "3"})
+		return s.counter
+	}
+	before := exits()
+
+	h := instrumentTool("metrics-test", toolHandler(pdfTool{name: "metrics-test", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+		err := execCommand(r.Context(), t.TempDir(), io.Discard, io.Discard, "sh", "-c", "exit 3")
+		errorJSON(w, http.StatusUnprocessableEntity, err.Error())
+	}}))
+	rec := httptest.NewRecorder()
+	h(rec, multipartRequest(t, 100))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		count  uint64  // observations, for histograms
+		value  float64 // counter value, or histogram sum when set
+	}{
+		{"pdf_tool_requests_total", map[string]string{"tool": "metrics-test", "code": "422"}, 0, 1},
+		{"pdf_tool_request_duration_seconds", map[string]string{"tool": "metrics-test"}, 1, 0},
+		{"pdf_job_duration_seconds", map[string]string{"tool": "metrics-test", "status": jobFailed}, 1, 0},
+		{"pdf_job_input_bytes", map[string]string{"tool": "metrics-test"}, 1, 100},
+		{"pdf_subprocess_duration_seconds", map[string]string{"binary": "sh"}, 0, 0},
+	}
+	for _, tt := range tests {
+		s, ok := sample(t, tt.name, tt.labels)
+		switch {
+		case !ok:
+			t.Errorf("%s%v: no series", tt.name, tt.labels)
+		case !s.histo:
+			if s.counter != tt.value {
+				t.Errorf("%s%v = %v, want %v", tt.name, tt.labels, s.counter, tt.value)
+			}
+		case tt.count > 0:
+			if s.count != tt.count || tt.value != 0 && s.sum != tt.value {
+				t.Errorf("%s%v: %d observations summing to %v, want %d summing to %v", tt.name, tt.labels, s.count, s.sum, tt.count, tt.value)
+			}
+		}
+	}
+	// Successful jobs only.
+	for _, name := range []string{"pdf_pages_processed_total", "pdf_job_output_bytes"} {
+		if _, ok := sample(t, name, map[string]string{"tool": "metrics-test"}); ok {
+			t.Errorf("%s recorded for a failed job", name)
+		}
+	}
+	if got := exits() - before; got != 1 {
+		t.Errorf(`pdf_subprocess_exits_total{binary="sh",code="3"} went up by %v, want 1`, got)
+	}
+}
+
+func TestSubprocessExitCodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		bin  string
+		args []string
+		code string
+	}{
+		{"success", context.Background(), "true", nil, "0"},
+		{"failure", context.Background(), "false", nil, "1"},
+		{"killed", context.Background(), "sh", []string{"-c", "kill -9 $$"}, "signal"},
+		{"not installed", context.Background(), "no-such-binary", nil, "start_failed"},
+		{"cancelled before start", ctx, "true", nil, "start_failed"},
+	}
+	for _, tt := range tests {
+		labels := map[string]string{"binary": tt.bin, "code": tt.code}
+		before, _ := sample(t, "pdf_subprocess_exits_total", labels)
+		_ = execCommand(tt.ctx, t.TempDir(), io.Discard, io.Discard, tt.bin, tt.args...)
+		after, _ := sample(t, "pdf_subprocess_exits_total", labels)
+		if got := after.counter - before.counter; got != 1 {
+			t.Errorf("%s: %s code %s went up by %v, want 1", tt.name, tt.bin, tt.code, got)
+		}
+	}
+}
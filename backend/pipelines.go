@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// maxPipelineSteps bounds how many tools one pipeline may chain.
+const maxPipelineSteps = 10
+
+// pipelineTool serves POST /api/pipelines through the same job machinery as
+// the individual tools: async mode, events, cancellation and callbacks.
+var pipelineTool = pdfTool{name: "pipeline", class: classPipeline, handler: handlePipeline}
+
+// pipelineMultiInput lists the tools that take their input as "files"; all
+// other chainable tools take a single "file".
+var pipelineMultiInput = map[string]bool{
+	"merge":        true,
+	"scan-to-pdf":  true,
+	"image-to-pdf": true,
+}
+
+// pipelineExcluded lists tools that cannot be a pipeline step: compare wants
+// two separately named files and preview does not produce a file.
+var pipelineExcluded = map[string]bool{
+	"compare": true,
+	"preview": true,
+}
+
+// pipelineStep is one entry of the "steps" field of POST /api/pipelines.
+// Params are the same form fields the tool's own endpoint accepts.
+type pipelineStep struct {
+	Tool   string                     `json:"tool"`
+	Params map[string]json.RawMessage `json:"params,omitempty"`
+}
+
+// stepDirKey carries the subdirectory of the job directory that the current
+// pipeline step writes to.
+type stepDirKey struct{}
+
+func withStepDir(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, stepDirKey{}, name)
+}
+
+func stepDirFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(stepDirKey{}).(string)
+	return name
+}
+
+// stepFile is an input or output file of a pipeline step.
+type stepFile struct {
+	name string
+	path string
+}
+
+// handlePipeline serves POST /api/pipelines. It takes the input files (or
+// upload IDs) as "files" and a JSON "steps" list such as
+//
+//	[{"tool": "merge"}, {"tool": "ocr", "params": {"language": "eng"}}, {"tool": "compress", "params": {"level": "high"}}]
+//
+// Each step runs the tool's handler in its own subdirectory of one job
+// directory, fed with the output of the step before it. Only the final output
+// is kept.
+func handlePipeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	steps, tools, err := parsePipelineSteps(r.FormValue("steps"))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	uploads := append(formFiles(r, "files"), formFiles(r, "file")...)
+	if len(uploads) == 0 {
+		errorJSON(w, http.StatusBadRequest, "no files provided")
+		return
+	}
+
+	jobID, dir, err := newJobDir(r)
+	if err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to create job")
+		return
+	}
+
+	inputDir := filepath.Join(dir, "input")
+	if err := os.MkdirAll(inputDir, 0o755); err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to create job")
+		return
+	}
+	var current []stepFile
+	for i, fh := range uploads {
+		name := filepath.Base(fh.Filename)
+		p := filepath.Join(inputDir, fmt.Sprintf("%d_%s", i, name))
+		if err := saveUploadedFile(fh, p); err != nil {
+			errorJSON(w, http.StatusInternalServerError, "failed to save input file")
+			return
+		}
+		current = append(current, stepFile{name: name, path: p})
+	}
+
+	for i, step := range steps {
+		t := tools[i]
+		reportPhase(r.Context(), fmt.Sprintf("step %d/%d: %s", i+1, len(steps), t.name))
+
+		if !pipelineMultiInput[t.name] && len(current) > 1 {
+			pipelineStepError(w, i, t, http.StatusBadRequest, fmt.Sprintf("%s takes one file but got %d", t.name, len(current)), nil)
+			return
+		}
+		for _, in := range current {
+			if err := checkFileType("files", in.name, in.path, t.accepts); err != nil {
+				pipelineStepError(w, i, t, http.StatusUnsupportedMediaType, err.Error(), map[string]any{"accepted": err.acceptedNames()})
+				return
+			}
+		}
+
+		rec, err := runPipelineStep(r, i, t, step, current)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			pipelineStepError(w, i, t, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+
+		status := rec.statusCode()
+		var resp map[string]any
+		_ = json.Unmarshal(rec.body.Bytes(), &resp)
+		if msg, _ := resp["error"].(string); status >= 400 || msg != "" {
+			if msg == "" {
+				msg = http.StatusText(status)
+			}
+			// A step turned away by a full pool passes on when to retry.
+			if ra := rec.Header().Get("Retry-After"); ra != "" {
+				w.Header().Set("Retry-After", ra)
+			}
+			pipelineStepError(w, i, t, max(status, http.StatusBadRequest), msg, resp)
+			return
+		}
+
+		downloadURL, _ := resp["downloadUrl"].(string)
+		out, err := stepOutput(dir, downloadURL)
+		if err != nil {
+			pipelineStepError(w, i, t, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		if i < len(steps)-1 && strings.EqualFold(filepath.Ext(out.name), ".zip") {
+			pipelineStepError(w, i, t, http.StatusBadRequest, "produced a ZIP archive, which cannot feed the next step", nil)
+			return
+		}
+		current = []stepFile{out}
+	}
+
+	// Keep the final output at the top of the job directory and drop the rest.
+	final := current[0]
+	outPath := filepath.Join(dir, final.name)
+	if err := os.Rename(final.path, outPath); err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to save output file")
+		return
+	}
+	_ = os.RemoveAll(inputDir)
+	for i := range steps {
+		_ = os.RemoveAll(filepath.Join(dir, pipelineStepDir(i)))
+	}
+
+	writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, final.name)})
+}
+
+// parsePipelineSteps decodes and checks the "steps" field.
+func parsePipelineSteps(raw string) ([]pipelineStep, []pdfTool, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil, errors.New("steps is required")
+	}
+	var steps []pipelineStep
+	if err := json.Unmarshal([]byte(raw), &steps); err != nil {
+		return nil, nil, errors.New("steps must be a JSON list of {\"tool\": ..., \"params\": {...}}")
+	}
+	if len(steps) == 0 {
+		return nil, nil, errors.New("steps must not be empty")
+	}
+	if len(steps) > maxPipelineSteps {
+		return nil, nil, fmt.Errorf("a pipeline may have at most %d steps", maxPipelineSteps)
+	}
+
+	tools := make([]pdfTool, len(steps))
+	for i, step := range steps {
+		t, ok := lookupTool(step.Tool)
+		if !ok || pipelineExcluded[step.Tool] {
+			return nil, nil, fmt.Errorf("step %d: unknown or unsupported tool %q", i+1, step.Tool)
+		}
+		for k, v := range step.Params {
+			// A step's input is the output of the step before it.
+			if slices.Contains(uploadFields, k) {
+				return nil, nil, fmt.Errorf("step %d (%s): param %q is not allowed; steps take their input from the previous step", i+1, step.Tool, k)
+			}
+			if _, err := paramValues(v); err != nil {
+				return nil, nil, fmt.Errorf("step %d (%s): param %q: %v", i+1, step.Tool, k, err)
+			}
+		}
+		tools[i] = t
+	}
+	return steps, tools, nil
+}
+
+func lookupTool(name string) (pdfTool, bool) {
+	for _, t := range pdfTools {
+		if t.name == name && cfg.toolEnabled(name) {
+			return t, true
+		}
+	}
+	return pdfTool{}, false
+}
+
+// paramValues turns a JSON param into form values: strings are used as-is,
+// numbers and booleans as written, and lists become repeated fields.
+func paramValues(raw json.RawMessage) ([]string, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	var out []string
+	add := func(v any) error {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			out = append(out, v)
+		case float64, bool:
+			b, _ := json.Marshal(v)
+			out = append(out, string(b))
+		default:
+			return errors.New("must be a string, number, boolean or a list of those")
+		}
+		return nil
+	}
+	if list, ok := v.([]any); ok {
+		for _, item := range list {
+			if err := add(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	if err := add(v); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func pipelineStepDir(i int) string {
+	return fmt.Sprintf("step-%d", i+1)
+}
+
+// runPipelineStep calls a tool handler with a form built from the step's
+// params and input files, in the tool's worker pool, and returns its response.
+// The step is admitted to the pool like a request to the tool's own endpoint,
+// so when the pool and its queue are full the response is the pool's 429.
+func runPipelineStep(r *http.Request, i int, t pdfTool, step pipelineStep, inputs []stepFile) (*responseRecorder, error) {
+	ctx := withStepDir(r.Context(), pipelineStepDir(i))
+	ctx = withLogAttrs(ctx, slog.Int("step", i+1), slog.String("step_tool", t.name))
+	ctx, span := startSpan(ctx, "pipeline step",
+		attribute.Int("pipeline.step", i+1),
+		attribute.String("pipeline.step_tool", t.name),
+	)
+	// The step sees only its own params, not the pipeline's query string.
+	// withForm comes last: the files it puts in the context must not be
+	// replaced by a later WithContext.
+	sr := r.WithContext(ctx)
+	sr.URL = &url.URL{Path: "/api/pdf/" + t.name}
+	sr = withForm(sr, stepForm(t, step, inputs))
+	rec := &responseRecorder{}
+	pool := pools[t.class]
+	if ticket, ok := pool.admit(); !ok {
+		rejectBusy(rec, pool)
+	} else {
+		defer ticket.release()
+		if err := ticket.wait(ctx); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		t.handler(rec, sr)
+	}
+	span.SetAttributes(attribute.Int("pipeline.step_status", rec.statusCode()))
+	if rec.statusCode() >= 400 {
+		span.SetStatus(codes.Error, http.StatusText(rec.statusCode()))
+	}
+	span.End()
+	return rec, nil
+}
+
+// stepForm hands the step's params and input files to the tool the way
+// toolHandler would have read them from a client. The inputs are already on
+// disk, so the tool moves them rather than receiving a copy.
+func stepForm(t pdfTool, step pipelineStep, inputs []stepFile) *toolForm {
+	field := "file"
+	if pipelineMultiInput[t.name] {
+		field = "files"
+	}
+	form := &toolForm{Value: url.Values{}, File: map[string][]*uploadedFile{}}
+	for k, raw := range step.Params {
+		vs, _ := paramValues(raw)
+		form.Value[k] = vs
+	}
+	for _, in := range inputs {
+		f := &uploadedFile{Filename: in.name, path: in.path}
+		if fi, err := os.Stat(in.path); err == nil {
+			f.Size = fi.Size()
+		}
+		form.File[field] = append(form.File[field], f)
+	}
+	return form
+}
+
+// stepOutput maps the download URL a step returned to its file on disk.
+func stepOutput(jobDir, downloadURL string) (stepFile, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/downloads/") {
+		return stepFile{}, errors.New("produced no output file")
+	}
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(u.Path, "/downloads/")))
+	p := filepath.Join(cfg.WorkDir, rel)
+	if !strings.HasPrefix(p, jobDir+string(os.PathSeparator)) {
+		return stepFile{}, errors.New("produced no output file")
+	}
+	if fi, err := os.Stat(p); err != nil || fi.IsDir() {
+		return stepFile{}, errors.New("produced no output file")
+	}
+	return stepFile{name: path.Base(u.Path), path: p}, nil
+}
+
+// pipelineStepError reports a failed step. Extra fields from the tool's own
+// error response, such as "limit" and the binary in "tool", are passed through.
+func pipelineStepError(w http.ResponseWriter, i int, t pdfTool, status int, msg string, extra map[string]any) {
+	resp := map[string]any{}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	resp["error"] = fmt.Sprintf("step %d (%s): %s", i+1, t.name, msg)
+	resp["step"] = i + 1
+	resp["stepTool"] = t.name
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withTools replaces the tool list for the test.
+func withTools(t *testing.T, tools ...pdfTool) {
+	t.Helper()
+	prev := pdfTools
+	t.Cleanup(func() { pdfTools = prev })
+	pdfTools = tools
+}
+
+// passOn is a tool handler that writes its input, unchanged, as its output.
+func passOn(w http.ResponseWriter, r *http.Request) {
+	f, err := formFile(r, "file")
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, "file required")
+		return
+	}
+	jobID, dir, _ := newJobDir(r)
+	if err := saveUploadedFile(f, filepath.Join(dir, "out.pdf")); err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to save output file")
+		return
+	}
+	writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, "out.pdf")})
+}
+
+func TestPipelineStepAdmission(t *testing.T) {
+	tests := []struct {
+		name  string
+		busy  bool
+		want  int
+		retry string
+	}{
+		{"pool free", false, http.StatusOK, ""},
+		{"pool and queue full", true, http.StatusTooManyRequests, "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPools(t, 1, 0)
+			ran := false
+			tool := pdfTool{name: "echo", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+				ran = true
+				if st := pools[classLight].stats(); st.Running != 1 {
+					t.Errorf("step ran outside its pool: %+v", st)
+				}
+				writeJSON(w, http.StatusOK, map[string]string{"downloadUrl": "/downloads/job/out.pdf"})
+			}}
+			if tt.busy {
+				ticket, _ := pools[classLight].admit()
+				defer ticket.release()
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/pipelines", nil)
+			rec, err := runPipelineStep(r, 0, tool, pipelineStep{Tool: "echo"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.statusCode() != tt.want || rec.Header().Get("Retry-After") != tt.retry || ran == tt.busy {
+				t.Errorf("status %d, Retry-After %q, ran %v; want %d, %q", rec.statusCode(), rec.Header().Get("Retry-After"), ran, tt.want, tt.retry)
+			}
+			if st := pools[classLight].stats(); st.Running != 0 {
+				t.Errorf("step kept its slot: %+v", st)
+			}
+		})
+	}
+}
+
+func TestPipelineStepForm(t *testing.T) {
+	withPools(t, 1, 0)
+	in := filepath.Join(t.TempDir(), "0_in.pdf")
+	if err := os.WriteFile(in, []byte("%PDF-1.4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tool := pdfTool{name: "echo", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+		f, err := formFile(r, "file")
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, "file required")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"file": f.path, "level": r.FormValue("level")})
+	}}
+
+	// The pipeline's own files and fields must not reach the step.
+	r := withForm(httptest.NewRequest(http.MethodPost, "/api/pipelines", nil), &toolForm{
+		Value: url.Values{"level": {"low"}},
+		File:  map[string][]*uploadedFile{"file": {{Filename: "orig.pdf", path: "/elsewhere/orig.pdf"}}},
+	})
+	step := pipelineStep{Tool: "echo", Params: map[string]json.RawMessage{"level": json.RawMessage(`"high"`)}}
+	rec, err := runPipelineStep(r, 0, tool, step, []stepFile{{name: "in.pdf", path: in}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	_ = json.Unmarshal(rec.body.Bytes(), &got)
+	if got["file"] != in || got["level"] != "high" {
+		t.Errorf("step got %v, want file %s and level high", got, in)
+	}
+}
+
+func TestParsePipelineSteps(t *testing.T) {
+	prev := cfg.DisabledTools
+	t.Cleanup(func() { cfg.DisabledTools = prev })
+	cfg.DisabledTools = []string{"ocr"}
+	tooMany := "[" + strings.Repeat(`{"tool": "compress"},`, maxPipelineSteps) + `{"tool": "compress"}]`
+
+	tests := []struct {
+		name  string
+		raw   string
+		tools []string
+		err   string // empty when valid
+	}{
+		{"one step", `[{"tool": "compress"}]`, []string{"compress"}, ""},
+		{"chain with params", `[{"tool": "merge"}, {"tool": "rotate", "params": {"angle": 90, "pages": ["1", "2"], "keep": true, "note": null}}]`, []string{"merge", "rotate"}, ""},
+		{"most steps", "[" + strings.Repeat(`{"tool": "compress"},`, maxPipelineSteps-1) + `{"tool": "compress"}]`, nil, ""},
+		{"missing", " ", nil, "steps is required"},
+		{"not a list", `{"tool": "compress"}`, nil, "steps must be a JSON list"},
+		{"empty", `[]`, nil, "steps must not be empty"},
+		{"too many steps", tooMany, nil, fmt.Sprintf("at most %d steps", maxPipelineSteps)},
+		{"unknown tool", `[{"tool": "compress"}, {"tool": "shred"}]`, nil, `step 2: unknown or unsupported tool "shred"`},
+		{"disabled tool", `[{"tool": "ocr"}]`, nil, `step 1: unknown or unsupported tool "ocr"`},
+		{"excluded tool", `[{"tool": "preview"}]`, nil, `step 1: unknown or unsupported tool "preview"`},
+		{"object param", `[{"tool": "watermark", "params": {"text": {"en": "draft"}}}]`, nil, `step 1 (watermark): param "text": must be a string`},
+		{"nested list param", `[{"tool": "rotate", "params": {"pages": [[1]]}}]`, nil, `step 1 (rotate): param "pages": must be a string`},
+	}
+	for _, tt := range tests {
+		steps, tools, err := parsePipelineSteps(tt.raw)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(steps) != len(tools) {
+			t.Errorf("%s: %d steps but %d tools", tt.name, len(steps), len(tools))
+		}
+		for i, name := range tt.tools {
+			if tools[i].name != name {
+				t.Errorf("%s: step %d is %s, want %s", tt.name, i+1, tools[i].name, name)
+			}
+		}
+	}
+}
+
+func TestPipelineStepFailure(t *testing.T) {
+	withStore(t)
+	withStorage(t, localBackend)
+	withPools(t, 1, 1)
+	fakePDFInfo(t, printing("Pages: 1\nPage size: 612 x 792 pts\n"))
+
+	var ran []string
+	tool := func(name string, status int) pdfTool {
+		return pdfTool{name: name, class: classLight, accepts: pdfInput, handler: func(w http.ResponseWriter, r *http.Request) {
+			ran = append(ran, name)
+			if status != http.StatusOK {
+				writeJSON(w, status, map[string]string{"error": "page 9 does not exist", "limit": "pages"})
+				return
+			}
+			passOn(w, r)
+		}}
+	}
+	withTools(t, tool("first", http.StatusOK), tool("fails", http.StatusUnprocessableEntity), tool("last", http.StatusOK))
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("steps", `[{"tool": "first"}, {"tool": "fails"}, {"tool": "last"}]`)
+	fw, _ := mw.CreateFormFile("file", "in.pdf")
+	_, _ = fw.Write([]byte("%PDF-1.4\n%%EOF\n"))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/pipelines", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	toolHandler(pipelineTool)(rec, r)
+
+	var resp map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d %s, want 422", rec.Code, rec.Body)
+	}
+	want := map[string]any{"error": "step 2 (fails): page 9 does not exist", "step": 2.0, "stepTool": "fails", "limit": "pages"}
+	for k, v := range want {
+		if resp[k] != v {
+			t.Errorf("%s = %v, want %v", k, resp[k], v)
+		}
+	}
+	if strings.Join(ran, ",") != "first,fails" {
+		t.Errorf("ran %v, want the run to stop at the failed step", ran)
+	}
+	// No final output is kept for a failed run.
+	entries, _ := os.ReadDir(cfg.WorkDir)
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(cfg.WorkDir, e.Name(), "out.pdf")); err == nil {
+			t.Errorf("job %s kept an output", e.Name())
+		}
+	}
+}
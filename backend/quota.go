@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/time/rate"
+)
+
+// Tool submissions are throttled per client: the authenticated caller, or the
+// client address when authentication is off (behind a reverse proxy, list it
+// in PDF_TRUSTED_PROXIES; see clientAddr). Both are opt-in:
+//
+//	PDF_RATE_LIMIT="requests=30,per=1m,burst=10"  token bucket per client
+//	PDF_QUOTA="pages=5000,bytes=2G"                allowance per client and UTC day
+//
+// Pages are those of the PDF inputs; bytes are everything uploaded to a tool,
+// including resumable uploads. Both are charged when a job is accepted, except
+// the bytes of resumable uploads, which are charged as each chunk arrives.
+type rateSettings struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+type quotaSettings struct {
+	Pages int64
+	Bytes int64
+}
+
+var (
+	rateLimit  rateSettings
+	dailyQuota quotaSettings
+)
+
+var usageBucket = []byte("usage")
+
+func loadRateLimits() error {
+	if raw := cfg.RateLimit; raw != "" {
+		rs := rateSettings{Per: time.Minute}
+		err := parseSettings(raw, func(k, v string) (err error) {
+			switch k {
+			case "requests":
+				rs.Requests, err = strconv.Atoi(v)
+			case "per":
+				rs.Per, err = parseLimitDuration(v)
+			case "burst":
+				rs.Burst, err = strconv.Atoi(v)
+			default:
+				err = fmt.Errorf("unknown setting %q", k)
+			}
+			return err
+		})
+		if err == nil && (rs.Requests < 0 || rs.Per <= 0 || rs.Burst < 0) {
+			err = fmt.Errorf("invalid value %q", raw)
+		}
+		if err != nil {
+			return fmt.Errorf("PDF_RATE_LIMIT: %w", err)
+		}
+		if rs.Burst == 0 {
+			rs.Burst = max(1, rs.Requests)
+		}
+		rateLimit = rs
+	}
+	if raw := cfg.Quota; raw != "" {
+		var qs quotaSettings
+		err := parseSettings(raw, func(k, v string) (err error) {
+			switch k {
+			case "pages":
+				qs.Pages, err = strconv.ParseInt(v, 10, 64)
+			case "bytes":
+				qs.Bytes, err = parseByteSize(v)
+			default:
+				err = fmt.Errorf("unknown setting %q", k)
+			}
+			return err
+		})
+		if err == nil && (qs.Pages < 0 || qs.Bytes < 0) {
+			err = fmt.Errorf("invalid value %q", raw)
+		}
+		if err != nil {
+			return fmt.Errorf("PDF_QUOTA: %w", err)
+		}
+		dailyQuota = qs
+	}
+	return nil
+}
+
+// parseSettings splits "k=v,k=v" lists as used by the PDF_* variables.
+func parseSettings(raw string, set func(k, v string) error) error {
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(field, "=")
+		if err := set(strings.TrimSpace(k), strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientIdentity is who limits and quotas are counted against.
+func clientIdentity(r *http.Request) string {
+	if id := callerID(r); id != "" {
+		return "caller:" + id
+	}
+	return "addr:" + clientAddr(r)
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*clientLimiter{}
+)
+
+// allowRequest takes a token from the client's bucket. When there is none
+// left it answers 429 and reports false.
+func allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	if rateLimit.Requests == 0 {
+		return true
+	}
+	id := clientIdentity(r)
+	limitersMu.Lock()
+	cl, ok := limiters[id]
+	if !ok {
+		every := rateLimit.Per / time.Duration(rateLimit.Requests)
+		cl = &clientLimiter{limiter: rate.NewLimiter(rate.Every(every), rateLimit.Burst)}
+		limiters[id] = cl
+	}
+	cl.lastSeen = time.Now()
+	limitersMu.Unlock()
+
+	now := time.Now()
+	allowed := cl.limiter.AllowN(now, 1)
+	tokens := cl.limiter.TokensAt(now)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(0, int(tokens))))
+	if allowed {
+		return true
+	}
+	wait := time.Duration((1 - tokens) / float64(cl.limiter.Limit()) * float64(time.Second))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	errorJSON(w, http.StatusTooManyRequests, "rate limit exceeded")
+	return false
+}
+
+// pruneLimiters forgets clients idle long enough for their bucket to be full.
+func pruneLimiters() {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	for id, cl := range limiters {
+		if time.Since(cl.lastSeen) > rateLimit.Per {
+			delete(limiters, id)
+		}
+	}
+}
+
+// usage is what a client has used on one UTC day.
+type usage struct {
+	Pages int64 `json:"pages"`
+	Bytes int64 `json:"bytes"`
+}
+
+func usageKey(day, id string) []byte {
+	return []byte(day + "\x00" + id)
+}
+
+// chargeUsage adds u to the client's usage for day unless that would go over
+// q, and returns the usage after the charge (or as it stands, if refused).
+func (s *jobStore) chargeUsage(day, id string, u usage, q quotaSettings) (usage, bool, error) {
+	var cur usage
+	charged := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		if v := b.Get(usageKey(day, id)); v != nil {
+			_ = json.Unmarshal(v, &cur)
+		}
+		if (q.Pages > 0 && cur.Pages+u.Pages > q.Pages) || (q.Bytes > 0 && cur.Bytes+u.Bytes > q.Bytes) {
+			return nil
+		}
+		cur.Pages += u.Pages
+		cur.Bytes += u.Bytes
+		charged = true
+		data, err := json.Marshal(cur)
+		if err != nil {
+			return err
+		}
+		return b.Put(usageKey(day, id), data)
+	})
+	return cur, charged, err
+}
+
+// refundUsage takes u back off the client's usage for day, as far as it goes.
+func (s *jobStore) refundUsage(day, id string, u usage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		v := b.Get(usageKey(day, id))
+		if v == nil {
+			return nil
+		}
+		var cur usage
+		_ = json.Unmarshal(v, &cur)
+		cur.Pages = max(0, cur.Pages-u.Pages)
+		cur.Bytes = max(0, cur.Bytes-u.Bytes)
+		data, err := json.Marshal(cur)
+		if err != nil {
+			return err
+		}
+		return b.Put(usageKey(day, id), data)
+	})
+}
+
+// pruneUsage drops the usage of days before day.
+func (s *jobStore) pruneUsage(day string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < day; k, _ = c.Next() {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// formUsage measures a submission: its bytes, and the pages of its PDFs as
+// counted by checkDocumentLimits. The total includes the resumable uploads the
+// form refers to; charge leaves them out, as they were charged on arrival.
+func formUsage(form *toolForm, pages int64) (total, charge usage) {
+	charge = usage{Pages: pages}
+	for _, files := range form.File {
+		for _, f := range files {
+			charge.Bytes += f.Size
+		}
+	}
+	total = charge
+	for _, field := range uploadFields {
+		for _, id := range form.Value[field] {
+			if info, err := loadUpload(strings.TrimSpace(id)); err == nil {
+				total.Bytes += info.Size
+			}
+		}
+	}
+	return total, charge
+}
+
+// chargeQuota charges a submission to the client's daily quota and sets the
+// quota headers on w. When it does not fit it returns the 429 to answer.
+func chargeQuota(w http.ResponseWriter, r *http.Request, u usage) *formError {
+	if dailyQuota.Pages == 0 && dailyQuota.Bytes == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+	reset := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	cur, ok, err := store.chargeUsage(day, clientIdentity(r), u, dailyQuota)
+	if err != nil {
+		return &formError{http.StatusInternalServerError, "failed to check quota"}
+	}
+	if dailyQuota.Pages > 0 {
+		w.Header().Set("X-Quota-Pages-Limit", strconv.FormatInt(dailyQuota.Pages, 10))
+		w.Header().Set("X-Quota-Pages-Remaining", strconv.FormatInt(max(0, dailyQuota.Pages-cur.Pages), 10))
+	}
+	if dailyQuota.Bytes > 0 {
+		w.Header().Set("X-Quota-Bytes-Limit", strconv.FormatInt(dailyQuota.Bytes, 10))
+		w.Header().Set("X-Quota-Bytes-Remaining", strconv.FormatInt(max(0, dailyQuota.Bytes-cur.Bytes), 10))
+	}
+	w.Header().Set("X-Quota-Reset", reset.Format(time.RFC3339))
+	if ok {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
+	return &formError{http.StatusTooManyRequests, "daily quota exceeded"}
+}
+
+// refundQuota gives back a charge that went unused, such as the part of an
+// upload chunk that never arrived. Past midnight it comes off the new day.
+func refundQuota(r *http.Request, u usage) {
+	if dailyQuota.Pages == 0 && dailyQuota.Bytes == 0 || u == (usage{}) {
+		return
+	}
+	day := time.Now().UTC().Format(time.DateOnly)
+	if err := store.refundUsage(day, clientIdentity(r), u); err != nil {
+		slog.ErrorContext(r.Context(), "failed to refund quota", "err", err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withQuota sets the rate limit and daily quota for the test, with no client
+// buckets left over from earlier tests.
+func withQuota(t *testing.T, rs rateSettings, qs quotaSettings) {
+	t.Helper()
+	prevRate, prevQuota := rateLimit, dailyQuota
+	limitersMu.Lock()
+	prevLimiters := limiters
+	limiters = map[string]*clientLimiter{}
+	limitersMu.Unlock()
+	t.Cleanup(func() {
+		rateLimit, dailyQuota = prevRate, prevQuota
+		limitersMu.Lock()
+		limiters = prevLimiters
+		limitersMu.Unlock()
+	})
+	rateLimit, dailyQuota = rs, qs
+}
+
+// usedToday reads id's usage for the current UTC day.
+func usedToday(t *testing.T, id string) usage {
+	t.Helper()
+	u, _, err := store.chargeUsage(time.Now().UTC().Format(time.DateOnly), id, usage{}, quotaSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+
+	tests := []struct {
+		rate, quota string
+		wantRate    rateSettings
+		wantQuota   quotaSettings
+		ok          bool
+	}{
+		{"", "", rateSettings{}, quotaSettings{}, true},
+		{"requests=30,per=1m,burst=10", "", rateSettings{30, time.Minute, 10}, quotaSettings{}, true},
+		{"requests=5", "", rateSettings{5, time.Minute, 5}, quotaSettings{}, true},
+		{"requests=0", "", rateSettings{0, time.Minute, 1}, quotaSettings{}, true},
+		{" requests = 2 , per = 10s ", "", rateSettings{2, 10 * time.Second, 2}, quotaSettings{}, true},
+		{"", "pages=5000,bytes=2G", rateSettings{}, quotaSettings{5000, 2 << 30}, true},
+		{"", "bytes=512K", rateSettings{}, quotaSettings{0, 512 << 10}, true},
+		{"requests=x", "", rateSettings{}, quotaSettings{}, false},
+		{"requests=-1", "", rateSettings{}, quotaSettings{}, false},
+		{"requests=1,per=0s", "", rateSettings{}, quotaSettings{}, false},
+		{"requests=1,window=1m", "", rateSettings{}, quotaSettings{}, false},
+		{"", "pages=-1", rateSettings{}, quotaSettings{}, false},
+		{"", "bytes=lots", rateSettings{}, quotaSettings{}, false},
+		{"", "files=3", rateSettings{}, quotaSettings{}, false},
+	}
+	for _, tt := range tests {
+		withQuota(t, rateSettings{}, quotaSettings{})
+		cfg.RateLimit, cfg.Quota = tt.rate, tt.quota
+		err := loadRateLimits()
+		if (err == nil) != tt.ok {
+			t.Errorf("rate %q, quota %q: err = %v, want ok = %v", tt.rate, tt.quota, err, tt.ok)
+			continue
+		}
+		if tt.ok && (rateLimit != tt.wantRate || dailyQuota != tt.wantQuota) {
+			t.Errorf("rate %q, quota %q: got %+v, %+v; want %+v, %+v", tt.rate, tt.quota, rateLimit, dailyQuota, tt.wantRate, tt.wantQuota)
+		}
+	}
+}
+
+func TestChargeUsage(t *testing.T) {
+	withStore(t)
+	q := quotaSettings{Pages: 10, Bytes: 100}
+
+	// Each step runs against the usage the steps before it left behind.
+	steps := []struct {
+		name    string
+		day     string
+		charge  usage
+		refund  usage
+		want    usage
+		charged bool
+	}{
+		{"first job", "2026-10-16", usage{Pages: 4, Bytes: 40}, usage{}, usage{4, 40}, true},
+		{"up to the quota", "2026-10-16", usage{Pages: 6, Bytes: 60}, usage{}, usage{10, 100}, true},
+		{"over the pages", "2026-10-16", usage{Pages: 1}, usage{}, usage{10, 100}, false},
+		{"over the bytes", "2026-10-16", usage{Bytes: 1}, usage{}, usage{10, 100}, false},
+		{"refund makes room", "2026-10-16", usage{Bytes: 20}, usage{Pages: 2, Bytes: 30}, usage{8, 90}, true},
+		{"refund floors at zero", "2026-10-16", usage{}, usage{Pages: 50, Bytes: 500}, usage{0, 0}, true},
+		{"next day starts afresh", "2026-10-17", usage{Pages: 10, Bytes: 100}, usage{}, usage{10, 100}, true},
+	}
+	for _, st := range steps {
+		if st.refund != (usage{}) {
+			if err := store.refundUsage(st.day, "caller:alice", st.refund); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, charged, err := store.chargeUsage(st.day, "caller:alice", st.charge, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != st.want || charged != st.charged {
+			t.Errorf("%s: %+v, charged %v; want %+v, %v", st.name, got, charged, st.want, st.charged)
+		}
+	}
+
+	// Other clients have their own allowance.
+	if got, _, _ := store.chargeUsage("2026-10-16", "caller:bob", usage{}, q); got != (usage{}) {
+		t.Errorf("bob starts at %+v", got)
+	}
+
+	// Rollover drops the days before the current one.
+	if err := store.pruneUsage("2026-10-17"); err != nil {
+		t.Fatal(err)
+	}
+	for day, want := range map[string]usage{"2026-10-16": {}, "2026-10-17": {10, 100}} {
+		if got, _, _ := store.chargeUsage(day, "caller:alice", usage{}, q); got != want {
+			t.Errorf("%s after pruning: %+v, want %+v", day, got, want)
+		}
+	}
+}
+
+func TestChargeQuotaResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		quota       quotaSettings
+		u           usage
+		status      int // 0 when accepted
+		wantHeaders map[string]string
+	}{
+		{"no quota", quotaSettings{}, usage{Pages: 1 << 20}, 0, map[string]string{"X-Quota-Pages-Limit": "", "X-Quota-Reset": ""}},
+		{"fits", quotaSettings{Pages: 10, Bytes: 100}, usage{Pages: 3, Bytes: 30}, 0, map[string]string{
+			"X-Quota-Pages-Limit": "10", "X-Quota-Pages-Remaining": "7",
+			"X-Quota-Bytes-Limit": "100", "X-Quota-Bytes-Remaining": "70",
+			"Retry-After": "",
+		}},
+		{"pages only", quotaSettings{Pages: 10}, usage{Pages: 10, Bytes: 1 << 30}, 0, map[string]string{
+			"X-Quota-Pages-Remaining": "0", "X-Quota-Bytes-Limit": "",
+		}},
+		{"over", quotaSettings{Pages: 10, Bytes: 100}, usage{Pages: 11}, http.StatusTooManyRequests, map[string]string{
+			"X-Quota-Pages-Remaining": "10", "X-Quota-Bytes-Remaining": "100",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStore(t)
+			withQuota(t, rateSettings{}, tt.quota)
+			r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+			rec := httptest.NewRecorder()
+			err := chargeQuota(rec, r, tt.u)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("refused: %v", err)
+				}
+			} else {
+				if err == nil || err.status != tt.status {
+					t.Fatalf("err = %v, want %d", err, tt.status)
+				}
+				formErrorJSON(rec, err)
+				var body map[string]string
+				if json.Unmarshal(rec.Body.Bytes(), &body); body["error"] != "daily quota exceeded" {
+					t.Errorf("body %s", rec.Body)
+				}
+				// Retry-After points at the next UTC midnight.
+				secs, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+				reset, perr := time.Parse(time.RFC3339, rec.Header().Get("X-Quota-Reset"))
+				if perr != nil || secs <= 0 || secs > 24*60*60 || !reset.Equal(time.Now().UTC().Truncate(24*time.Hour).Add(24*time.Hour)) {
+					t.Errorf("Retry-After %q, X-Quota-Reset %q", rec.Header().Get("Retry-After"), rec.Header().Get("X-Quota-Reset"))
+				}
+			}
+			for k, want := range tt.wantHeaders {
+				if got := rec.Header().Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	withQuota(t, rateSettings{Requests: 2, Per: time.Hour, Burst: 2}, quotaSettings{})
+	from := func(addr string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+		r.RemoteAddr = addr + ":1234"
+		return r
+	}
+
+	steps := []struct {
+		addr      string
+		allowed   bool
+		remaining string
+	}{
+		{"192.0.2.1", true, "1"},
+		{"192.0.2.1", true, "0"},
+		{"192.0.2.1", false, "0"},
+		// Each client has its own bucket.
+		{"192.0.2.2", true, "1"},
+	}
+	for i, st := range steps {
+		rec := httptest.NewRecorder()
+		if got := allowRequest(rec, from(st.addr)); got != st.allowed {
+			t.Fatalf("request %d from %s: allowed = %v", i+1, st.addr, got)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != st.remaining || rec.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("request %d: remaining %q, limit %q", i+1, got, rec.Header().Get("X-RateLimit-Limit"))
+		}
+		if st.allowed {
+			continue
+		}
+		// A token comes back every 30 minutes.
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1800" {
+			t.Errorf("request %d: %d, Retry-After %q; want 429 after 1800s", i+1, rec.Code, rec.Header().Get("Retry-After"))
+		}
+		var body map[string]string
+		if json.Unmarshal(rec.Body.Bytes(), &body); body["error"] != "rate limit exceeded" {
+			t.Errorf("body %s", rec.Body)
+		}
+	}
+}
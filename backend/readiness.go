@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tools shell out to a number of binaries and Python modules that the
+// image may lack or ship broken. Each is probed at startup and every
+// cfg.ProbeInterval (PDF_PROBE_INTERVAL):
+//
+//	GET /health/details  status and version of every dependency and tool
+//	GET /ready           503 while a dependency of an enabled tool is missing,
+//	                     or the job store or file storage is unavailable
+//
+// /health stays a plain liveness check.
+type dependency struct {
+	name string
+	// probe runs a binary with args that print its version. For Python
+	// modules, module is imported and the version of dist reported instead.
+	// Services are checked with ping instead.
+	probe  []string
+	module string
+	dist   string
+	ping   func(ctx context.Context) error
+}
+
+// services are the dependencies every tool has, so they are not listed in
+// any tool's needs.
+var services = []string{"jobstore", "storage"}
+
+// storageProbePrefix is listed to check that the file storage answers; no
+// objects live under it.
+const storageProbePrefix = ".ready/"
+
+var dependencies = []dependency{
+	{name: "pdfcpu", probe: []string{"pdfcpu", "version"}},
+	{name: "qpdf", probe: []string{"qpdf", "--version"}},
+	{name: "gs", probe: []string{"gs", "--version"}},
+	{name: "ocrmypdf", probe: []string{"ocrmypdf", "--version"}},
+	{name: "libreoffice", probe: []string{"libreoffice", "--version"}},
+	{name: "wkhtmltopdf", probe: []string{"wkhtmltopdf", "--version"}},
+	{name: "convert", probe: []string{"convert", "-version"}},
+	{name: "identify", probe: []string{"identify", "-version"}},
+	// Poppler tools print their version to stderr.
+	{name: "pdfinfo", probe: []string{"pdfinfo", "-v"}},
+	{name: "pdftoppm", probe: []string{"pdftoppm", "-v"}},
+	{name: "pdftotext", probe: []string{"pdftotext", "-v"}},
+	{name: "pdfimages", probe: []string{"pdfimages", "-v"}},
+	{name: "pdftohtml", probe: []string{"pdftohtml", "-v"}},
+	{name: "diff", probe: []string{"diff", "--version"}},
+	{name: "python3", probe: []string{"python3", "--version"}},
+	{name: "pdf2docx", module: "pdf2docx", dist: "pdf2docx"},
+	{name: "tabula", module: "tabula", dist: "tabula-py"},
+	{name: "pandas", module: "pandas", dist: "pandas"},
+	{name: "pptx", module: "pptx", dist: "python-pptx"},
+	{name: "pdf2image", module: "pdf2image", dist: "pdf2image"},
+	{name: "jobstore", ping: func(ctx context.Context) error { return store.ping() }},
+	{name: "storage", ping: func(ctx context.Context) error {
+		_, err := storage.list(ctx, storageProbePrefix)
+		return err
+	}},
+}
+
+// pythonProbe imports argv[1] and prints the installed version of argv[2].
+const pythonProbe = `import importlib, sys
+importlib.import_module(sys.argv[1])
+try:
+    from importlib.metadata import version
+    print(version(sys.argv[2]))
+except Exception:
+    print("")
+`
+
+const probeTimeout = 20 * time.Second
+
+const (
+	depOK      = "ok"
+	depMissing = "missing" // not installed
+	depBroken  = "broken"  // installed, but the probe failed
+)
+
+type dependencyStatus struct {
+	Status  string `json:"status"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type toolStatus struct {
+	Ready   bool     `json:"ready"`
+	Enabled bool     `json:"enabled"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+type probeReport struct {
+	CheckedAt    time.Time                   `json:"checkedAt"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+var (
+	probeMu   sync.RWMutex
+	lastProbe *probeReport // nil until the first probe has finished
+)
+
+func probeLoop() {
+	for {
+		runProbes(workCtx)
+		select {
+		case <-time.After(cfg.ProbeInterval):
+		case <-workCtx.Done():
+			return
+		}
+	}
+}
+
+// runProbes checks every dependency concurrently and publishes the result.
+func runProbes(ctx context.Context) {
+	report := &probeReport{Dependencies: make(map[string]dependencyStatus, len(dependencies))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, d := range dependencies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st := d.check(ctx)
+			mu.Lock()
+			report.Dependencies[d.name] = st
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	report.CheckedAt = time.Now().UTC()
+
+	probeMu.Lock()
+	prev := lastProbe
+	lastProbe = report
+	probeMu.Unlock()
+
+	for _, d := range dependencies {
+		st := report.Dependencies[d.name]
+		if st.Status != depOK && (prev == nil || prev.Dependencies[d.name].Status != st.Status) {
+			slog.Warn("dependency unavailable", "dependency", d.name, "status", st.Status, "err", st.Error)
+		}
+	}
+}
+
+func (d dependency) check(ctx context.Context) dependencyStatus {
+	if d.ping != nil {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+		if err := d.ping(ctx); err != nil {
+			return dependencyStatus{Status: depBroken, Error: truncate(err.Error(), 300)}
+		}
+		return dependencyStatus{Status: depOK}
+	}
+	argv := d.probe
+	if d.module != "" {
+		argv = []string{"python3", "-c", pythonProbe, d.module, d.dist}
+	}
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		return dependencyStatus{Status: depMissing, Error: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		msg := lastLine(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		if d.module != "" && strings.Contains(msg, "ModuleNotFoundError") {
+			return dependencyStatus{Status: depMissing, Error: msg}
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			msg = "probe timed out"
+		}
+		return dependencyStatus{Status: depBroken, Error: msg}
+	}
+	return dependencyStatus{Status: depOK, Version: firstLine(string(out))}
+}
+
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return truncate(line, 120)
+		}
+	}
+	return ""
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return truncate(strings.TrimSpace(lines[len(lines)-1]), 300)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// toolStatuses reports, per tool, which of its dependencies are not ok.
+func (p *probeReport) toolStatuses() map[string]toolStatus {
+	out := make(map[string]toolStatus, len(pdfTools))
+	for _, t := range pdfTools {
+		ts := toolStatus{Enabled: cfg.toolEnabled(t.name)}
+		for _, dep := range t.needs {
+			if p.Dependencies[dep].Status != depOK {
+				ts.Missing = append(ts.Missing, dep)
+			}
+		}
+		ts.Ready = len(ts.Missing) == 0
+		out[t.name] = ts
+	}
+	return out
+}
+
+type healthDetailsResponse struct {
+	Status       string                      `json:"status"` // "ok", "degraded" or "starting"
+	CheckedAt    *time.Time                  `json:"checkedAt,omitempty"`
+	Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"`
+	Tools        map[string]toolStatus       `json:"tools,omitempty"`
+}
+
+// handleHealthDetails serves GET /health/details.
+func handleHealthDetails(w http.ResponseWriter, r *http.Request) {
+	probeMu.RLock()
+	p := lastProbe
+	probeMu.RUnlock()
+	if p == nil {
+		writeJSON(w, http.StatusOK, healthDetailsResponse{Status: "starting"})
+		return
+	}
+	resp := healthDetailsResponse{
+		Status:       "ok",
+		CheckedAt:    &p.CheckedAt,
+		Dependencies: p.Dependencies,
+		Tools:        p.toolStatuses(),
+	}
+	for _, st := range resp.Dependencies {
+		if st.Status != depOK {
+			resp.Status = "degraded"
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type readyResponse struct {
+	Ready  bool                `json:"ready"`
+	Reason string              `json:"reason,omitempty"`
+	Tools  map[string][]string `json:"tools,omitempty"` // enabled tool -> missing dependencies
+}
+
+// handleReady serves GET /ready: 200 when the services are up and every
+// enabled tool has what it needs, 503 otherwise, before the first probe and
+// while shutting down.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown() {
+		writeJSON(w, http.StatusServiceUnavailable, readyResponse{Reason: "shutting down"})
+		return
+	}
+	probeMu.RLock()
+	p := lastProbe
+	probeMu.RUnlock()
+	if p == nil {
+		writeJSON(w, http.StatusServiceUnavailable, readyResponse{Reason: "dependencies not checked yet"})
+		return
+	}
+	for _, name := range services {
+		if st := p.Dependencies[name]; st.Status != depOK {
+			writeJSON(w, http.StatusServiceUnavailable, readyResponse{Reason: name + " unavailable: " + st.Error})
+			return
+		}
+	}
+	missing := map[string][]string{}
+	var deps []string
+	for name, ts := range p.toolStatuses() {
+		if ts.Enabled && !ts.Ready {
+			missing[name] = ts.Missing
+			deps = append(deps, ts.Missing...)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(deps)
+		writeJSON(w, http.StatusServiceUnavailable, readyResponse{
+			Reason: "missing dependencies: " + strings.Join(slices.Compact(deps), ", "),
+			Tools:  missing,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, readyResponse{Ready: true})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withProbe publishes report as the last probe for the test.
+func withProbe(t *testing.T, report *probeReport) {
+	t.Helper()
+	probeMu.Lock()
+	prev := lastProbe
+	lastProbe = report
+	probeMu.Unlock()
+	t.Cleanup(func() {
+		probeMu.Lock()
+		lastProbe = prev
+		probeMu.Unlock()
+	})
+}
+
+// brokenStorage is a file storage that cannot be reached.
+type brokenStorage struct {
+	localStorage
+}
+
+func (brokenStorage) list(ctx context.Context, prefix string) ([]string, error) {
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func TestDependencyCheck(t *testing.T) {
+	bin := t.TempDir()
+	for name, script := range map[string]string{
+		"good": "echo 'good 1.2.3'; echo 'more'",
+		"bad":  "echo 'warming up'; echo 'error: libfoo.so not found' >&2; exit 1",
+	} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+	withStore(t)
+	withStorage(t, localBackend)
+	closed := store
+	withStore(t)
+	_ = closed.db.Close()
+
+	tests := []struct {
+		name string
+		dep  dependency
+		want dependencyStatus
+	}{
+		{"installed", dependency{name: "good", probe: []string{"good", "--version"}}, dependencyStatus{Status: depOK, Version: "good 1.2.3"}},
+		{"not installed", dependency{name: "gone", probe: []string{"gone", "--version"}}, dependencyStatus{Status: depMissing}},
+		{"probe fails", dependency{name: "bad", probe: []string{"bad", "--version"}}, dependencyStatus{Status: depBroken, Error: "error: libfoo.so not found"}},
+		{"store up", dependency{name: "jobstore", ping: func(ctx context.Context) error { return store.ping() }}, dependencyStatus{Status: depOK}},
+		{"store closed", dependency{name: "jobstore", ping: func(ctx context.Context) error { return closed.ping() }}, dependencyStatus{Status: depBroken, Error: "database not open"}},
+	}
+	for _, tt := range tests {
+		got := tt.dep.check(context.Background())
+		if tt.want.Status == depMissing {
+			got.Error = "" // it is the PATH lookup's
+		}
+		if got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	prev := cfg.DisabledTools
+	t.Cleanup(func() { cfg.DisabledTools = prev })
+	withTools(t,
+		pdfTool{name: "compress", needs: []string{"gs", "pdfinfo"}},
+		pdfTool{name: "word-to-pdf", needs: []string{"libreoffice"}},
+	)
+	report := func(down map[string]string) *probeReport {
+		p := &probeReport{Dependencies: map[string]dependencyStatus{}}
+		for _, name := range []string{"gs", "pdfinfo", "libreoffice", "jobstore", "storage"} {
+			p.Dependencies[name] = dependencyStatus{Status: depOK}
+			if status, ok := down[name]; ok {
+				p.Dependencies[name] = dependencyStatus{Status: status, Error: name + " is down"}
+			}
+		}
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		probe    *probeReport
+		disabled []string
+		drain    bool
+		want     int
+		reason   string
+		tools    map[string][]string
+	}{
+		{"not probed yet", nil, nil, false, http.StatusServiceUnavailable, "dependencies not checked yet", nil},
+		{"all there", report(nil), nil, false, http.StatusOK, "", nil},
+		{"missing binary", report(map[string]string{"libreoffice": depMissing}), nil, false, http.StatusServiceUnavailable,
+			"missing dependencies: libreoffice", map[string][]string{"word-to-pdf": {"libreoffice"}}},
+		{"broken binaries", report(map[string]string{"gs": depBroken, "pdfinfo": depMissing}), nil, false, http.StatusServiceUnavailable,
+			"missing dependencies: gs, pdfinfo", map[string][]string{"compress": {"gs", "pdfinfo"}}},
+		{"missing binary of a disabled tool", report(map[string]string{"libreoffice": depMissing}), []string{"word-to-pdf"}, false, http.StatusOK, "", nil},
+		{"job store unavailable", report(map[string]string{"jobstore": depBroken}), nil, false, http.StatusServiceUnavailable, "jobstore unavailable: jobstore is down", nil},
+		{"storage unavailable", report(map[string]string{"storage": depBroken}), nil, false, http.StatusServiceUnavailable, "storage unavailable: storage is down", nil},
+		{"shutting down", report(nil), nil, true, http.StatusServiceUnavailable, "shutting down", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withProbe(t, tt.probe)
+			cfg.DisabledTools = tt.disabled
+			if tt.drain {
+				draining(t)
+			}
+			rec := httptest.NewRecorder()
+			handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			var got readyResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.want || got.Ready != (tt.want == http.StatusOK) || got.Reason != tt.reason {
+				t.Errorf("%d %+v, want %d with reason %q", rec.Code, got, tt.want, tt.reason)
+			}
+			if len(got.Tools) != len(tt.tools) {
+				t.Errorf("tools %v, want %v", got.Tools, tt.tools)
+			}
+			for name, deps := range tt.tools {
+				if strings.Join(got.Tools[name], ",") != strings.Join(deps, ",") {
+					t.Errorf("%s is missing %v, want %v", name, got.Tools[name], deps)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyWithStorageDown(t *testing.T) {
+	withStore(t)
+	withStorage(t, func(root string) storageBackend { return brokenStorage{localStorage{root: root}} })
+	withTools(t)
+	prev := dependencies
+	t.Cleanup(func() { dependencies = prev })
+	dependencies = nil
+	for _, d := range prev {
+		if slices.Contains(services, d.name) {
+			dependencies = append(dependencies, d)
+		}
+	}
+
+	withProbe(t, nil)
+	runProbes(context.Background())
+	rec := httptest.NewRecorder()
+	handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "storage unavailable: dial tcp: connection refused") {
+		t.Errorf("%d %s, want 503 naming the storage", rec.Code, rec.Body)
+	}
+}
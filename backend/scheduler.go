@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tool classes. Each class has its own worker pool so a burst of office
+// conversions cannot starve quick pdfcpu operations, and vice versa.
+// Pipelines are admitted through their own pool; each step is then admitted
+// to its tool's pool in turn.
+const (
+	classOffice   = "office"
+	classOCR      = "ocr"
+	classRaster   = "raster"
+	classLight    = "light"
+	classPipeline = "pipeline"
+)
+
+// workerPool bounds how many jobs of one class run at once and how many may
+// wait for a turn. Anything beyond that is turned away with 429.
+type workerPool struct {
+	name       string
+	slots      chan struct{}
+	queueSize  int
+	retryAfter time.Duration
+
+	mu      sync.Mutex
+	pending int // admitted jobs, running or waiting
+	running int
+}
+
+func newWorkerPool(name string, workers, queueSize int, retryAfter time.Duration) *workerPool {
+	return &workerPool{
+		name:       name,
+		slots:      make(chan struct{}, workers),
+		queueSize:  queueSize,
+		retryAfter: retryAfter,
+	}
+}
+
+// poolTicket is an admitted job's place in a pool.
+type poolTicket struct {
+	pool     *workerPool
+	acquired bool
+	released bool
+}
+
+// admit reserves a place for one job, or reports false when the pool and its
+// queue are full.
+func (p *workerPool) admit() (*poolTicket, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending >= cap(p.slots)+p.queueSize {
+		return nil, false
+	}
+	p.pending++
+	return &poolTicket{pool: p}, true
+}
+
+// wait blocks until the job may run or ctx is done.
+func (t *poolTicket) wait(ctx context.Context) error {
+	select {
+	case t.pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	t.pool.mu.Lock()
+	t.pool.running++
+	t.pool.mu.Unlock()
+	t.acquired = true
+	return nil
+}
+
+// release gives the place back. It is safe to call more than once.
+func (t *poolTicket) release() {
+	if t.released {
+		return
+	}
+	t.released = true
+	t.pool.mu.Lock()
+	t.pool.pending--
+	if t.acquired {
+		t.pool.running--
+	}
+	t.pool.mu.Unlock()
+	if t.acquired {
+		<-t.pool.slots
+	}
+}
+
+// run executes fn in a worker slot without going through admission. It is
+// for background work, which should wait rather than be rejected.
+func (p *workerPool) run(ctx context.Context, fn func()) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	fn()
+	return nil
+}
+
+type poolStats struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	Running   int `json:"running"`
+	Queued    int `json:"queued"`
+}
+
+func (p *workerPool) stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return poolStats{
+		Workers:   cap(p.slots),
+		QueueSize: p.queueSize,
+		Running:   p.running,
+		Queued:    p.pending - p.running,
+	}
+}
+
+// pools holds one workerPool per tool class.
+var pools = map[string]*workerPool{}
+
+// loadPools sets up the worker pools. Sizes can be overridden in the pools
+// section of the config, e.g. PDF_POOL_<CLASS>="workers=2,queue=8,retryAfter=30s".
+func loadPools() error {
+	cpus := runtime.NumCPU()
+	defaults := map[string]poolStats{
+		classOffice:   {Workers: 2, QueueSize: 8},
+		classOCR:      {Workers: 2, QueueSize: 8},
+		classRaster:   {Workers: max(2, cpus/2), QueueSize: 16},
+		classLight:    {Workers: max(4, cpus*2), QueueSize: 64},
+		classPipeline: {Workers: max(2, cpus/2), QueueSize: 16},
+	}
+	retryAfter := map[string]time.Duration{
+		classOffice:   30 * time.Second,
+		classOCR:      30 * time.Second,
+		classRaster:   10 * time.Second,
+		classLight:    2 * time.Second,
+		classPipeline: 30 * time.Second,
+	}
+
+	for class := range cfg.Pools {
+		if _, ok := defaults[class]; !ok {
+			return fmt.Errorf("PDF_POOL_%s: unknown class", strings.ToUpper(class))
+		}
+	}
+	for class, d := range defaults {
+		workers, queue, retry := d.Workers, d.QueueSize, retryAfter[class]
+		key := "PDF_POOL_" + strings.ToUpper(class)
+		if raw, ok := cfg.Pools[class]; ok {
+			for _, field := range strings.Split(raw, ",") {
+				field = strings.TrimSpace(field)
+				if field == "" {
+					continue
+				}
+				k, v, _ := strings.Cut(field, "=")
+				var err error
+				switch strings.TrimSpace(k) {
+				case "workers":
+					workers, err = strconv.Atoi(strings.TrimSpace(v))
+					if err == nil && workers < 1 {
+						err = fmt.Errorf("must be at least 1")
+					}
+				case "queue":
+					queue, err = strconv.Atoi(strings.TrimSpace(v))
+					if err == nil && queue < 0 {
+						err = fmt.Errorf("must not be negative")
+					}
+				case "retryAfter":
+					retry, err = time.ParseDuration(strings.TrimSpace(v))
+				default:
+					err = fmt.Errorf("unknown setting")
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", key, k, err)
+				}
+			}
+		}
+		pools[class] = newWorkerPool(class, workers, queue, retry)
+	}
+	return nil
+}
+
+// rejectBusy answers 429 when a pool cannot take another job.
+func rejectBusy(w http.ResponseWriter, p *workerPool) {
+	secs := int((p.retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	st := p.stats()
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(st.Queued))
+	errorJSON(w, http.StatusTooManyRequests, fmt.Sprintf("server busy: %s queue is full", p.name))
+}
+
+type queueResponse struct {
+	Running int                  `json:"running"`
+	Queued  int                  `json:"queued"`
+	Pools   map[string]poolStats `json:"pools"`
+}
+
+// handleQueue serves GET /api/queue so load balancers can see how busy this
+// instance is. X-Queue-Depth carries the total number of waiting jobs.
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	resp := queueResponse{Pools: make(map[string]poolStats, len(pools))}
+	for name, p := range pools {
+		st := p.stats()
+		resp.Pools[name] = st
+		resp.Running += st.Running
+		resp.Queued += st.Queued
+	}
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(resp.Queued))
+	writeJSON(w, http.StatusOK, resp)
+}
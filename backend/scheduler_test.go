@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolAdmission(t *testing.T) {
+	p := newWorkerPool(classLight, 1, 1, 2*time.Second)
+	var tickets []*poolTicket
+
+	// Each step runs against the tickets the steps before it left behind.
+	steps := []struct {
+		name string
+		do   func() bool
+		ok   bool
+		want poolStats
+	}{
+		{"first is admitted", func() bool {
+			tk, ok := p.admit()
+			tickets = append(tickets, tk)
+			return ok
+		}, true, poolStats{Workers: 1, QueueSize: 1, Queued: 1}},
+		{"first takes the slot", func() bool {
+			return tickets[0].wait(context.Background()) == nil
+		}, true, poolStats{Workers: 1, QueueSize: 1, Running: 1}},
+		{"second is queued", func() bool {
+			tk, ok := p.admit()
+			tickets = append(tickets, tk)
+			return ok
+		}, true, poolStats{Workers: 1, QueueSize: 1, Running: 1, Queued: 1}},
+		{"third is turned away", func() bool {
+			_, ok := p.admit()
+			return ok
+		}, false, poolStats{Workers: 1, QueueSize: 1, Running: 1, Queued: 1}},
+		{"second gives up waiting", func() bool {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			return !errors.Is(tickets[1].wait(ctx), context.DeadlineExceeded)
+		}, false, poolStats{Workers: 1, QueueSize: 1, Running: 1, Queued: 1}},
+		{"first is released", func() bool {
+			tickets[0].release()
+			tickets[0].release()
+			return true
+		}, true, poolStats{Workers: 1, QueueSize: 1, Queued: 1}},
+		{"second takes the slot", func() bool {
+			return tickets[1].wait(context.Background()) == nil
+		}, true, poolStats{Workers: 1, QueueSize: 1, Running: 1}},
+		{"second is released", func() bool {
+			tickets[1].release()
+			return true
+		}, true, poolStats{Workers: 1, QueueSize: 1}},
+	}
+	for _, st := range steps {
+		if ok := st.do(); ok != st.ok {
+			t.Fatalf("%s: %v, want %v", st.name, ok, st.ok)
+		}
+		if got := p.stats(); got != st.want {
+			t.Errorf("%s: %+v, want %+v", st.name, got, st.want)
+		}
+	}
+}
+
+func TestLoadPools(t *testing.T) {
+	prevCfg, prevPools := cfg.Pools, pools
+	t.Cleanup(func() { cfg.Pools, pools = prevCfg, prevPools })
+
+	tests := []struct {
+		raw   map[string]string
+		class string
+		want  poolStats
+		retry time.Duration
+		ok    bool
+	}{
+		{nil, classOffice, poolStats{Workers: 2, QueueSize: 8}, 30 * time.Second, true},
+		{map[string]string{classOCR: "workers=3,queue=0,retryAfter=1m"}, classOCR, poolStats{Workers: 3}, time.Minute, true},
+		{map[string]string{classLight: " queue = 5 "}, classLight, poolStats{Workers: 0, QueueSize: 5}, 2 * time.Second, true},
+		{map[string]string{classRaster: "workers=0"}, "", poolStats{}, 0, false},
+		{map[string]string{classRaster: "queue=-1"}, "", poolStats{}, 0, false},
+		{map[string]string{classRaster: "retryAfter=soon"}, "", poolStats{}, 0, false},
+		{map[string]string{classRaster: "size=3"}, "", poolStats{}, 0, false},
+		{map[string]string{"gpu": "workers=1"}, "", poolStats{}, 0, false},
+	}
+	for _, tt := range tests {
+		cfg.Pools, pools = tt.raw, map[string]*workerPool{}
+		err := loadPools()
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v, want ok = %v", tt.raw, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		p := pools[tt.class]
+		got := p.stats()
+		// The default worker count depends on the machine.
+		if tt.want.Workers == 0 {
+			got.Workers = 0
+		}
+		if got != tt.want || p.retryAfter != tt.retry {
+			t.Errorf("%v: %s pool %+v retrying after %s, want %+v after %s", tt.raw, tt.class, got, p.retryAfter, tt.want, tt.retry)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	withPools(t, 1, 1)
+	h := toolHandler(pdfTool{name: "compress", class: classLight, handler: func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}})
+	// One job runs and one waits, which fills the light pool.
+	running, _ := pools[classLight].admit()
+	_ = running.wait(context.Background())
+	defer running.release()
+	queued, _ := pools[classLight].admit()
+	defer queued.release()
+
+	rec := httptest.NewRecorder()
+	h(rec, multipartRequest(t, 10))
+	var body map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusTooManyRequests || body["error"] != "server busy: light queue is full" {
+		t.Errorf("%d %s, want 429 naming the light queue", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After %q, want 5", got)
+	}
+	if got := rec.Header().Get("X-Queue-Depth"); got != "1" {
+		t.Errorf("X-Queue-Depth %q, want 1", got)
+	}
+
+	// Other classes are not affected.
+	if tk, ok := pools[classOffice].admit(); !ok {
+		t.Error("office pool turned a job away")
+	} else {
+		tk.release()
+	}
+}
+
+func TestHandleQueue(t *testing.T) {
+	withPools(t, 2, 3)
+	var held []*poolTicket
+	for class, n := range map[string]struct{ running, queued int }{
+		classLight:  {2, 1},
+		classRaster: {1, 0},
+		classOCR:    {0, 2},
+	} {
+		for i := range n.running + n.queued {
+			tk, _ := pools[class].admit()
+			if i < n.running {
+				_ = tk.wait(context.Background())
+			}
+			held = append(held, tk)
+		}
+	}
+	defer func() {
+		for _, tk := range held {
+			tk.release()
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	handleQueue(rec, httptest.NewRequest(http.MethodGet, "/api/queue", nil))
+	var got queueResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Running != 3 || got.Queued != 3 || rec.Header().Get("X-Queue-Depth") != "3" {
+		t.Errorf("running %d, queued %d, X-Queue-Depth %q; want 3, 3, 3", got.Running, got.Queued, rec.Header().Get("X-Queue-Depth"))
+	}
+	want := map[string]poolStats{
+		classLight:    {Workers: 2, QueueSize: 3, Running: 2, Queued: 1},
+		classRaster:   {Workers: 2, QueueSize: 3, Running: 1},
+		classOCR:      {Workers: 2, QueueSize: 3, Queued: 2},
+		classOffice:   {Workers: 2, QueueSize: 3},
+		classPipeline: {Workers: 2, QueueSize: 3},
+	}
+	if len(got.Pools) != len(want) {
+		t.Errorf("pools %v", got.Pools)
+	}
+	for class, w := range want {
+		if got.Pools[class] != w {
+			t.Errorf("%s: %+v, want %+v", class, got.Pools[class], w)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// On SIGTERM the server stops accepting connections and new jobs, and waits
+// up to cfg.ShutdownTimeout (PDF_SHUTDOWN_TIMEOUT) for running jobs, queued
+// async jobs and background preview renders. Whatever is still running then
+// is cancelled, which kills its tools and removes its job directory.
+var inflight struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// workCtx is cancelled when the shutdown deadline passes. Jobs and renders
+// that outlive their request derive from it instead of context.Background.
+var workCtx, abortWork = context.WithCancel(context.Background())
+
+// abortGrace is how long cancelled work gets to kill its tools and remove its
+// files before the process exits anyway.
+const abortGrace = 5 * time.Second
+
+// beginWork registers a job or render that shutdown must wait for. It reports
+// false once the server is shutting down; otherwise the caller must call
+// endWork when done.
+func beginWork() bool {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+	if inflight.draining {
+		return false
+	}
+	inflight.wg.Add(1)
+	return true
+}
+
+// holdWork registers background work started by work that beginWork already
+// registered, such as a finished job's webhook delivery. Unlike beginWork it
+// is not refused while draining. The caller must call endWork when done.
+func holdWork() {
+	inflight.wg.Add(1)
+}
+
+func endWork() {
+	inflight.wg.Done()
+}
+
+func shuttingDown() bool {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+	return inflight.draining
+}
+
+// shutdown drains srv and the work registered with beginWork.
+func shutdown(srv *http.Server) {
+	inflight.mu.Lock()
+	inflight.draining = true
+	inflight.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		inflight.wg.Wait()
+		close(drained)
+	}()
+
+	slog.Info("shutting down; waiting for running jobs", "timeout", cfg.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		select {
+		case <-drained:
+			slog.Info("all jobs finished")
+			return
+		case <-ctx.Done():
+		}
+	}
+
+	slog.Warn("shutdown deadline passed; cancelling remaining jobs")
+	abortWork()
+	ctx, cancel = context.WithTimeout(context.Background(), abortGrace)
+	defer cancel()
+	// Cancelled synchronous jobs still answer their clients; let them.
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "err", err)
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		slog.Warn("some jobs did not stop in time")
+	}
+}
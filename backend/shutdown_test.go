@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withFreshShutdown gives the test its own work context and restores the
+// server to running afterwards, so shutting down does not leak into other
+// tests.
+func withFreshShutdown(t *testing.T) {
+	t.Helper()
+	prevCtx, prevAbort := workCtx, abortWork
+	workCtx, abortWork = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		abortWork()
+		workCtx, abortWork = prevCtx, prevAbort
+		inflight.mu.Lock()
+		inflight.draining = false
+		inflight.mu.Unlock()
+	})
+}
+
+func TestBeginWorkDuringShutdown(t *testing.T) {
+	withFreshShutdown(t)
+	prev := cfg.ShutdownTimeout
+	t.Cleanup(func() { cfg.ShutdownTimeout = prev })
+	cfg.ShutdownTimeout = time.Second
+
+	if !beginWork() {
+		t.Fatal("beginWork refused before shutdown")
+	}
+	endWork()
+	if shuttingDown() {
+		t.Fatal("shutting down before shutdown")
+	}
+	shutdown(&http.Server{})
+	if !shuttingDown() {
+		t.Error("not shutting down after shutdown")
+	}
+	if beginWork() {
+		endWork()
+		t.Error("beginWork accepted new work after shutdown began")
+	}
+	// Work started by registered work is still let through.
+	holdWork()
+	endWork()
+}
+
+func TestShutdownWaitsForWork(t *testing.T) {
+	prev := cfg.ShutdownTimeout
+	t.Cleanup(func() { cfg.ShutdownTimeout = prev })
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		work    time.Duration // how long the work runs unless cancelled
+		aborted bool
+		atLeast time.Duration
+		atMost  time.Duration
+	}{
+		{"work finishes in time", time.Second, 50 * time.Millisecond, false, 50 * time.Millisecond, 900 * time.Millisecond},
+		{"work outlives the timeout", 100 * time.Millisecond, time.Minute, true, 100 * time.Millisecond, abortGrace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFreshShutdown(t)
+			cfg.ShutdownTimeout = tt.timeout
+			if !beginWork() {
+				t.Fatal("beginWork refused")
+			}
+			ctx := workCtx
+			go func() {
+				defer endWork()
+				select {
+				case <-time.After(tt.work):
+				case <-ctx.Done():
+				}
+			}()
+
+			start := time.Now()
+			shutdown(&http.Server{})
+			took := time.Since(start)
+			if took < tt.atLeast || took > tt.atMost {
+				t.Errorf("shutdown took %s, want between %s and %s", took, tt.atLeast, tt.atMost)
+			}
+			if aborted := ctx.Err() != nil; aborted != tt.aborted {
+				t.Errorf("work cancelled = %v, want %v", aborted, tt.aborted)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Job files are still produced in cfg.WorkDir, which is scratch space private
+// to this instance. The storage backend is where finished job inputs, outputs
+// and previews are kept so that any replica can serve them. Keys are the paths
+// below cfg.WorkDir in slash form, "<jobID>/output.pdf", so download and
+// preview URLs map to keys directly.
+//
+// storage.backend (PDF_STORAGE) selects the backend: "local" (the default)
+// keeps files in the work directory itself; "s3" uses the S3-compatible
+// bucket configured under storage.s3.
+type storageBackend interface {
+	// put stores the local file at src under key.
+	put(ctx context.Context, key, src string) error
+	// open returns the object stored under key, or fs.ErrNotExist.
+	open(ctx context.Context, key string) (io.ReadSeekCloser, storedObject, error)
+	// list returns the keys below prefix.
+	list(ctx context.Context, prefix string) ([]string, error)
+	// presign returns a URL the client can fetch key from directly, or
+	// errNoPresign when the backend cannot hand out such URLs.
+	presign(ctx context.Context, key, filename string, inline bool) (string, error)
+	// prune removes objects written before cutoff.
+	prune(ctx context.Context, cutoff time.Time) error
+	// claim records key as taken and reports whether this call took it, so
+	// that of several replicas only one wins. Claims are dropped some time
+	// after expires.
+	claim(ctx context.Context, key string, expires time.Time) (bool, error)
+	// remote reports whether objects live outside cfg.WorkDir.
+	remote() bool
+}
+
+type storedObject struct {
+	Size    int64
+	ModTime time.Time
+}
+
+var errNoPresign = errors.New("presigned URLs are not supported")
+
+// storage holds every job's files; it is set up in main.
+var storage storageBackend
+
+func openStorage() (storageBackend, error) {
+	if cfg.Storage.Backend == "s3" {
+		s, err := newS3Storage()
+		if err != nil {
+			return nil, err
+		}
+		return tracedStorage{s}, nil
+	}
+	return tracedStorage{localStorage{root: cfg.WorkDir}}, nil
+}
+
+// storageKey turns a URL path below /downloads/ or /previews/ into a key,
+// refusing anything that would leave the job directory tree or reach the
+// claims kept next to it.
+func storageKey(rel string) (string, bool) {
+	key := path.Clean("/" + rel)[1:]
+	if key == "" || strings.Contains(rel, "..") || strings.HasPrefix(key, ".") {
+		return "", false
+	}
+	return key, true
+}
+
+// localStorage serves job files straight from the work directories.
+type localStorage struct {
+	root string
+}
+
+func (s localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s localStorage) put(ctx context.Context, key, src string) error {
+	dst := s.path(key)
+	if dst == filepath.Clean(src) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return copyFile(src, dst)
+}
+
+func (s localStorage) open(ctx context.Context, key string) (io.ReadSeekCloser, storedObject, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, storedObject{}, fs.ErrNotExist
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		return nil, storedObject{}, fs.ErrNotExist
+	}
+	return f, storedObject{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s localStorage) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.path(prefix), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(s.root, p)
+			keys = append(keys, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+func (s localStorage) presign(ctx context.Context, key, filename string, inline bool) (string, error) {
+	return "", errNoPresign
+}
+
+// prune is a no-op: the objects are the work directories, which
+// cleanupOldJobs removes itself.
+func (s localStorage) prune(ctx context.Context, cutoff time.Time) error {
+	return nil
+}
+
+func (s localStorage) remote() bool { return false }
+
+// claim uses the job store: a local backend serves one instance only.
+func (s localStorage) claim(ctx context.Context, key string, expires time.Time) (bool, error) {
+	return store.spendLink(key, expires)
+}
+
+// s3Storage keeps job files in an S3-compatible bucket (AWS S3, MinIO, ...).
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Storage() (*s3Storage, error) {
+	sc := cfg.Storage.S3
+	endpoint, secure := sc.Endpoint, !sc.Insecure
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		endpoint = u.Host
+		secure = secure && u.Scheme != "http"
+	}
+	bucket := sc.Bucket
+
+	// Without explicit keys, fall back to the usual AWS environment variables
+	// and instance credentials.
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.IAM{},
+	})
+	if sc.AccessKey != "" {
+		creds = credentials.NewStaticV4(sc.AccessKey, sc.SecretKey, "")
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: sc.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 storage: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ok, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3 storage: check bucket %s: %w", bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("s3 storage: bucket %s does not exist", bucket)
+	}
+	prefix := strings.Trim(sc.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Storage) put(ctx context.Context, key, src string) error {
+	_, err := s.client.FPutObject(ctx, s.bucket, s.prefix+key, src, minio.PutObjectOptions{
+		ContentType: contentTypeFor(src),
+	})
+	return err
+}
+
+func (s *s3Storage) open(ctx context.Context, key string) (io.ReadSeekCloser, storedObject, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, storedObject{}, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, storedObject{}, fs.ErrNotExist
+		}
+		return nil, storedObject{}, err
+	}
+	return obj, storedObject{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Storage) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	return keys, nil
+}
+
+func (s *s3Storage) presign(ctx context.Context, key, filename string, inline bool) (string, error) {
+	params := url.Values{}
+	if !inline {
+		params.Set("response-content-disposition", "attachment; filename="+strconv.Quote(filename))
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, s.prefix+key, cfg.Storage.S3.PresignTTL, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *s3Storage) prune(ctx context.Context, cutoff time.Time) error {
+	objects := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objects)
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+			if obj.Err == nil && obj.LastModified.Before(cutoff) {
+				objects <- obj
+			}
+		}
+	}()
+	for res := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if res.Err != nil {
+			return res.Err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) remote() bool { return true }
+
+// claim creates an empty object under key with If-None-Match: *, which the
+// bucket refuses when the object exists; AWS S3 and MinIO support such
+// conditional writes. prune removes the object with the job files.
+func (s *s3Storage) claim(ctx context.Context, key string, _ time.Time) (bool, error) {
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETagExcept("*")
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, bytes.NewReader(nil), 0, opts)
+	switch minio.ToErrorResponse(err).StatusCode {
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// 409 is a concurrent claim of the same key.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func contentTypeFor(name string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(name))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// publishDir stores every file below dir, a directory inside cfg.WorkDir, so
+// other replicas can serve it. Local storage already holds it.
+func publishDir(ctx context.Context, dir string) error {
+	if !storage.remote() {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == partsDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(cfg.WorkDir, p)
+		if err != nil {
+			return err
+		}
+		return storage.put(ctx, filepath.ToSlash(rel), p)
+	})
+}
+
+// fetchJobFiles makes sure the files of a job stored by another replica are
+// present in its work directory, downloading the ones that are missing.
+func fetchJobFiles(ctx context.Context, jobID string) error {
+	if !storage.remote() {
+		return nil
+	}
+	keys, err := storage.list(ctx, jobID+"/")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fs.ErrNotExist
+	}
+	for _, key := range keys {
+		dst := filepath.Join(cfg.WorkDir, filepath.FromSlash(key))
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := fetchObject(ctx, key, dst); err != nil {
+			return fmt.Errorf("fetch %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func fetchObject(ctx context.Context, key, dst string) error {
+	obj, _, err := storage.open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	// Write under a temporary name so a concurrent reader never sees half a file.
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, obj); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// serveStored answers with the object under key: a redirect to a presigned
+// URL when the backend has them, the bytes otherwise. It reports false, having
+// written nothing, when there is no such object. A single-use link is spent
+// only here, once the object is known to exist, so a request that is turned
+// away leaves it for its recipient.
+func serveStored(w http.ResponseWriter, r *http.Request, key string, inline bool) bool {
+	filename := path.Base(key)
+	// A presigned URL would stay usable until it expires, so the file of a
+	// single-use link goes through this server.
+	err := errNoPresign
+	var u string
+	if r.URL.Query().Get("once") != "1" {
+		u, err = storage.presign(r.Context(), key, filename, inline)
+	}
+	if err == nil {
+		// Presigning does not check that the object exists.
+		if obj, _, err := storage.open(r.Context(), key); err == nil {
+			obj.Close()
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, u, http.StatusFound)
+			return true
+		}
+		return false
+	}
+	if !errors.Is(err, errNoPresign) {
+		slog.ErrorContext(r.Context(), "failed to presign", "key", key, "err", err)
+	}
+
+	obj, info, err := storage.open(r.Context(), key)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.ErrorContext(r.Context(), "failed to open stored file", "key", key, "err", err)
+		}
+		return false
+	}
+	defer obj.Close()
+	if !claimLink(w, r) {
+		return true
+	}
+	if !inline {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filename))
+	}
+	http.ServeContent(w, r, filename, info.ModTime, obj)
+	return true
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultJobPageSize = 50
+	maxJobPageSize     = 500
+)
+
+var (
+	jobsBucket       = []byte("jobs")
+	jobsByTimeBucket = []byte("jobs_by_time")
+)
+
+// jobRecord is what the store keeps about a job. Unlike the job directory it
+// outlives restarts and the cleanup of old outputs.
+type jobRecord struct {
+	ID          string              `json:"jobId"`
+	Tool        string              `json:"tool"`
+	Status      string              `json:"status"`
+	Client      string              `json:"client,omitempty"`
+	Owner       string              `json:"owner,omitempty"`
+	Params      map[string][]string `json:"params,omitempty"`
+	Inputs      []jobInput          `json:"inputs,omitempty"`
+	Outputs     []jobOutput         `json:"outputs,omitempty"`
+	Commands    []jobCommand        `json:"commands,omitempty"`
+	DownloadURL string              `json:"downloadUrl,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	CallbackURL string              `json:"callbackUrl,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	StartedAt   *time.Time          `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time          `json:"finishedAt,omitempty"`
+}
+
+type jobInput struct {
+	Field  string `json:"field"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type jobOutput struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// jobCommand is one external tool run of a job. Arguments are left out since
+// they may hold passwords.
+type jobCommand struct {
+	Binary     string `json:"binary"`
+	ExitCode   int    `json:"exitCode"` // -1 if it was killed or never started
+	DurationMS int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+	Stderr     string `json:"stderr,omitempty"` // the last few KiB
+}
+
+// jobStore persists job records in a bbolt file. Records are keyed by job ID;
+// a second bucket indexes them by creation time for listing.
+type jobStore struct {
+	db *bolt.DB
+}
+
+var store *jobStore
+
+// openJobStore opens the store at cfg.JobDB.
+// Jobs that were still queued or running when the process last stopped are
+// marked failed, since nothing will ever finish them.
+func openJobStore() (*jobStore, error) {
+	p := cfg.JobDB
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(p, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &jobStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsByTimeBucket, idempotencyBucket, usedLinksBucket, usageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		return b.ForEach(func(k, v []byte) error {
+			var rec jobRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return nil
+			}
+			if rec.Status != jobQueued && rec.Status != jobRunning {
+				return nil
+			}
+			rec.Status = jobFailed
+			rec.Error = "interrupted by server restart"
+			rec.FinishedAt = &now
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			return b.Put(k, data)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// ping reports whether the database can still be read.
+func (s *jobStore) ping() error {
+	return s.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func (s *jobStore) Close() error {
+	return s.db.Close()
+}
+
+func timeKey(t time.Time, id string) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, id...)
+}
+
+func (s *jobStore) put(rec jobRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(jobsBucket).Put([]byte(rec.ID), data); err != nil {
+			return err
+		}
+		return tx.Bucket(jobsByTimeBucket).Put(timeKey(rec.CreatedAt, rec.ID), nil)
+	})
+}
+
+func (s *jobStore) get(id string) (jobRecord, bool) {
+	var rec jobRecord
+	var found bool
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = json.Unmarshal(v, &rec) == nil
+		return nil
+	})
+	return rec, found
+}
+
+// jobFilter selects records for GET /api/jobs.
+type jobFilter struct {
+	Owner  string
+	Tool   string
+	Status string
+	Since  time.Time
+	Before []byte // time index key to continue from, exclusive
+	Limit  int
+}
+
+// list returns matching records, newest first, and the cursor for the next
+// page (nil when there is none).
+func (s *jobStore) list(f jobFilter) ([]jobRecord, []byte, error) {
+	recs := []jobRecord{}
+	var next []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		byID := tx.Bucket(jobsBucket)
+		c := tx.Bucket(jobsByTimeBucket).Cursor()
+
+		var k []byte
+		if f.Before != nil {
+			k, _ = c.Seek(f.Before)
+			if k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		} else {
+			k, _ = c.Last()
+		}
+
+		for ; k != nil; k, _ = c.Prev() {
+			if len(k) < 8 {
+				continue
+			}
+			created := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			if !f.Since.IsZero() && created.Before(f.Since) {
+				break
+			}
+			v := byID.Get(k[8:])
+			if v == nil {
+				continue
+			}
+			var rec jobRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				continue
+			}
+			if (f.Owner != "" && rec.Owner != f.Owner) || (f.Tool != "" && rec.Tool != f.Tool) || (f.Status != "" && rec.Status != f.Status) {
+				continue
+			}
+			if len(recs) == f.Limit {
+				next = append([]byte(nil), recs[len(recs)-1].timeKey()...)
+				break
+			}
+			recs = append(recs, rec)
+		}
+		return nil
+	})
+	return recs, next, err
+}
+
+func (rec jobRecord) timeKey() []byte {
+	return timeKey(rec.CreatedAt, rec.ID)
+}
+
+// prune drops records created before cutoff and reports how many there were.
+func (s *jobStore) prune(cutoff time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		byID := tx.Bucket(jobsBucket)
+		byTime := tx.Bucket(jobsByTimeBucket)
+		end := timeKey(cutoff, "")
+		// Collect first: deleting under a cursor makes it skip keys.
+		var stale [][]byte
+		c := byTime.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if len(k) >= 8 {
+				if err := byID.Delete(k[8:]); err != nil {
+					return err
+				}
+			}
+			if err := byTime.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(stale)
+		return nil
+	})
+	return n, err
+}
+
+// record captures the job's current state for the store.
+func (j *job) record() jobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec := jobRecord{
+		ID:          j.ID,
+		Tool:        j.Tool,
+		Status:      j.Status,
+		Client:      j.Client,
+		Owner:       j.Owner,
+		Params:      j.Params,
+		Inputs:      j.Inputs,
+		DownloadURL: j.DownloadURL,
+		Error:       j.Error,
+		CallbackURL: j.CallbackURL,
+		Commands:    slices.Clone(j.Commands),
+		CreatedAt:   j.CreatedAt,
+	}
+	if j.DownloadURL != "" {
+		rec.Outputs = []jobOutput{{Name: path.Base(downloadKey(j.DownloadURL)), URL: j.DownloadURL}}
+	}
+	if !j.StartedAt.IsZero() {
+		t := j.StartedAt
+		rec.StartedAt = &t
+	}
+	if !j.FinishedAt.IsZero() {
+		t := j.FinishedAt
+		rec.FinishedAt = &t
+	}
+	return rec
+}
+
+// persist writes the job's current state to the store.
+func (j *job) persist() {
+	if err := store.put(j.record()); err != nil {
+		j.log.Error("failed to save job record", "err", err)
+	}
+}
+
+// describe records who submitted the job and with what. Values of fields that
+// look like secrets are not kept.
+func (j *job) describe(r *http.Request, form *toolForm) {
+	params := make(map[string][]string, len(form.Value))
+	for k, vs := range form.Value {
+		switch {
+		case isSecretParam(k):
+			params[k] = []string{"[redacted]"}
+		case k == "steps":
+			params[k] = redactSteps(vs)
+		default:
+			params[k] = vs
+		}
+	}
+	var inputs []jobInput
+	for field, files := range form.File {
+		for _, f := range files {
+			inputs = append(inputs, jobInput{Field: field, Name: f.Filename, Size: f.Size, SHA256: f.SHA256})
+		}
+	}
+
+	j.mu.Lock()
+	j.Client = clientAddr(r)
+	j.Owner = callerID(r)
+	j.Params = params
+	j.Inputs = inputs
+	j.mu.Unlock()
+}
+
+func isSecretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"password", "passphrase", "secret", "token"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSteps hides secret params of pipeline steps, such as a protect
+// step's password.
+func redactSteps(vs []string) []string {
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		var steps []pipelineStep
+		if json.Unmarshal([]byte(v), &steps) != nil {
+			out[i] = v
+			continue
+		}
+		for _, step := range steps {
+			for k := range step.Params {
+				if isSecretParam(k) {
+					step.Params[k] = json.RawMessage(`"[redacted]"`)
+				}
+			}
+		}
+		data, _ := json.Marshal(steps)
+		out[i] = string(data)
+	}
+	return out
+}
+
+// clientAddr is the caller's address: the peer's, or, when the peer is one of
+// cfg.TrustedProxies, the right-most X-Forwarded-For hop that is not. Hops
+// further left are whatever the client chose to send.
+func clientAddr(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !trustedProxy(addr) {
+		return addr
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for _, hop := range slices.Backward(hops) {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		addr = hop
+	}
+	return addr
+}
+
+func trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, s := range cfg.TrustedProxies {
+		if p, err := parsePrefix(s); err == nil && p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix reads a CIDR range; a bare address is a range of one.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(s); err == nil {
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	return p.Masked(), err
+}
+
+func (rec jobRecord) statusResponse() jobStatusResponse {
+	return jobStatusResponse{
+		JobID:       rec.ID,
+		Tool:        rec.Tool,
+		Status:      rec.Status,
+		DownloadURL: rec.DownloadURL,
+		Error:       rec.Error,
+		CreatedAt:   rec.CreatedAt,
+		StartedAt:   rec.StartedAt,
+		FinishedAt:  rec.FinishedAt,
+		Commands:    rec.Commands,
+	}
+}
+
+type jobListResponse struct {
+	Jobs       []jobRecord `json:"jobs"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// handleJobList serves GET /api/jobs. Filters: tool, status, since (RFC 3339),
+// limit (default 50, at most 500) and cursor from a previous page's nextCursor.
+func handleJobList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := jobFilter{
+		Owner:  callerID(r),
+		Tool:   q.Get("tool"),
+		Status: q.Get("status"),
+		Limit:  defaultJobPageSize,
+	}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+		f.Since = t
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errorJSON(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		f.Limit = min(n, maxJobPageSize)
+	}
+	if v := q.Get("cursor"); v != "" {
+		k, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(k) < 8 {
+			errorJSON(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		f.Before = k
+	}
+
+	recs, next, err := store.list(f)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list jobs", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to list jobs")
+		return
+	}
+	resp := jobListResponse{Jobs: recs}
+	if next != nil {
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString(next)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
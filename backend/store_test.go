@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// withStore opens a fresh job store for the test.
+func withStore(t *testing.T) {
+	t.Helper()
+	prevDB, prevStore := cfg.JobDB, store
+	cfg.JobDB = filepath.Join(t.TempDir(), "jobs.db")
+	s, err := openJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	t.Cleanup(func() {
+		_ = s.db.Close()
+		cfg.JobDB, store = prevDB, prevStore
+	})
+}
+
+func TestClientAddr(t *testing.T) {
+	prev := cfg.TrustedProxies
+	t.Cleanup(func() { cfg.TrustedProxies = prev })
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.7"}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"no proxy", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"untrusted peer sends xff", "203.0.113.5:4000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client prepends a hop", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.1.2.3:4000", []string{"198.51.100.1, 192.0.2.7", "10.9.9.9"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:4000", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"trusted proxy without xff", "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"mapped address", "[::ffff:10.1.2.3]:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientAddr(r); got != tt.want {
+				t.Errorf("clientAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Requests are traced with OpenTelemetry: a span per HTTP request, continuing
+// the caller's trace when it sends a traceparent header, with children for
+// the job, the upload, page counting, every external tool, zipping and every
+// storage operation.
+//
+// tracing.exporter (PDF_TRACING_EXPORTER) is "none" (the default), "otlp"
+// or "stdout", which prints finished spans for local debugging. The OTLP
+// exporter speaks HTTP to tracing.endpoint (PDF_TRACING_ENDPOINT), e.g.
+// http://otel-collector:4318, or else to wherever the standard
+// OTEL_EXPORTER_OTLP_* variables point. tracing.sampleRatio
+// (PDF_TRACING_SAMPLE_RATIO) is the share of new traces recorded; traces
+// started by the caller follow the caller's decision.
+var tracer = otel.Tracer("pdf-backend")
+
+// setupTracing installs the configured exporter. The returned function
+// flushes the spans not yet exported.
+func setupTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Tracing.Exporter == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	ctx := context.Background()
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("pdf-backend")),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win.
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	}
+	switch cfg.Tracing.Exporter {
+	case "otlp":
+		var eopts []otlptracehttp.Option
+		if cfg.Tracing.Endpoint != "" {
+			eopts = append(eopts, otlptracehttp.WithEndpointURL(cfg.Tracing.Endpoint))
+		}
+		exp, err := otlptracehttp.New(ctx, eopts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithSyncer(exp))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// traceRequests starts the span of every request, named after the route
+// pattern it matches in mux.
+func traceRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		_, route := mux.Handler(r)
+		name := r.Method
+		if route != "" {
+			name += " " + strings.TrimPrefix(route, r.Method+" ")
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.HTTPRoute(route),
+				semconv.ClientAddress(clientAddr(r)),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// startSpan starts a child span of whatever ctx carries.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed when err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// redactArgs returns a copy of a tool's arguments fit for a span: passwords
+// are replaced and long inline scripts shortened.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	hide := 0
+	for i, a := range args {
+		switch {
+		case hide > 0:
+			a = "REDACTED"
+			hide--
+		case a == "--encrypt":
+			// qpdf --encrypt <user-password> <owner-password> <bits>
+			hide = 2
+		case strings.HasPrefix(a, "--password="):
+			a = "--password=REDACTED"
+		case a == "-upw" || a == "-opw":
+			hide = 1
+		case len(a) > 200:
+			a = fmt.Sprintf("%s... (%d bytes)", a[:40], len(a))
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// tracedStorage wraps a storage backend with a span per operation.
+type tracedStorage struct {
+	storageBackend
+}
+
+func (s tracedStorage) put(ctx context.Context, key, src string) (err error) {
+	ctx, span := startSpan(ctx, "storage.put", attribute.String("storage.key", key))
+	defer func() { endSpan(span, err) }()
+	return s.storageBackend.put(ctx, key, src)
+}
+
+func (s tracedStorage) open(ctx context.Context, key string) (_ io.ReadSeekCloser, _ storedObject, err error) {
+	ctx, span := startSpan(ctx, "storage.open", attribute.String("storage.key", key))
+	defer func() { endSpan(span, err) }()
+	return s.storageBackend.open(ctx, key)
+}
+
+func (s tracedStorage) list(ctx context.Context, prefix string) (keys []string, err error) {
+	ctx, span := startSpan(ctx, "storage.list", attribute.String("storage.prefix", prefix))
+	defer func() {
+		span.SetAttributes(attribute.Int("storage.keys", len(keys)))
+		endSpan(span, err)
+	}()
+	return s.storageBackend.list(ctx, prefix)
+}
+
+func (s tracedStorage) presign(ctx context.Context, key, filename string, inline bool) (_ string, err error) {
+	ctx, span := startSpan(ctx, "storage.presign", attribute.String("storage.key", key))
+	defer func() {
+		if errors.Is(err, errNoPresign) {
+			endSpan(span, nil)
+			return
+		}
+		endSpan(span, err)
+	}()
+	return s.storageBackend.presign(ctx, key, filename, inline)
+}
+
+func (s tracedStorage) claim(ctx context.Context, key string, expires time.Time) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "storage.claim", attribute.String("storage.key", key))
+	defer func() { endSpan(span, err) }()
+	return s.storageBackend.claim(ctx, key, expires)
+}
+
+func (s tracedStorage) prune(ctx context.Context, cutoff time.Time) (err error) {
+	ctx, span := startSpan(ctx, "storage.prune", attribute.String("storage.cutoff", cutoff.UTC().Format(time.RFC3339)))
+	defer func() { endSpan(span, err) }()
+	return s.storageBackend.prune(ctx, cutoff)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+func TestRedactArgs(t *testing.T) {
+	long := strings.Repeat("a", 250)
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"plain", []string{"-png", "-r", "150", "in.pdf", "page"}, []string{"-png", "-r", "150", "in.pdf", "page"}},
+		{"qpdf encrypt", []string{"--encrypt", "user", "owner", "256", "--", "in.pdf", "out.pdf"}, []string{"--encrypt", "REDACTED", "REDACTED", "256", "--", "in.pdf", "out.pdf"}},
+		{"qpdf password", []string{"--password=hunter2", "--decrypt", "in.pdf"}, []string{"--password=REDACTED", "--decrypt", "in.pdf"}},
+		{"poppler passwords", []string{"-upw", "user", "-opw", "owner", "in.pdf"}, []string{"-upw", "REDACTED", "-opw", "REDACTED", "in.pdf"}},
+		{"password at the end", []string{"-upw"}, []string{"-upw"}},
+		{"long script", []string{"-c", long}, []string{"-c", long[:40] + "... (250 bytes)"}},
+		{"exactly 200 bytes", []string{long[:200]}, []string{long[:200]}},
+		{"none", nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := slices.Clone(tt.args)
+			got := redactArgs(in)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("redactArgs(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+			if !slices.Equal(in, tt.args) {
+				t.Errorf("the arguments were changed to %q", in)
+			}
+		})
+	}
+}
+
+func TestCommandSpanRedactsArgs(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	// true ignores its arguments, standing in for qpdf.
+	if err := execCommand(context.Background(), t.TempDir(), io.Discard, io.Discard, "true", "--encrypt", "hunter2", "hunter2", "256"); err != nil {
+		t.Fatal(err)
+	}
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	for _, kv := range spans[0].Attributes() {
+		if kv.Key != semconv.ProcessCommandArgsKey {
+			continue
+		}
+		if got, want := kv.Value.AsStringSlice(), []string{"true", "--encrypt", "REDACTED", "REDACTED", "256"}; !slices.Equal(got, want) {
+			t.Errorf("process.command_args = %q, want %q", got, want)
+		}
+		return
+	}
+	t.Error("span has no process.command_args")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uploadFields are the form fields that may carry an upload ID instead of a
+// file part.
+var uploadFields = []string{"file", "files", "file1", "file2"}
+
+// Resumable uploads are kept in cfg.UploadDir, outside the work directory so
+// /downloads/ never serves them; once a tool takes one it is moved into the
+// job directory.
+
+// uploadInfo is the metadata of a resumable upload. The offset is not stored:
+// it is the size of the data file, so it is right even after a crash.
+type uploadInfo struct {
+	ID        string    `json:"uploadId"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (u uploadInfo) complete() bool {
+	return u.Offset == u.Size
+}
+
+// uploadLocks serialises PATCH requests to the same upload.
+var uploadLocks sync.Map
+
+func lockUpload(id string) func() {
+	v, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func uploadDir(id string) (string, bool) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", false
+	}
+	return filepath.Join(cfg.UploadDir, id), true
+}
+
+func loadUpload(id string) (uploadInfo, error) {
+	dir, ok := uploadDir(id)
+	if !ok {
+		return uploadInfo{}, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "info.json"))
+	if err != nil {
+		return uploadInfo{}, err
+	}
+	var info uploadInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return uploadInfo{}, err
+	}
+	fi, err := os.Stat(filepath.Join(dir, "data"))
+	if err != nil {
+		return uploadInfo{}, err
+	}
+	info.Offset = fi.Size()
+	return info, nil
+}
+
+// handleUploadCreate serves POST /api/uploads. The total size comes in the
+// Upload-Length header and the file name in Upload-Filename (or ?filename=).
+func handleUploadCreate(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		errorJSON(w, http.StatusBadRequest, "Upload-Length header with the file size is required")
+		return
+	}
+	if size > int64(cfg.Uploads.MaxResumableSize) {
+		errorJSON(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads are limited to %s", formatByteSize(int64(cfg.Uploads.MaxResumableSize))))
+		return
+	}
+	name := r.Header.Get("Upload-Filename")
+	if name == "" {
+		name = r.URL.Query().Get("filename")
+	}
+
+	info := uploadInfo{
+		ID:        uuid.NewString(),
+		Filename:  sanitizeFilename(name),
+		Size:      size,
+		Owner:     callerID(r),
+		CreatedAt: time.Now(),
+	}
+	info.ExpiresAt = info.CreatedAt.Add(cfg.Uploads.ResumableRetention)
+
+	dir := filepath.Join(cfg.UploadDir, info.ID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	meta, _ := json.Marshal(info)
+	if err := os.WriteFile(filepath.Join(dir, "info.json"), meta, 0o644); err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), nil, 0o644); err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/api/uploads/%s", inferBaseURL(r), info.ID))
+	w.Header().Set("Upload-Offset", "0")
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// handleUploadHead serves HEAD /api/uploads/{id}: the offset to resume from.
+func handleUploadHead(w http.ResponseWriter, r *http.Request) {
+	info, err := loadUpload(r.PathValue("id"))
+	if err != nil || !canAccess(r, info.Owner) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUploadStatus serves GET /api/uploads/{id}.
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	info, err := loadUpload(r.PathValue("id"))
+	if err != nil || !canAccess(r, info.Owner) {
+		errorJSON(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleUploadPatch serves PATCH /api/uploads/{id}. Upload-Offset must match
+// the bytes received so far; the body is appended straight to disk. Whatever
+// arrived before a dropped connection is kept, so the client resumes from the
+// offset reported by HEAD. The chunk's bytes count against the daily quota:
+// its Content-Length (or the rest of the upload) is charged before it is read,
+// and whatever does not arrive is refunded.
+func handleUploadPatch(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	unlock := lockUpload(id)
+	defer unlock()
+
+	info, err := loadUpload(id)
+	if err != nil || !canAccess(r, info.Owner) {
+		if err != nil {
+			uploadLocks.Delete(id)
+		}
+		errorJSON(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, "Upload-Offset header is required")
+		return
+	}
+	if offset != info.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+		errorJSON(w, http.StatusConflict, fmt.Sprintf("offset mismatch: upload is at %d", info.Offset))
+		return
+	}
+
+	remaining := info.Size - info.Offset
+	chunk := remaining
+	if r.ContentLength >= 0 && r.ContentLength < chunk {
+		chunk = r.ContentLength
+	}
+	if err := chargeQuota(w, r, usage{Bytes: chunk}); err != nil {
+		formErrorJSON(w, err)
+		return
+	}
+
+	dir, _ := uploadDir(id)
+	f, err := os.OpenFile(filepath.Join(dir, "data"), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		refundQuota(r, usage{Bytes: chunk})
+		errorJSON(w, http.StatusInternalServerError, "failed to open upload")
+		return
+	}
+	defer f.Close()
+
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, chunk))
+	if copyErr == nil && n == chunk && chunk == remaining {
+		// Anything past the declared size is refused.
+		var extra [1]byte
+		if m, _ := r.Body.Read(extra[:]); m > 0 {
+			_ = f.Truncate(info.Offset)
+			refundQuota(r, usage{Bytes: chunk})
+			errorJSON(w, http.StatusRequestEntityTooLarge, "chunk goes past Upload-Length")
+			return
+		}
+	}
+	refundQuota(r, usage{Bytes: chunk - n})
+	info.Offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	if copyErr != nil {
+		slog.InfoContext(r.Context(), "upload interrupted", "upload_id", id, "offset", info.Offset, "err", copyErr)
+		errorJSON(w, http.StatusBadRequest, "upload interrupted; resume from Upload-Offset")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUploadDelete serves DELETE /api/uploads/{id}.
+func handleUploadDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	dir, ok := uploadDir(id)
+	if !ok {
+		errorJSON(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	unlock := lockUpload(id)
+	defer unlock()
+	if info, err := loadUpload(id); err != nil || !canAccess(r, info.Owner) {
+		errorJSON(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	_ = os.RemoveAll(dir)
+	uploadLocks.Delete(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkUploadRefs makes sure every upload ID given in place of a file refers
+// to a finished upload of the caller.
+func checkUploadRefs(r *http.Request, form *toolForm) error {
+	for _, field := range uploadFields {
+		for _, id := range form.Value[field] {
+			info, err := loadUpload(strings.TrimSpace(id))
+			if err != nil || !canAccess(r, info.Owner) {
+				return fmt.Errorf("%s: unknown upload %q", field, id)
+			}
+			if !info.complete() {
+				return fmt.Errorf("%s: upload %s is incomplete (%d of %d bytes)", field, info.ID, info.Offset, info.Size)
+			}
+		}
+	}
+	return nil
+}
+
+// cleanupOldUploads removes uploads that were never used by a tool once they
+// expire. A directory without readable metadata goes by its age.
+func cleanupOldUploads() {
+	entries, err := os.ReadDir(cfg.UploadDir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		id := e.Name()
+		expired := false
+		if info, err := loadUpload(id); err == nil {
+			expired = now.After(info.ExpiresAt)
+		} else if fi, err := e.Info(); err == nil {
+			expired = fi.ModTime().Before(now.Add(-cfg.Uploads.ResumableRetention))
+		}
+		if !expired {
+			continue
+		}
+		unlock := lockUpload(id)
+		err := os.RemoveAll(filepath.Join(cfg.UploadDir, id))
+		uploadLocks.Delete(id)
+		unlock()
+		if err == nil {
+			cleanupDeletions.WithLabelValues("upload").Inc()
+		}
+	}
+}
+
+// uploadedFile is a tool input already on disk: a file part streamed into the
+// job directory, a finished resumable upload, or a pipeline step's input.
+type uploadedFile struct {
+	Filename string
+	Size     int64
+	SHA256   string
+
+	path     string
+	uploadID string
+}
+
+// dataPath is where f's bytes are until it is saved.
+func (f *uploadedFile) dataPath() string {
+	if f.uploadID != "" {
+		dir, _ := uploadDir(f.uploadID)
+		return filepath.Join(dir, "data")
+	}
+	return f.path
+}
+
+var errNoFile = errors.New("no file")
+
+// formFiles returns the files sent in field: file parts first, then
+// finished resumable uploads of the caller named by ID.
+func formFiles(r *http.Request, field string) []*uploadedFile {
+	files := append([]*uploadedFile(nil), filesFromContext(r.Context())[field]...)
+	if r.MultipartForm == nil {
+		return files
+	}
+	for _, id := range r.MultipartForm.Value[field] {
+		info, err := loadUpload(strings.TrimSpace(id))
+		if err != nil || !info.complete() || !canAccess(r, info.Owner) {
+			continue
+		}
+		files = append(files, &uploadedFile{Filename: info.Filename, Size: info.Size, uploadID: info.ID})
+	}
+	return files
+}
+
+// formFile returns the first file sent in field.
+func formFile(r *http.Request, field string) (*uploadedFile, error) {
+	files := formFiles(r, field)
+	if len(files) == 0 {
+		return nil, errNoFile
+	}
+	return files[0], nil
+}
+
+// saveUploadedFile moves f to dst. The file is already on disk, normally in
+// the same job directory, so this is a rename rather than another copy. Each
+// file can be saved once.
+func saveUploadedFile(f *uploadedFile, dst string) error {
+	if f.uploadID != "" {
+		return claimUpload(f.uploadID, dst)
+	}
+	return moveFile(f.path, dst)
+}
+
+func claimUpload(id, dst string) error {
+	unlock := lockUpload(id)
+	defer unlock()
+	dir, ok := uploadDir(id)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if err := moveFile(filepath.Join(dir, "data"), dst); err != nil {
+		return err
+	}
+	uploadLocks.Delete(id)
+	return os.RemoveAll(dir)
+}
+
+// moveFile renames src to dst, copying when they are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// withAuth enables authentication for the test, with one API key per name.
+func withAuth(t *testing.T, names ...string) {
+	t.Helper()
+	prev := auth
+	t.Cleanup(func() { auth = prev })
+	auth = authConfig{}
+	for _, name := range names {
+		auth.apiKeys = append(auth.apiKeys, apiKey{name: name})
+	}
+}
+
+// withUploadDir points cfg.UploadDir at a fresh directory for the test.
+func withUploadDir(t *testing.T) {
+	t.Helper()
+	prev := cfg.UploadDir
+	t.Cleanup(func() { cfg.UploadDir = prev })
+	cfg.UploadDir = t.TempDir()
+}
+
+// makeUpload writes a finished resumable upload owned by owner.
+func makeUpload(t *testing.T, owner string, data []byte) uploadInfo {
+	t.Helper()
+	info := uploadInfo{
+		ID:        uuid.NewString(),
+		Filename:  "in.pdf",
+		Size:      int64(len(data)),
+		Owner:     owner,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	dir := filepath.Join(cfg.UploadDir, info.ID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := json.Marshal(info)
+	if err := os.WriteFile(filepath.Join(dir, "info.json"), meta, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func requestAs(caller string, form *toolForm) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+	r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal{ID: caller, Method: "api-key"}))
+	return withForm(r, form)
+}
+
+func TestFormFilesOwner(t *testing.T) {
+	withAuth(t, "alice", "mallory")
+	withUploadDir(t)
+	up := makeUpload(t, "alice", []byte("%PDF-1.4\n%%EOF\n"))
+	form := &toolForm{Value: url.Values{"files": {up.ID}}}
+
+	tests := []struct {
+		caller string
+		want   int
+	}{
+		{"alice", 1},
+		{"mallory", 0},
+	}
+	for _, tt := range tests {
+		r := requestAs(tt.caller, form)
+		if got := len(formFiles(r, "files")); got != tt.want {
+			t.Errorf("formFiles as %s: got %d files, want %d", tt.caller, got, tt.want)
+		}
+		if err := checkUploadRefs(r, form); (err == nil) != (tt.want == 1) {
+			t.Errorf("checkUploadRefs as %s: err = %v", tt.caller, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.UploadDir, up.ID, "data")); err != nil {
+		t.Errorf("upload was touched: %v", err)
+	}
+}
+
+func TestPipelineStepUploadParam(t *testing.T) {
+	// A step param naming an upload would bypass checkUploadRefs, which only
+	// sees the pipeline's own form.
+	for _, field := range uploadFields {
+		raw := `[{"tool": "compress", "params": {"` + field + `": "` + uuid.NewString() + `"}}]`
+		_, _, err := parsePipelineSteps(raw)
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("param %q: err = %v, want it refused", field, err)
+		}
+	}
+	if _, _, err := parsePipelineSteps(`[{"tool": "compress", "params": {"level": "high"}}]`); err != nil {
+		t.Errorf("ordinary param refused: %v", err)
+	}
+}
+
+func TestCleanupOldUploads(t *testing.T) {
+	withUploadDir(t)
+	live := makeUpload(t, "", []byte("data"))
+	stale := makeUpload(t, "", []byte("data"))
+	stale.ExpiresAt = time.Now().Add(-time.Minute)
+	meta, _ := json.Marshal(stale)
+	if err := os.WriteFile(filepath.Join(cfg.UploadDir, stale.ID, "info.json"), meta, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lockUpload(stale.ID)()
+
+	cleanupOldUploads()
+
+	if _, err := loadUpload(live.ID); err != nil {
+		t.Errorf("unexpired upload removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.UploadDir, stale.ID)); !os.IsNotExist(err) {
+		t.Errorf("expired upload kept: %v", err)
+	}
+	if _, ok := uploadLocks.Load(stale.ID); ok {
+		t.Error("lock of expired upload kept")
+	}
+}
+
+// failingBody yields data and then fails, like a dropped connection.
+type failingBody struct{ data []byte }
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+// patchUpload sends a PATCH with body and the given Content-Length.
+func patchUpload(id string, offset int64, body io.Reader, length int64) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/api/uploads/"+id, body)
+	r.ContentLength = length
+	r.SetPathValue("id", id)
+	r.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	rec := httptest.NewRecorder()
+	handleUploadPatch(rec, r)
+	return rec
+}
+
+func TestUploadPatchQuota(t *testing.T) {
+	withStore(t)
+	withUploadDir(t)
+	withQuota(t, rateSettings{}, quotaSettings{Bytes: 10})
+	r := httptest.NewRequest(http.MethodPost, "/api/uploads", nil)
+	r.Header.Set("Upload-Length", "16")
+	rec := httptest.NewRecorder()
+	handleUploadCreate(rec, r)
+	var info uploadInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	client := clientIdentity(r)
+
+	steps := []struct {
+		name       string
+		offset     int64
+		body       io.Reader
+		length     int64
+		want       int
+		wantOffset int64
+		wantUsed   int64
+	}{
+		{"first chunk", 0, strings.NewReader("aaaaaa"), 6, http.StatusNoContent, 6, 6},
+		{"chunk over quota", 6, strings.NewReader("bbbbbb"), 6, http.StatusTooManyRequests, 6, 6},
+		{"interrupted chunk", 6, &failingBody{[]byte("cc")}, 4, http.StatusBadRequest, 8, 8},
+		{"chunk that fits", 8, strings.NewReader("dd"), 2, http.StatusNoContent, 10, 10},
+		{"quota spent", 10, strings.NewReader("e"), 1, http.StatusTooManyRequests, 10, 10},
+	}
+	for _, st := range steps {
+		rec := patchUpload(info.ID, st.offset, st.body, st.length)
+		if rec.Code != st.want {
+			t.Errorf("%s: %d %s, want %d", st.name, rec.Code, rec.Body, st.want)
+		}
+		if got, _ := loadUpload(info.ID); got.Offset != st.wantOffset {
+			t.Errorf("%s: offset %d, want %d", st.name, got.Offset, st.wantOffset)
+		}
+		if used := usedToday(t, client); used.Bytes != st.wantUsed {
+			t.Errorf("%s: charged %d bytes, want %d", st.name, used.Bytes, st.wantUsed)
+		}
+	}
+
+	// A job using the upload is not charged for its bytes again.
+	form := &toolForm{Value: url.Values{"file": {info.ID}}}
+	if total, charge := formUsage(form, 0); total.Bytes != info.Size || charge.Bytes != 0 {
+		t.Errorf("formUsage = %+v, %+v; want %d bytes in total and none to charge", total, charge, info.Size)
+	}
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	withUploadDir(t)
+	withQuota(t, rateSettings{Requests: 1, Per: time.Minute, Burst: 1}, quotaSettings{})
+	up := makeUpload(t, "", nil)
+
+	tests := []struct {
+		name string
+		send func() *httptest.ResponseRecorder
+		want int
+	}{
+		{"create", func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/api/uploads", nil)
+			r.Header.Set("Upload-Length", "4")
+			rec := httptest.NewRecorder()
+			handleUploadCreate(rec, r)
+			return rec
+		}, http.StatusCreated},
+		{"second create", func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/api/uploads", nil)
+			r.Header.Set("Upload-Length", "4")
+			rec := httptest.NewRecorder()
+			handleUploadCreate(rec, r)
+			return rec
+		}, http.StatusTooManyRequests},
+		{"patch", func() *httptest.ResponseRecorder {
+			return patchUpload(up.ID, 0, strings.NewReader(""), 0)
+		}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		rec := tt.send()
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+		if tt.want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+}
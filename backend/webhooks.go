@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook delivery settings. A delivery is retried on network errors, 429 and
+// 5xx with exponential backoff; any other response ends it.
+const (
+	webhookMaxAttempts  = 6
+	webhookInitialDelay = 2 * time.Second
+	webhookMaxDelay     = 5 * time.Minute
+	webhookTimeout      = 10 * time.Second
+)
+
+// webhookClient connects only where html-to-pdf may fetch from: public
+// addresses of hosts the fetch policy allows, checked when the connection is
+// made. See fetchpolicy.go.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext:         fetchDialer.DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	// A redirect would resend the signed payload somewhere the caller did not name.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var errCallbacksDisabled = errors.New("callbacks are not enabled on this server")
+
+// webhookPayload is the body POSTed to a job's callbackUrl.
+type webhookPayload struct {
+	Event       string    `json:"event"`
+	JobID       string    `json:"jobId"`
+	Tool        string    `json:"tool"`
+	Status      string    `json:"status"`
+	DownloadURL string    `json:"downloadUrl,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	FinishedAt  time.Time `json:"finishedAt"`
+}
+
+// callbackURLFrom returns the callbackUrl of a tool submission, if any. It may
+// come as a form field or a query parameter.
+func callbackURLFrom(r *http.Request, form *toolForm) (string, error) {
+	raw := r.URL.Query().Get("callbackUrl")
+	if vs := form.Value["callbackUrl"]; len(vs) > 0 {
+		raw = vs[0]
+	}
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	// Callbacks are refused while there is no secret to sign them with, since
+	// receivers would have no way to tell our requests from anyone else's.
+	if cfg.WebhookSecret == "" {
+		return "", errCallbacksDisabled
+	}
+	u, err := checkFetchURL(r.Context(), raw)
+	var blocked *fetchBlockedError
+	if errors.As(err, &blocked) {
+		return "", &formError{http.StatusForbidden, fmt.Sprintf("callbackUrl %s is not allowed: %s", blocked.target, blocked.reason)}
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid callbackUrl: %w", err)
+	}
+	return u.String(), nil
+}
+
+// signWebhook returns the X-Signature-256 value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of "<timestamp>.<body>" under the webhook secret.
+func signWebhook(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyCallback posts the job's final state to its callbackUrl in the
+// background. It does nothing for jobs submitted without one.
+func notifyCallback(j *job) {
+	j.mu.Lock()
+	target := j.CallbackURL
+	payload := webhookPayload{
+		Event:       "job.finished",
+		JobID:       j.ID,
+		Tool:        j.Tool,
+		Status:      j.Status,
+		DownloadURL: j.DownloadURL,
+		Error:       j.Error,
+		FinishedAt:  j.FinishedAt,
+	}
+	j.mu.Unlock()
+	if target == "" {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		j.log.Error("failed to encode callback", "err", err)
+		return
+	}
+	// Shutdown waits for the delivery like for the job that started it.
+	holdWork()
+	go func() {
+		defer endWork()
+		deliverWebhook(j.log, j.ID, target, body)
+	}()
+}
+
+// deliverWebhook sends body to target until it is accepted, a permanent
+// failure comes back, webhookMaxAttempts is reached or the shutdown deadline
+// passes.
+func deliverWebhook(log *slog.Logger, jobID, target string, body []byte) {
+	delay := webhookInitialDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(jobID, target, body, attempt)
+		if err == nil {
+			log.Info("callback delivered", "attempt", attempt)
+			return
+		}
+		if !retry || attempt == webhookMaxAttempts {
+			log.Error("callback failed", "attempts", attempt, "err", err)
+			return
+		}
+		// Jitter keeps many failed deliveries from retrying in lockstep.
+		wait := delay/2 + rand.N(delay/2+1)
+		log.Warn("callback attempt failed", "attempt", attempt, "err", err, "retry_in", wait.Round(time.Millisecond).String())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-workCtx.Done():
+			timer.Stop()
+			log.Error("callback abandoned at shutdown", "attempts", attempt)
+			return
+		}
+		delay = min(delay*2, webhookMaxDelay)
+	}
+}
+
+// postWebhook makes one delivery attempt and reports whether a failure is
+// worth retrying.
+func postWebhook(jobID, target string, body []byte, attempt int) (bool, error) {
+	ctx, cancel := context.WithTimeout(workCtx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pdf-backend-webhook/1")
+	req.Header.Set("X-Webhook-Id", jobID)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Signature-256", signWebhook(timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		// A refused address stays refused.
+		var blocked *fetchBlockedError
+		return !errors.As(err, &blocked), err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("receiver answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+}
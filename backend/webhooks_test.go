@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withWebhookSecret(t *testing.T, secret string) {
+	t.Helper()
+	prev := cfg.WebhookSecret
+	t.Cleanup(func() { cfg.WebhookSecret = prev })
+	cfg.WebhookSecret = secret
+}
+
+func TestCallbackURLFrom(t *testing.T) {
+	withWebhookSecret(t, "s3cret")
+	prevDeny := cfg.Fetch.DenyHosts
+	t.Cleanup(func() { cfg.Fetch.DenyHosts = prevDeny })
+	cfg.Fetch.DenyHosts = []string{"*.internal.example"}
+
+	tests := []struct {
+		raw    string
+		status int // 0 when accepted
+	}{
+		{"https://203.0.113.10/hook", 0},
+		{"http://127.0.0.1:8080/hook", http.StatusForbidden},
+		{"http://[::1]/hook", http.StatusForbidden},
+		{"http://169.254.169.254/latest/meta-data", http.StatusForbidden},
+		{"http://10.0.0.5/hook", http.StatusForbidden},
+		{"http://[::ffff:192.168.1.1]/hook", http.StatusForbidden},
+		{"http://api.internal.example/hook", http.StatusForbidden},
+		{"ftp://203.0.113.10/hook", http.StatusBadRequest},
+		{"http:///hook", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+		form := &toolForm{Value: url.Values{"callbackUrl": {tt.raw}}}
+		got, err := callbackURLFrom(r, form)
+		if tt.status == 0 {
+			if err != nil || got != tt.raw {
+				t.Errorf("%s: got %q, %v; want it accepted", tt.raw, got, err)
+			}
+			continue
+		}
+		status := http.StatusBadRequest
+		var fe *formError
+		if errors.As(err, &fe) {
+			status = fe.status
+		}
+		if err == nil || status != tt.status {
+			t.Errorf("%s: err = %v (status %d), want status %d", tt.raw, err, status, tt.status)
+		}
+	}
+}
+
+func TestCallbackURLWithoutSecret(t *testing.T) {
+	withWebhookSecret(t, "")
+	r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress?callbackUrl=https://203.0.113.10/hook", nil)
+	if _, err := callbackURLFrom(r, &toolForm{Value: url.Values{}}); !errors.Is(err, errCallbacksDisabled) {
+		t.Errorf("err = %v, want errCallbacksDisabled", err)
+	}
+}
+
+// receiver is a stand-in webhook endpoint that records what it gets.
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	status := rc.status
+	rc.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	withWebhookSecret(t, "s3cret")
+	rc := &receiver{status: http.StatusNoContent}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	// The stand-in listens on loopback, which the real client refuses.
+	prev := webhookClient
+	t.Cleanup(func() { webhookClient = prev })
+	webhookClient = srv.Client()
+
+	payload := webhookPayload{
+		Event:       "job.finished",
+		JobID:       "job-1",
+		Tool:        "compress",
+		Status:      jobSucceeded,
+		DownloadURL: "https://pdf.example/downloads/job-1/out.pdf",
+		FinishedAt:  time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	body, _ := json.Marshal(payload)
+	deliverWebhook(slog.New(slog.DiscardHandler), payload.JobID, srv.URL+"/hook", body)
+
+	if len(rc.requests) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(rc.requests))
+	}
+	req, got := rc.requests[0], rc.bodies[0]
+	var decoded webhookPayload
+	if err := json.Unmarshal(got, &decoded); err != nil || decoded != payload {
+		t.Errorf("payload = %s, want %+v", got, payload)
+	}
+	if req.Method != http.MethodPost || req.URL.Path != "/hook" {
+		t.Errorf("got %s %s, want POST /hook", req.Method, req.URL.Path)
+	}
+	for header, want := range map[string]string{"Content-Type": "application/json", "X-Webhook-Id": "job-1", "X-Webhook-Attempt": "1"} {
+		if v := req.Header.Get(header); v != want {
+			t.Errorf("%s = %q, want %q", header, v, want)
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(req.Header.Get("X-Webhook-Timestamp") + "." + string(got)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Signature-256") != want {
+		t.Errorf("X-Signature-256 = %q, want %q", req.Header.Get("X-Signature-256"), want)
+	}
+}
+
+func TestDeliverWebhookPermanentFailure(t *testing.T) {
+	withWebhookSecret(t, "s3cret")
+	rc := &receiver{status: http.StatusBadRequest}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	prev := webhookClient
+	t.Cleanup(func() { webhookClient = prev })
+	webhookClient = srv.Client()
+
+	deliverWebhook(slog.New(slog.DiscardHandler), "job-1", srv.URL, []byte(`{}`))
+	if len(rc.requests) != 1 {
+		t.Errorf("got %d deliveries, want 1: 400 is not retried", len(rc.requests))
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	withWebhookSecret(t, "s3cret")
+	rc := &receiver{status: http.StatusNoContent}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	retry, err := postWebhook("job-1", srv.URL, []byte(`{}`), 1)
+	var blocked *fetchBlockedError
+	if !errors.As(err, &blocked) || retry {
+		t.Errorf("postWebhook to loopback: retry = %v, err = %v; want a refusal without retry", retry, err)
+	}
+	if len(rc.requests) != 0 {
+		t.Errorf("receiver got %d requests", len(rc.requests))
+	}
+}
@@ -6,9 +6,9 @@ export default function ToolHtmlToPdf() {
       title="HTML to PDF"
       description="Convert an HTML file or web page export into PDF."
       apiPath="/html-to-pdf"
-      accept="text/html,.html"
+      accept="text/html,.html,.zip"
       actionLabel="Convert to PDF"
-      helperText="Select an HTML file to convert."
+      helperText="Select an HTML file, or a ZIP of the page with its images and stylesheets (index.html at the top)."
     />
   );
 }
@@ -6,7 +6,7 @@ const ToolImageToPdf = () => {
     <ToolLayout
       title="Image to PDF"
       description="Convert one or more images into a single, high-quality PDF."
-      accept="image/*"
+      accept="image/png,image/jpeg,image/tiff"
       multiple
       actionLabel="Convert images to PDF"
       helperText="Select one or more images to convert."
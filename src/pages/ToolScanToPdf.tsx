@@ -6,7 +6,7 @@ const ToolScanToPdf = () => {
     <ToolLayout
       title="Scan to PDF"
       description="Turn photos or scans of documents into a clean, searchable PDF."
-      accept="image/*"
+      accept="image/png,image/jpeg,image/tiff"
       multiple
       actionLabel="Create PDF from scans"
       helperText="Select one or more images of your document pages."